@@ -0,0 +1,189 @@
+package balance_mirror
+
+import (
+	"context"
+	"time"
+
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/log"
+	"github.com/zly-app/zapp/pkg/utils"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/dao"
+	"github.com/zlyuancn/score/model"
+	"github.com/zlyuancn/score/score_type"
+	"github.com/zlyuancn/score/side_effect"
+)
+
+// 每次从镜像表读取的行数
+const reconcileBatchSize = 100
+
+// 写入积分余额镜像
+func writeBalanceMirror(ctx context.Context, flow *dao.ScoreFlowModel) error {
+	v := &dao.ScoreBalanceMirrorModel{
+		ScoreTypeID: flow.ScoreTypeID,
+		Domain:      flow.Domain,
+		Uid:         flow.Uid,
+		OrderID:     flow.OrderID,
+		Score:       flow.ResultScore,
+		OrderTime:   flow.OrderTime,
+	}
+	err := dao.WriteScoreBalanceMirror(ctx, v)
+	if err != nil {
+		log.Error(ctx, "writeBalanceMirror call dao.WriteScoreBalanceMirror fail.", zap.Any("flow", flow), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+type ScoreChangeSideEffect struct {
+	side_effect.BaseSideEffect
+}
+
+func (ScoreChangeSideEffect) AfterScoreChange(ctx context.Context, st *model.ScoreType, data *model.SideEffectData, flow *dao.ScoreFlowModel) error {
+	if !conf.Conf.WriteScoreBalanceMirror {
+		return nil
+	}
+	// 余额没有变化
+	if flow.OldScore == flow.ResultScore {
+		return nil
+	}
+
+	err := writeBalanceMirror(ctx, flow)
+	if err != nil {
+		log.Error(ctx, "SideEffect.AfterScoreChange call writeBalanceMirror fail.", zap.Any("data", data), zap.Any("flow", flow), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// 启动积分余额镜像核对守护程序, 配置的核对间隔为0或注册了其它储存时不启动
+func StartReconcile(app core.IApp) {
+	if conf.Conf.ReconcileBalanceMirrorIntervalSec < 1 || dao.CheckRedisStore() != nil {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(conf.Conf.ReconcileBalanceMirrorIntervalSec) * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-app.BaseContext().Done():
+				return
+			case <-t.C:
+				_, _ = Reconcile(app.BaseContext(), conf.Conf.RepairBalanceMirrorDrift)
+			}
+		}
+	}()
+}
+
+// 核对积分余额镜像. 遍历镜像表, 将每一行与redis中的余额以及最新流水的结果积分比较, 返回发现的差异.
+//
+// repair 为true时修复差异:
+//   - redis中的积分数据不存在时, 只有最新流水的结果积分与镜像一致时才使用镜像中的余额恢复. 没有流水可以确认时无法判断镜像是否正确, 不会恢复
+//   - redis中的余额与镜像不一致时以redis为准修复镜像
+//   - 流水只会报告差异, 不会修改
+//
+// 注册了其它储存时返回 dao.ErrStoreNotSupported
+func Reconcile(ctx context.Context, repair bool) ([]*model.BalanceDrift, error) {
+	ctx = utils.Trace.CtxStart(ctx, "reconcileBalanceMirror")
+	defer utils.Trace.CtxEnd(ctx)
+
+	err := dao.CheckRedisStore()
+	if err != nil {
+		log.Error(ctx, "Reconcile err", zap.Error(err))
+		return nil, err
+	}
+
+	var ret []*model.BalanceDrift
+	var afterID uint64
+	for {
+		rows, err := dao.GetScoreBalanceMirrors(ctx, afterID, reconcileBatchSize)
+		if err != nil {
+			log.Error(ctx, "Reconcile call dao.GetScoreBalanceMirrors fail.", zap.Uint64("afterID", afterID), zap.Error(err))
+			return ret, err
+		}
+		for _, row := range rows {
+			drift, err := reconcileOne(ctx, row, repair)
+			if err != nil {
+				log.Error(ctx, "Reconcile call reconcileOne fail.", zap.Any("row", row), zap.Error(err))
+				return ret, err
+			}
+			if drift != nil {
+				ret = append(ret, drift)
+			}
+		}
+		if len(rows) < reconcileBatchSize {
+			return ret, nil
+		}
+		afterID = rows[len(rows)-1].ID
+	}
+}
+
+// 核对一行镜像, 没有差异时返回nil
+func reconcileOne(ctx context.Context, row *dao.ScoreBalanceMirrorModel, repair bool) (*model.BalanceDrift, error) {
+	st, err := score_type.ForceGetScoreType(ctx, row.ScoreTypeID)
+	if err == score_type.ErrScoreTypeNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	drift := &model.BalanceDrift{
+		ScoreTypeID:   row.ScoreTypeID,
+		Domain:        row.Domain,
+		Uid:           row.Uid,
+		MirrorScore:   row.Score,
+		MirrorOrderID: row.OrderID,
+	}
+
+	// 批次模式无法从一个余额恢复批次, 只比较余额
+	if st.LotMode {
+		drift.RedisScore, err = dao.GetLotScore(ctx, row.ScoreTypeID, row.Domain, row.Uid, time.Now().Unix())
+		drift.RedisExists = true
+	} else {
+		drift.RedisScore, drift.RedisExists, err = dao.GetRedisScoreWithExists(ctx, row.ScoreTypeID, row.Domain, row.Uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var flow *dao.ScoreFlowModel
+	if conf.Conf.WriteScoreFlow {
+		flow, err = dao.GetLatestScoreFlowBefore(ctx, row.ScoreTypeID, row.Domain, row.Uid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if flow != nil {
+		drift.FlowScore = flow.ResultScore
+		drift.FlowOrderID = flow.OrderID
+	}
+
+	flowMatched := flow == nil || flow.ResultScore == drift.RedisScore
+	if drift.RedisExists && drift.RedisScore == row.Score && flowMatched {
+		return nil, nil
+	}
+
+	if repair {
+		switch {
+		case !drift.RedisExists:
+			if flow != nil && flow.ResultScore == row.Score {
+				drift.Repaired, err = dao.RestoreRedisScore(ctx, row.ScoreTypeID, row.Domain, row.Uid, row.Score)
+			}
+		case drift.RedisScore != row.Score:
+			orderID := ""
+			if flow != nil && flowMatched {
+				orderID = flow.OrderID
+			}
+			drift.Repaired, err = dao.RepairScoreBalanceMirror(ctx, row, orderID, drift.RedisScore)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Warn(ctx, "reconcile balance mirror found drift", zap.Any("drift", drift))
+	return drift, nil
+}
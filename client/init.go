@@ -26,3 +26,13 @@ func GetScoreTypeRedisClient() (redis.UniversalClient, error) {
 func GetScoreFlowSqlxClient() sqlx.Client {
 	return sqlx.GetClient(conf.Conf.ScoreFlowSqlxName)
 }
+
+// 获取积分余额镜像 sqlx 客户端
+func GetScoreBalanceMirrorSqlxClient() sqlx.Client {
+	return sqlx.GetClient(conf.Conf.ScoreBalanceMirrorSqlxName)
+}
+
+// 获取mysql储存 sqlx 客户端
+func GetScoreStoreSqlxClient() sqlx.Client {
+	return sqlx.GetClient(conf.Conf.ScoreStoreSqlxName)
+}
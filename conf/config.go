@@ -10,6 +10,16 @@ const (
 	defGenOrderSeqNoKeyFormat            = "score_sn:<score_type_id>:<score_type_id_shard>"
 	defGenOrderSeqNoKeyShardNum          = 1000
 	defGenOrderSideEffectStatusKeyFormat = "score_oses:<order_id>:<side_effect_type>:<side_effect>:{<uid>}"
+	defScoreFrozenKeyFormat              = "score_frozen:<score_type_id>:<domain>:{<uid>}"
+	defScoreQuotaKeyFormat               = "score_quota:<score_type_id>:<domain>:<quota>:{<uid>}"
+	defScoreLotKeyFormat                 = "score_lot:<score_type_id>:<domain>:{<uid>}"
+	defScoreLotExpireKeyFormat           = "score_lot_ex:<score_type_id>:<domain>:{<uid>}"
+	defScoreWalletKeyFormat              = "score_wallet:{<uid>}"
+	defScoreSupplyKeyFormat              = "score_supply:<score_type_id>:<domain>:{<slot_tag>}"
+	defLeaderboardKeyFormat              = "score_rank:<score_type_id>:<domain>"
+	defFrozenTimeoutKeyFormat            = "score_frozen_timeout:{<slot_tag>}"
+	defCheckFrozenTimeoutIntervalSec     = 10
+	defScoreSupplyCacheSec               = 10
 
 	defScoreTypeRedisName         = "score"
 	defScoreTypeRedisKey          = "score:score_type"
@@ -18,6 +28,12 @@ const (
 	defScoreFlowSqlxName       = "score"
 	defWriteScoreFlow          = false
 	defScoreFlowTableShardNums = 2
+
+	defScoreStoreSqlxName           = "score"
+	defPurgeStoreExpiredIntervalSec = 3600
+
+	defScoreBalanceMirrorSqlxName = "score"
+	defWriteScoreBalanceMirror    = false
 )
 
 var Conf = Config{
@@ -28,6 +44,16 @@ var Conf = Config{
 	GenOrderSeqNoKeyFormat:            defGenOrderSeqNoKeyFormat,
 	GenOrderSeqNoKeyShardNum:          defGenOrderSeqNoKeyShardNum,
 	GenOrderSideEffectStatusKeyFormat: defGenOrderSideEffectStatusKeyFormat,
+	ScoreFrozenKeyFormat:              defScoreFrozenKeyFormat,
+	ScoreQuotaKeyFormat:               defScoreQuotaKeyFormat,
+	ScoreLotKeyFormat:                 defScoreLotKeyFormat,
+	ScoreLotExpireKeyFormat:           defScoreLotExpireKeyFormat,
+	ScoreWalletKeyFormat:              defScoreWalletKeyFormat,
+	ScoreSupplyKeyFormat:              defScoreSupplyKeyFormat,
+	LeaderboardKeyFormat:              defLeaderboardKeyFormat,
+	FrozenTimeoutKeyFormat:            defFrozenTimeoutKeyFormat,
+	CheckFrozenTimeoutIntervalSec:     defCheckFrozenTimeoutIntervalSec,
+	ScoreSupplyCacheSec:               defScoreSupplyCacheSec,
 
 	ScoreTypeRedisName:         defScoreTypeRedisName,
 	ScoreTypeRedisKey:          defScoreTypeRedisKey,
@@ -37,6 +63,14 @@ var Conf = Config{
 	ScoreFlowSqlxName:       defScoreFlowSqlxName,
 	WriteScoreFlow:          defWriteScoreFlow,
 	ScoreFlowTableShardNums: defScoreFlowTableShardNums,
+
+	ScoreStoreSqlxName:           defScoreStoreSqlxName,
+	PurgeStoreExpiredIntervalSec: defPurgeStoreExpiredIntervalSec,
+
+	ScoreBalanceMirrorSqlxName:        defScoreBalanceMirrorSqlxName,
+	WriteScoreBalanceMirror:           defWriteScoreBalanceMirror,
+	ReconcileBalanceMirrorIntervalSec: 0,
+	RepairBalanceMirrorDrift:          false,
 }
 
 type Config struct {
@@ -47,6 +81,16 @@ type Config struct {
 	GenOrderSeqNoKeyFormat            string // 订单号生成器key格式化字符串
 	GenOrderSeqNoKeyShardNum          int32  // 生成订单序列号key的分片数
 	GenOrderSideEffectStatusKeyFormat string // 生成订单副作用key格式化字符串
+	ScoreFrozenKeyFormat              string // 冻结积分数据key格式化字符串
+	ScoreQuotaKeyFormat               string // 周期配额key格式化字符串
+	ScoreLotKeyFormat                 string // 积分批次数据key格式化字符串
+	ScoreLotExpireKeyFormat           string // 积分批次过期时间key格式化字符串
+	ScoreWalletKeyFormat              string // 用户钱包key格式化字符串, 记录用户有积分数据的积分类型和域
+	ScoreSupplyKeyFormat              string // 积分供应量key格式化字符串, redis集群中按用户积分数据key所在的slot分片
+	LeaderboardKeyFormat              string // 排行榜key格式化字符串
+	FrozenTimeoutKeyFormat            string // 冻结超时数据key格式化字符串, 用于自动取消超时的冻结, redis集群中按用户积分数据key所在的slot分片
+	CheckFrozenTimeoutIntervalSec     int    // 检查冻结超时间隔秒数
+	ScoreSupplyCacheSec               int    // 供应量分片合并结果的缓存秒数, 只在redis集群中使用, 0表示不缓存
 
 	ScoreTypeRedisName         string // 积分类型redis组件名
 	ScoreTypeRedisKey          string // 积分类型从redis加载的 hash map key名
@@ -56,6 +100,14 @@ type Config struct {
 	ScoreFlowSqlxName       string // 积分流水记录sqlx组件名
 	WriteScoreFlow          bool   // 是否写入积分流水
 	ScoreFlowTableShardNums uint32 // 积分流水记录表分片数量
+
+	ScoreStoreSqlxName           string // mysql储存的sqlx组件名, 只有注册了mysql储存时才会使用
+	PurgeStoreExpiredIntervalSec int    // 清理mysql储存中已过期的订单状态/订单副作用状态/周期配额的间隔秒数, 0表示不清理
+
+	ScoreBalanceMirrorSqlxName        string // 积分余额镜像sqlx组件名
+	WriteScoreBalanceMirror           bool   // 是否写入积分余额镜像
+	ReconcileBalanceMirrorIntervalSec int    // 核对积分余额镜像间隔秒数, 0表示不自动核对
+	RepairBalanceMirrorDrift          bool   // 自动核对时是否修复差异
 }
 
 func (conf *Config) Check() {
@@ -77,6 +129,36 @@ func (conf *Config) Check() {
 	if conf.GenOrderSideEffectStatusKeyFormat == "" {
 		conf.GenOrderSideEffectStatusKeyFormat = defGenOrderSideEffectStatusKeyFormat
 	}
+	if conf.ScoreFrozenKeyFormat == "" {
+		conf.ScoreFrozenKeyFormat = defScoreFrozenKeyFormat
+	}
+	if conf.ScoreQuotaKeyFormat == "" {
+		conf.ScoreQuotaKeyFormat = defScoreQuotaKeyFormat
+	}
+	if conf.ScoreLotKeyFormat == "" {
+		conf.ScoreLotKeyFormat = defScoreLotKeyFormat
+	}
+	if conf.ScoreLotExpireKeyFormat == "" {
+		conf.ScoreLotExpireKeyFormat = defScoreLotExpireKeyFormat
+	}
+	if conf.ScoreWalletKeyFormat == "" {
+		conf.ScoreWalletKeyFormat = defScoreWalletKeyFormat
+	}
+	if conf.ScoreSupplyKeyFormat == "" {
+		conf.ScoreSupplyKeyFormat = defScoreSupplyKeyFormat
+	}
+	if conf.LeaderboardKeyFormat == "" {
+		conf.LeaderboardKeyFormat = defLeaderboardKeyFormat
+	}
+	if conf.FrozenTimeoutKeyFormat == "" {
+		conf.FrozenTimeoutKeyFormat = defFrozenTimeoutKeyFormat
+	}
+	if conf.CheckFrozenTimeoutIntervalSec < 1 {
+		conf.CheckFrozenTimeoutIntervalSec = defCheckFrozenTimeoutIntervalSec
+	}
+	if conf.ScoreSupplyCacheSec < 0 {
+		conf.ScoreSupplyCacheSec = 0
+	}
 
 	if conf.ScoreTypeRedisName == "" && conf.ScoreTypeSqlxName == "" {
 		conf.ScoreTypeRedisName = defScoreTypeRedisName
@@ -94,4 +176,18 @@ func (conf *Config) Check() {
 	if conf.ScoreFlowTableShardNums < 1 {
 		conf.ScoreFlowTableShardNums = defScoreFlowTableShardNums
 	}
+
+	if conf.ScoreStoreSqlxName == "" {
+		conf.ScoreStoreSqlxName = defScoreStoreSqlxName
+	}
+	if conf.PurgeStoreExpiredIntervalSec < 0 {
+		conf.PurgeStoreExpiredIntervalSec = 0
+	}
+
+	if conf.ScoreBalanceMirrorSqlxName == "" {
+		conf.ScoreBalanceMirrorSqlxName = defScoreBalanceMirrorSqlxName
+	}
+	if conf.ReconcileBalanceMirrorIntervalSec < 0 {
+		conf.ReconcileBalanceMirrorIntervalSec = 0
+	}
 }
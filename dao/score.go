@@ -32,12 +32,16 @@ const (
 	templateString_ScoreTypeIDShard = "<score_type_id_shard>"
 	templateString_SideEffect       = "<side_effect>"
 	templateString_SideEffectType   = "<side_effect_type>"
+	templateString_Quota            = "<quota>"
 )
 
 // status 在redis写入的数据为  操作类型_操作状态_旧值_变更值_新的值
 
 const (
-	// 增加/扣除积分 KEYS=[积分数据key, 订单状态key]  ARGV=[增加/扣除积分值, 订单状态key有效期]
+	// 增加/扣除积分 KEYS=[积分数据key, 订单状态key, 积分批次数据key, 积分批次过期时间key, 余额不足时写入的订单状态key, 配额key..., 用户钱包key, 积分供应量key]
+	// ARGV=[增加/扣除积分值, 订单状态key有效期, 最小余额, 最大余额, 是否为批次模式, 当前时间, 批次过期时间, 订单id,
+	//       是否检查当前余额, 期望的当前余额, 是否为部分扣除, 配额数量, 每个配额的(周期内最大积分值, 周期内最大订单数, 配额key有效期)..., 钱包成员,
+	//       余额不足时写入的订单状态key有效期]
 	addScoreLua = `
 -- 获取订单状态
 local status = redis.call('GET', KEYS[2])
@@ -48,38 +52,304 @@ end
 
 local changeScore = tonumber(ARGV[1])
 local ex = tonumber(ARGV[2])
+local minScore = tonumber(ARGV[3])
+local maxScore = tonumber(ARGV[4])
+local lotMode = ARGV[5] == '1'
+local now = ARGV[6]
+local lotExpire = ARGV[7]
+local orderID = ARGV[8]
+local checkOld = ARGV[9] == '1'
+local expectedOld = tonumber(ARGV[10])
+local upTo = ARGV[11] == '1'
+local quotaNum = tonumber(ARGV[12])
 
--- 增减积分
-local nowScore = redis.call('INCRBY', KEYS[1], changeScore)
--- 检查余额不足
-if nowScore < 0 then
-    -- 回退
-    redis.call('INCRBY', KEYS[1], -changeScore)
-    -- 余额不足状态
+-- 批次模式下先清理已过期的批次
+if lotMode then
+    local expired = redis.call('ZRANGEBYSCORE', KEYS[4], '-inf', now)
+    for _, lot in ipairs(expired) do
+        local amount = tonumber(redis.call('HGET', KEYS[3], lot) or '0')
+        redis.call('DECRBY', KEYS[1], amount)
+        redis.call('HINCRBY', KEYS[#KEYS], 'expire', amount)
+        redis.call('HDEL', KEYS[3], lot)
+    end
+    redis.call('ZREMRANGEBYSCORE', KEYS[4], '-inf', now)
+end
+
+-- 检查当前余额. 1=成功, 9=余额已变化
+local state = '1'
+if checkOld and tonumber(redis.call('GET', KEYS[1]) or '0') ~= expectedOld then
+    state = '9'
+end
+
+-- 部分扣除时最多扣除到最小余额
+if upTo and changeScore < 0 then
+    local available = tonumber(redis.call('GET', KEYS[1]) or '0') - minScore
+    if available < 0 then
+        available = 0
+    end
+    if -changeScore > available then
+        changeScore = -available
+    end
+end
+local absScore = changeScore
+if absScore < 0 then
+    absScore = -absScore
+end
+
+-- 检查配额. 8=超过配额
+for i = 1, quotaNum do
+    if state ~= '1' then
+        break
+    end
+    local quotaScore = tonumber(ARGV[10 + i * 3])
+    local quotaOrders = tonumber(ARGV[11 + i * 3])
+    local used = redis.call('HMGET', KEYS[5 + i], 's', 'n')
+    local usedScore = tonumber(used[1] or '0')
+    local usedOrders = tonumber(used[2] or '0')
+    if (quotaScore > 0 and usedScore + absScore > quotaScore) or (quotaOrders > 0 and usedOrders + 1 > quotaOrders) then
+        state = '8'
+        break
+    end
+end
+
+local oldScore
+local nowScore
+if state == '1' then
+    -- 增减积分
+    nowScore = redis.call('INCRBY', KEYS[1], changeScore)
+    oldScore = nowScore - changeScore
+    -- 检查余额限制. 2=余额不足, 7=超过余额上限
+    if changeScore < 0 and nowScore < minScore then
+        state = '2'
+    elseif changeScore > 0 and maxScore > 0 and nowScore > maxScore then
+        state = '7'
+    end
+    if state ~= '1' then
+        -- 回退
+        redis.call('INCRBY', KEYS[1], -changeScore)
+        nowScore = oldScore
+    end
+else
+    oldScore = tonumber(redis.call('GET', KEYS[1]) or '0')
+    nowScore = oldScore
+end
+
+-- 记录到用户钱包和积分供应量, 占用配额
+if state == '1' then
+    redis.call('SADD', KEYS[#KEYS - 1], ARGV[#ARGV - 1])
     if changeScore > 0 then
-        status = '1_2_' .. tostring(nowScore-changeScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore-changeScore)
+        redis.call('HINCRBY', KEYS[#KEYS], 'add', changeScore)
     else
-        status = '2_2_' .. tostring(nowScore-changeScore) .. '_' .. tostring(-changeScore) .. '_' .. tostring(nowScore-changeScore)
+        redis.call('HINCRBY', KEYS[#KEYS], 'deduct', -changeScore)
     end
-else
-    -- 成功状态
+    for i = 1, quotaNum do
+        redis.call('HINCRBY', KEYS[5 + i], 's', absScore)
+        redis.call('HINCRBY', KEYS[5 + i], 'n', 1)
+        if redis.call('TTL', KEYS[5 + i]) < 0 then
+            redis.call('EXPIRE', KEYS[5 + i], ARGV[12 + i * 3])
+        end
+    end
+end
+
+-- 批次模式下增加积分时写入批次, 扣除积分时按过期时间从早到晚消耗批次
+if state == '1' and lotMode then
     if changeScore > 0 then
-        status = '1_1_' .. tostring(nowScore-changeScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+        redis.call('HINCRBY', KEYS[3], orderID, changeScore)
+        redis.call('ZADD', KEYS[4], lotExpire, orderID)
     else
-        status = '2_1_' .. tostring(nowScore-changeScore) .. '_' .. tostring(-changeScore) .. '_' .. tostring(nowScore)
+        local remain = -changeScore
+        while remain > 0 do
+            local lots = redis.call('ZRANGE', KEYS[4], 0, 99)
+            if #lots == 0 then
+                break
+            end
+            for _, lot in ipairs(lots) do
+                local amount = tonumber(redis.call('HGET', KEYS[3], lot) or '0')
+                if amount > remain then
+                    redis.call('HINCRBY', KEYS[3], lot, -remain)
+                    remain = 0
+                    break
+                end
+                remain = remain - amount
+                redis.call('HDEL', KEYS[3], lot)
+                redis.call('ZREM', KEYS[4], lot)
+            end
+        end
     end
 end
 
--- 写入状态
+if changeScore > 0 then
+    status = '1_' .. state .. '_' .. tostring(oldScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+else
+    status = '2_' .. state .. '_' .. tostring(oldScore) .. '_' .. tostring(-changeScore) .. '_' .. tostring(nowScore)
+end
+
+-- 写入状态. 余额不足时可能写入到另一个订单状态key中, 此时订单不会被锁定
+local statusKey = KEYS[2]
+if state == '2' and KEYS[5] ~= KEYS[2] then
+    statusKey = KEYS[5]
+    ex = tonumber(ARGV[#ARGV])
+end
 if ex < 1 then
-    redis.call('SET', KEYS[2], status)
+    redis.call('SET', statusKey, status)
 else
-    redis.call('SET', KEYS[2], status, 'ex', ex)
+    redis.call('SET', statusKey, status, 'ex', ex)
 end
 return status .. '_0'
 `
 
-	// 重设积分 KEYS=[积分数据key, 订单状态key]  ARGV=[重设结果, 订单状态key有效期]
+	// 转移积分, 用于转账/兑换 KEYS=[转出方积分数据key, 转入方积分数据key, 转出方订单状态key, 转入方订单状态key, 转出方钱包key, 转入方钱包key,
+	//                            转出方积分供应量key, 转入方积分供应量key, 转出方关联订单标记key]
+	// ARGV=[转出积分值, 转入积分值, 订单状态key有效期, 转出方最小余额, 转入方最大余额, 转出方钱包成员, 转入方钱包成员]
+	moveScoreLua = `
+-- 获取订单状态
+local status = redis.call('GET', KEYS[3])
+-- 如果状态已写入则表示订单已完成, 直接返回状态
+if status ~= false then
+    local toStatus = redis.call('GET', KEYS[4])
+    if toStatus == false then
+        toStatus = ''
+    end
+    return {status .. '_1', toStatus .. '_1'}
+end
+
+local fromChangeScore = tonumber(ARGV[1])
+local toChangeScore = tonumber(ARGV[2])
+local ex = tonumber(ARGV[3])
+local fromMinScore = tonumber(ARGV[4])
+local toMaxScore = tonumber(ARGV[5])
+
+-- 获取双方积分
+local fromScore = tonumber(redis.call('GET', KEYS[1]) or '0')
+local toScore = tonumber(redis.call('GET', KEYS[2]) or '0')
+
+-- 检查余额限制. 2=余额不足, 7=超过余额上限
+local state
+if fromScore - fromChangeScore < fromMinScore then
+    state = '2'
+elseif toMaxScore > 0 and toScore + toChangeScore > toMaxScore then
+    state = '7'
+end
+
+local toStatus
+if state ~= nil then
+    -- 双方积分均不变
+    status = '2_' .. state .. '_' .. tostring(fromScore) .. '_' .. tostring(fromChangeScore) .. '_' .. tostring(fromScore)
+    toStatus = '1_' .. state .. '_' .. tostring(toScore) .. '_' .. tostring(toChangeScore) .. '_' .. tostring(toScore)
+else
+    -- 转出方扣除, 转入方增加
+    local fromResult = redis.call('DECRBY', KEYS[1], fromChangeScore)
+    local toResult = redis.call('INCRBY', KEYS[2], toChangeScore)
+    redis.call('SADD', KEYS[5], ARGV[6])
+    redis.call('SADD', KEYS[6], ARGV[7])
+    redis.call('HINCRBY', KEYS[7], 'deduct', fromChangeScore)
+    redis.call('HINCRBY', KEYS[8], 'add', toChangeScore)
+    status = '2_1_' .. tostring(fromResult+fromChangeScore) .. '_' .. tostring(fromChangeScore) .. '_' .. tostring(fromResult)
+    toStatus = '1_1_' .. tostring(toResult-toChangeScore) .. '_' .. tostring(toChangeScore) .. '_' .. tostring(toResult)
+end
+
+-- 写入状态, 并标记转出方订单为关联订单
+if ex < 1 then
+    redis.call('SET', KEYS[3], status)
+    redis.call('SET', KEYS[4], toStatus)
+    redis.call('SET', KEYS[9], '1')
+else
+    redis.call('SET', KEYS[3], status, 'ex', ex)
+    redis.call('SET', KEYS[4], toStatus, 'ex', ex)
+    redis.call('SET', KEYS[9], '1', 'ex', ex)
+end
+return {status .. '_0', toStatus .. '_0'}
+`
+
+	// 冲正订单 KEYS=[积分数据key, 原订单状态key, 订单状态key, 积分供应量key, 原订单关联订单标记key, 余额不足时写入的订单状态key]
+	// ARGV=[订单状态key有效期, 最小余额, 最大余额, 余额不足时写入的订单状态key有效期]
+	reverseOrderLua = `
+-- 获取订单状态
+local status = redis.call('GET', KEYS[3])
+-- 如果状态已写入则表示订单已完成, 直接返回状态
+if status ~= false then
+    return status .. '_1'
+end
+
+local ex = tonumber(ARGV[1])
+local minScore = tonumber(ARGV[2])
+local maxScore = tonumber(ARGV[3])
+
+-- 获取原订单状态
+local originStatus = redis.call('GET', KEYS[2])
+if originStatus == false then
+    return redis.error_reply('order not found')
+end
+local originOp, originState, originOld, originChange, originResult = string.match(originStatus, '^(%d+)_(%d+)_([^_]*)_([^_]*)_([^_]*)$')
+if originState == '6' then
+    return redis.error_reply('order reversed')
+end
+-- 关联订单只是整个操作的一部分, 不允许冲正
+if redis.call('EXISTS', KEYS[5]) == 1 then
+    return redis.error_reply('order not reversible')
+end
+if originState ~= '1' or (originOp ~= '1' and originOp ~= '2' and originOp ~= '3') then
+    return redis.error_reply('order not reversible')
+end
+
+local changeScore = tonumber(originChange)
+local nowScore = tonumber(redis.call('GET', KEYS[1]) or '0')
+
+if originOp == '1' then
+    -- 扣除增加的积分
+    if nowScore - changeScore < minScore then
+        status = '2_2_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+    else
+        local resultScore = redis.call('DECRBY', KEYS[1], changeScore)
+        redis.call('HINCRBY', KEYS[4], 'deduct', changeScore)
+        status = '2_1_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(resultScore)
+    end
+elseif originOp == '2' then
+    -- 返还扣除的积分
+    if maxScore > 0 and nowScore + changeScore > maxScore then
+        status = '1_7_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+    else
+        local resultScore = redis.call('INCRBY', KEYS[1], changeScore)
+        redis.call('HINCRBY', KEYS[4], 'add', changeScore)
+        status = '1_1_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(resultScore)
+    end
+else
+    -- 恢复重置前的积分
+    if maxScore > 0 and tonumber(originOld) > maxScore then
+        status = '3_7_' .. tostring(nowScore) .. '_' .. originOld .. '_' .. tostring(nowScore)
+    else
+        redis.call('SET', KEYS[1], originOld)
+        redis.call('HINCRBY', KEYS[4], 'reset', tonumber(originOld) - nowScore)
+        status = '3_1_' .. tostring(nowScore) .. '_' .. originOld .. '_' .. originOld
+    end
+end
+
+-- 标记原订单已冲正, 保留其有效期
+if string.match(status, '^%d+_1_') then
+    originStatus = originOp .. '_6_' .. originOld .. '_' .. originChange .. '_' .. originResult
+    local ttl = redis.call('PTTL', KEYS[2])
+    if ttl > 0 then
+        redis.call('SET', KEYS[2], originStatus, 'px', ttl)
+    else
+        redis.call('SET', KEYS[2], originStatus)
+    end
+end
+
+-- 写入状态, 余额不足时写入本次尝试的订单状态key
+local statusKey = KEYS[3]
+if string.match(status, '^%d+_2_') and KEYS[6] ~= KEYS[3] then
+    statusKey = KEYS[6]
+    ex = tonumber(ARGV[4])
+end
+if ex < 1 then
+    redis.call('SET', statusKey, status)
+else
+    redis.call('SET', statusKey, status, 'ex', ex)
+end
+return status .. '_0'
+`
+
+	// 重设积分 KEYS=[积分数据key, 订单状态key, 用户钱包key, 积分供应量key]  ARGV=[重设结果, 订单状态key有效期, 最大余额, 是否检查当前余额, 期望的当前余额, 钱包成员]
 	resetScoreLua = `
 -- 获取订单状态
 local status = redis.call('GET', KEYS[2])
@@ -90,6 +360,9 @@ end
 
 local changeScore = tonumber(ARGV[1])
 local ex = tonumber(ARGV[2])
+local maxScore = tonumber(ARGV[3])
+local checkOld = ARGV[4] == '1'
+local expectedOld = tonumber(ARGV[5])
 
 -- 获取之前的积分
 local oldScore = redis.call('GET', KEYS[1])
@@ -97,9 +370,19 @@ if oldScore == false then
     oldScore = '0'
 end
 
--- 重设积分
-redis.call('SET', KEYS[1], changeScore)
-status = '3_1_' .. tostring(oldScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(changeScore)
+if checkOld and tonumber(oldScore) ~= expectedOld then
+    -- 余额已变化
+    status = '3_9_' .. tostring(oldScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(oldScore)
+elseif maxScore > 0 and changeScore > maxScore then
+    -- 超过余额上限
+    status = '3_7_' .. tostring(oldScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(oldScore)
+else
+    -- 重设积分, 记录到用户钱包
+    redis.call('SET', KEYS[1], changeScore)
+    redis.call('SADD', KEYS[3], ARGV[6])
+    redis.call('HINCRBY', KEYS[4], 'reset', changeScore - tonumber(oldScore))
+    status = '3_1_' .. tostring(oldScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(changeScore)
+end
 
 -- 写入状态
 if ex < 1 then
@@ -113,12 +396,95 @@ return status .. '_0'
 
 // 脚本sha1值, 如果存在则使用 EVALSHA 执行脚本
 var (
-	addScoreLuaSha1   = ""
-	resetScoreLuaSha1 = ""
+	addScoreLuaSha1     = ""
+	moveScoreLuaSha1    = ""
+	reverseOrderLuaSha1 = ""
+	resetScoreLuaSha1   = ""
+)
+
+var (
+	// 订单不存在
+	ErrOrderNotFound = errors.New("order not found")
+	// 订单已冲正
+	ErrOrderReversed = errors.New("order reversed")
+	// 订单不允许冲正
+	ErrOrderNotReversible = errors.New("order not reversible")
+	// 转出方和转入方的key不在redis集群的同一个slot, 无法在一个lua脚本中转账
+	ErrCrossSlotTransfer = errors.New("cross slot transfer is not supported on redis cluster")
 )
 
-// 订单不存在
-var ErrOrderNotFound = errors.New("order not found")
+// 关联订单标记的后缀. 转账/兑换/多积分类型原子操作/按优先级扣除会为生成订单id的订单写入标记,
+// 这些订单只是整个操作的一部分, 单独冲正会导致积分凭空产生, 所以不允许冲正
+const linkedOrderIDSuffix = "_linked"
+
+// 生成关联订单标记key, 与订单状态key在同一个slot
+func genLinkedOrderKey(uid string, orderID string) string {
+	return genOrderStatusKey(uid, orderID+linkedOrderIDSuffix)
+}
+
+// 根据流水的订单id和关联订单id获取需要写入关联订单标记的订单id, 不需要时返回空.
+// 转账/兑换的转出方流水关联转入方的订单id, 多积分类型原子操作/按优先级扣除第1个之后的分项流水关联第一个分项的订单id.
+// 只有一个分项的多积分类型原子操作/按优先级扣除没有关联订单id, 无法识别
+func GetLinkedOrderID(orderID string, linkOrderID string) string {
+	if linkOrderID == "" {
+		return ""
+	}
+	if linkOrderID == GenTransferInOrderID(orderID) {
+		return orderID
+	}
+	index, ok := strings.CutPrefix(orderID, linkOrderID+"_")
+	if !ok || index == "" {
+		return ""
+	}
+	for _, c := range index {
+		if c < '0' || c > '9' {
+			return ""
+		}
+	}
+	return linkOrderID
+}
+
+// 检查订单是否为转账/兑换/多积分类型原子操作/按优先级扣除的订单, 这些订单不允许冲正
+func IsLinkedOrder(ctx context.Context, orderID string, uid string) (bool, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return false, err
+	}
+	n, err := rdb.Exists(ctx, genLinkedOrderKey(uid, orderID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// 转账/兑换时转入方订单id的后缀
+const transferInOrderIDSuffix = "_in"
+
+// 生成转账/兑换时转入方的订单id, 转入方使用这个订单id记录订单状态和流水
+func GenTransferInOrderID(orderID string) string {
+	return orderID + transferInOrderIDSuffix
+}
+
+const rejectedOrderIDSuffix = "_rejected_"
+
+// 生成余额不足时不锁定订单的本次尝试的订单id, 使用这个订单id记录订单状态和流水
+func GenRejectedOrderID(orderID string) string {
+	return orderID + rejectedOrderIDSuffix + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// 本次尝试的订单状态和副作用状态的最长有效期. 每次余额不足都会生成新的订单id, 只用于记录流水和执行副作用, 不需要保留到积分类型的订单状态保留天数
+const rejectedOrderStatusExpireSec = 86400
+
+// 获取订单状态和副作用状态的有效期, 本次尝试的订单id最多保留 rejectedOrderStatusExpireSec. statusExpireSec 小于1表示永不过期
+func genOrderStatusExpireSec(orderID string, statusExpireSec int64) int64 {
+	if !strings.Contains(orderID, rejectedOrderIDSuffix) {
+		return statusExpireSec
+	}
+	if statusExpireSec < 1 || statusExpireSec > rejectedOrderStatusExpireSec {
+		return rejectedOrderStatusExpireSec
+	}
+	return statusExpireSec
+}
 
 // 生成积分数据key
 func genScoreDataKey(scoreTypeID uint32, domain string, uid string) string {
@@ -137,6 +503,16 @@ func genOrderStatusKey(uid string, orderID string) string {
 	return text
 }
 
+// 生成配额key
+func genScoreQuotaKey(scoreTypeID uint32, domain string, uid string, quota string) string {
+	text := conf.Conf.ScoreQuotaKeyFormat
+	text = strings.ReplaceAll(text, templateString_ScoreTypeID, strconv.FormatInt(int64(scoreTypeID), 10))
+	text = strings.ReplaceAll(text, templateString_Domain, domain)
+	text = strings.ReplaceAll(text, templateString_Quota, quota)
+	text = strings.ReplaceAll(text, templateString_Uid, uid)
+	return text
+}
+
 // 生成订单副作用状态key
 func genOrderSideEffectStatusKey(uid string, orderID string, sideEffectName string, sideEffectType int) string {
 	text := conf.Conf.GenOrderSideEffectStatusKeyFormat
@@ -156,7 +532,7 @@ func genGenOrderSeqNoKey(scoreTypeID uint32, scoreTypeIdShard int32) string {
 }
 
 // 获取积分
-func GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
+func (redisStore) GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
 	key := genScoreDataKey(scoreTypeID, domain, uid)
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
@@ -170,7 +546,7 @@ func GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string
 }
 
 // 生成订单序列号
-func GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
+func (redisStore) GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
 	shard := rand.Int31n(conf.Conf.GenOrderSeqNoKeyShardNum)
 	key := genGenOrderSeqNoKey(scoreTypeID, shard)
 	rdb, err := client.GetScoreRedisClient()
@@ -181,27 +557,70 @@ func GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid s
 	if err != nil {
 		return "", err
 	}
+	return formatOrderSeqNo(time.Now().Unix(), shard, no, scoreTypeID, domain, uid), nil
+}
+
+// 批量生成订单序列号, 所有订单号使用同一个分片并通过一次 incrby 获取序列号
+func GenOrderSeqNos(ctx context.Context, scoreTypeID uint32, domain string, uids []string) ([]string, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	shard := rand.Int31n(conf.Conf.GenOrderSeqNoKeyShardNum)
+	key := genGenOrderSeqNoKey(scoreTypeID, shard)
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+	end, err := rdb.IncrBy(ctx, key, int64(len(uids))).Uint64()
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Now().Unix()
+	start := end - uint64(len(uids)) + 1
+	ret := make([]string, len(uids))
+	for i, uid := range uids {
+		ret[i] = formatOrderSeqNo(t, shard, start+uint64(i), scoreTypeID, domain, uid)
+	}
+	return ret, nil
+}
+
+func formatOrderSeqNo(t int64, shard int32, no uint64, scoreTypeID uint32, domain string, uid string) string {
 	const orderSeqNoFormat = "%d_%d_%s_%s_%d_%s"
 	uidHash := crc32.ChecksumIEEE([]byte(uid))
 	uidHashHex := strconv.FormatInt(int64(uidHash), 16)
 	domainHash := crc32.ChecksumIEEE([]byte(domain))
 	domainHashHex := strconv.FormatInt(int64(domainHash), 16)
 
-	t := time.Now().Unix()
-
 	// 限制编号不能达到 1e9. 这里个序列号分片能支撑每个用户每秒创建100w个订单
 	if no >= 1e9 {
 		no %= 1e9
 	}
 	noR := lcgr.ConfuseLimitLen(no, uint64(shard), 9)
 	noText := strconv.FormatUint(noR, 32)
-	return fmt.Sprintf(orderSeqNoFormat, t, shard, noText, uidHashHex, scoreTypeID, domainHashHex), nil
+	return fmt.Sprintf(orderSeqNoFormat, t, shard, noText, uidHashHex, scoreTypeID, domainHashHex)
+}
+
+// 增加/扣除积分选项
+type AddScoreOption struct {
+	MinScore int64          // 扣除后余额不能小于这个值
+	MaxScore int64          // 增加后余额不能大于这个值, 0表示不限制
+	Quotas   []*model.Quota // 周期配额, 只会检查与操作类型相同的配额
+
+	LotMode       bool  // 是否为批次模式
+	LotExpireTime int64 // 批次模式下增加的积分的过期时间, 秒级时间戳, 0表示永不过期
+
+	ExpectedOldScore *int64 // 期望的当前余额, 不为nil时只有当前余额等于这个值才会操作, 否则订单状态为余额已变化
+	UpTo             bool   // 部分扣除, 余额不足时扣除所有可用的积分而不是返回余额不足
+
+	// 余额不足时订单状态写入这个订单id而不锁定原订单, 之后可以使用原订单id重试. 为空表示余额不足时锁定原订单
+	RejectedOrderID string
 }
 
 // 增加/扣除积分
-func AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64) (*model.OrderData, model.OrderStatus, error) {
-	scoreDataKey := genScoreDataKey(scoreTypeID, domain, uid)
-	orderStatusKey := genOrderStatusKey(uid, orderID)
+func (redisStore) AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+	opt *AddScoreOption) (*model.OrderData, model.OrderStatus, error) {
+	keys, args := genAddScoreArgs(orderID, scoreTypeID, domain, uid, score, statusExpireSec, opt, time.Now())
 
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
@@ -209,14 +628,14 @@ func AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain st
 	}
 
 	if addScoreLuaSha1 != "" {
-		statusResult, err := rdb.EvalSha(ctx, addScoreLuaSha1, []string{scoreDataKey, orderStatusKey}, score, statusExpireSec).Result()
+		statusResult, err := rdb.EvalSha(ctx, addScoreLuaSha1, keys, args...).Result()
 		if err != nil {
 			return nil, 0, err
 		}
 		return parseStatus(cast.ToString(statusResult))
 	}
 
-	statusResult, err := rdb.Eval(ctx, addScoreLua, []string{scoreDataKey, orderStatusKey}, score, statusExpireSec).Result()
+	statusResult, err := rdb.Eval(ctx, addScoreLua, keys, args...).Result()
 	if err != nil {
 		return nil, 0, err
 	}
@@ -224,25 +643,213 @@ func AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain st
 	return parseStatus(cast.ToString(statusResult))
 }
 
-// 重设积分
-func ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, resetScore int64, statusExpireSec int64) (*model.OrderData, model.OrderStatus, error) {
+// 生成增加/扣除积分lua脚本的key和参数
+func genAddScoreArgs(orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+	opt *AddScoreOption, now time.Time) ([]string, []interface{}) {
 	scoreDataKey := genScoreDataKey(scoreTypeID, domain, uid)
 	orderStatusKey := genOrderStatusKey(uid, orderID)
 
+	op := model.OpType_Deduct
+	if score > 0 {
+		op = model.OpType_Add
+	}
+	quotaKeys, quotaArgs := genQuotaArgs(scoreTypeID, domain, uid, op, opt.Quotas, now)
+
+	lotMode, lotExpire := 0, "+inf"
+	if opt.LotMode {
+		lotMode = 1
+	}
+	if opt.LotExpireTime > 0 {
+		lotExpire = strconv.FormatInt(opt.LotExpireTime, 10)
+	}
+	checkOld, expectedOld := 0, int64(0)
+	if opt.ExpectedOldScore != nil {
+		checkOld, expectedOld = 1, *opt.ExpectedOldScore
+	}
+	upTo := 0
+	if opt.UpTo {
+		upTo = 1
+	}
+
+	rejectedStatusKey := orderStatusKey
+	if opt.RejectedOrderID != "" {
+		rejectedStatusKey = genOrderStatusKey(uid, opt.RejectedOrderID)
+	}
+
+	keys := append([]string{
+		scoreDataKey,
+		orderStatusKey,
+		genScoreLotKey(scoreTypeID, domain, uid),
+		genScoreLotExpireKey(scoreTypeID, domain, uid),
+		rejectedStatusKey,
+	}, quotaKeys...)
+	keys = append(keys, genScoreWalletKey(uid), genScoreSupplyKey(scoreTypeID, domain, uid))
+	args := append([]interface{}{
+		score, statusExpireSec, opt.MinScore, opt.MaxScore,
+		lotMode, now.Unix(), lotExpire, orderID,
+		checkOld, expectedOld, upTo,
+		len(quotaKeys),
+	}, quotaArgs...)
+	args = append(args, genWalletMember(scoreTypeID, domain), genOrderStatusExpireSec(opt.RejectedOrderID, statusExpireSec))
+	return keys, args
+}
+
+// 生成配额的key和lua参数. 配额周期按本地时区对齐, 比如周期为1天的配额在每天0点重置
+func genQuotaArgs(scoreTypeID uint32, domain string, uid string, op model.OpType, quotas []*model.Quota, now time.Time) ([]string, []interface{}) {
+	_, offset := now.Zone()
+	localNow := now.Unix() + int64(offset)
+
+	keys := make([]string, 0, len(quotas))
+	args := make([]interface{}, 0, len(quotas)*3)
+	for _, q := range quotas {
+		if q == nil || q.Op != op || q.PeriodSec < 1 || (q.MaxScore < 1 && q.MaxOrders < 1) {
+			continue
+		}
+		period := localNow / q.PeriodSec
+		quota := fmt.Sprintf("%d_%d_%d", q.Op, q.PeriodSec, period)
+		keys = append(keys, genScoreQuotaKey(scoreTypeID, domain, uid, quota))
+		args = append(args, q.MaxScore, q.MaxOrders, q.PeriodSec)
+	}
+	return keys, args
+}
+
+// 转账. 转出方余额不能小于 minScore, 转入方余额不能大于 maxScore. 返回转出方和转入方的订单数据及订单状态
+func TransferScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, fromUid string, toUid string, score int64,
+	statusExpireSec int64, minScore int64, maxScore int64) (*model.OrderData, *model.OrderData, model.OrderStatus, error) {
+	keys := genTransferKeys(orderID, scoreTypeID, domain, fromUid, toUid)
+	err := checkTransferSlot(keys)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	member := genWalletMember(scoreTypeID, domain)
+	return moveScore(ctx, keys, score, score, statusExpireSec, minScore, maxScore, member, member)
+}
+
+func genTransferKeys(orderID string, scoreTypeID uint32, domain string, fromUid string, toUid string) []string {
+	return []string{
+		genScoreDataKey(scoreTypeID, domain, fromUid),
+		genScoreDataKey(scoreTypeID, domain, toUid),
+		genOrderStatusKey(fromUid, orderID),
+		genOrderStatusKey(toUid, GenTransferInOrderID(orderID)),
+		genScoreWalletKey(fromUid),
+		genScoreWalletKey(toUid),
+		genScoreSupplyKey(scoreTypeID, domain, fromUid),
+		genScoreSupplyKey(scoreTypeID, domain, toUid),
+		genLinkedOrderKey(fromUid, orderID),
+	}
+}
+
+// 检查转账是否可以执行. 使用redis集群时转账的所有key必须在同一个slot, 否则返回 ErrCrossSlotTransfer
+func CheckTransferScore(orderID string, scoreTypeID uint32, domain string, fromUid string, toUid string) error {
+	return checkTransferSlot(genTransferKeys(orderID, scoreTypeID, domain, fromUid, toUid))
+}
+
+// redis集群客户端, 只有集群客户端有这个方法
+type clusterClient interface {
+	ReloadState(ctx context.Context)
+}
+
+func checkTransferSlot(keys []string) error {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return err
+	}
+	if _, ok := rdb.(clusterClient); !ok {
+		return nil
+	}
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			return ErrCrossSlotTransfer
+		}
+	}
+	return nil
+}
+
+// 兑换. 扣除 fromScore 个源积分类型的积分, 增加 toScore 个目标积分类型的积分.
+// 源积分类型余额不能小于 fromMinScore, 目标积分类型余额不能大于 toMaxScore. 返回源积分类型和目标积分类型的订单数据及订单状态
+func ExchangeScore(ctx context.Context, orderID string, fromScoreTypeID uint32, fromDomain string, toScoreTypeID uint32, toDomain string, uid string,
+	fromScore int64, toScore int64, statusExpireSec int64, fromMinScore int64, toMaxScore int64) (*model.OrderData, *model.OrderData, model.OrderStatus, error) {
+	keys := []string{
+		genScoreDataKey(fromScoreTypeID, fromDomain, uid),
+		genScoreDataKey(toScoreTypeID, toDomain, uid),
+		genOrderStatusKey(uid, orderID),
+		genOrderStatusKey(uid, GenTransferInOrderID(orderID)),
+		genScoreWalletKey(uid),
+		genScoreWalletKey(uid),
+		genScoreSupplyKey(fromScoreTypeID, fromDomain, uid),
+		genScoreSupplyKey(toScoreTypeID, toDomain, uid),
+		genLinkedOrderKey(uid, orderID),
+	}
+	return moveScore(ctx, keys, fromScore, toScore, statusExpireSec, fromMinScore, toMaxScore,
+		genWalletMember(fromScoreTypeID, fromDomain), genWalletMember(toScoreTypeID, toDomain))
+}
+
+func moveScore(ctx context.Context, keys []string, fromScore int64, toScore int64, statusExpireSec int64, fromMinScore int64,
+	toMaxScore int64, fromMember string, toMember string) (*model.OrderData, *model.OrderData, model.OrderStatus, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var statusResult []interface{}
+	if moveScoreLuaSha1 != "" {
+		statusResult, err = rdb.EvalSha(ctx, moveScoreLuaSha1, keys, fromScore, toScore, statusExpireSec, fromMinScore, toMaxScore,
+			fromMember, toMember).Slice()
+	} else {
+		statusResult, err = rdb.Eval(ctx, moveScoreLua, keys, fromScore, toScore, statusExpireSec, fromMinScore, toMaxScore,
+			fromMember, toMember).Slice()
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(statusResult) != 2 {
+		return nil, nil, 0, fmt.Errorf("parse move statusResult err. statusResult=%v", statusResult)
+	}
+
+	fromData, status, err := parseStatus(cast.ToString(statusResult[0]))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	toData, _, err := parseStatus(cast.ToString(statusResult[1]))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return fromData, toData, status, nil
+}
+
+// 重设积分. 重设结果不能大于 maxScore, maxScore 为0表示不限制. expectedOldScore 不为nil时只有当前余额等于这个值才会重设
+func (redisStore) ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, resetScore int64, statusExpireSec int64,
+	maxScore int64, expectedOldScore *int64) (*model.OrderData, model.OrderStatus, error) {
+	keys := []string{
+		genScoreDataKey(scoreTypeID, domain, uid),
+		genOrderStatusKey(uid, orderID),
+		genScoreWalletKey(uid),
+		genScoreSupplyKey(scoreTypeID, domain, uid),
+	}
+	member := genWalletMember(scoreTypeID, domain)
+
+	checkOld, expectedOld := 0, int64(0)
+	if expectedOldScore != nil {
+		checkOld, expectedOld = 1, *expectedOldScore
+	}
+
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
 		return nil, 0, err
 	}
 
 	if resetScoreLuaSha1 != "" {
-		statusResult, err := rdb.EvalSha(ctx, resetScoreLuaSha1, []string{scoreDataKey, orderStatusKey}, resetScore, statusExpireSec).Result()
+		statusResult, err := rdb.EvalSha(ctx, resetScoreLuaSha1, keys, resetScore, statusExpireSec, maxScore,
+			checkOld, expectedOld, member).Result()
 		if err != nil {
 			return nil, 0, err
 		}
 		return parseStatus(cast.ToString(statusResult))
 	}
 
-	statusResult, err := rdb.Eval(ctx, resetScoreLua, []string{scoreDataKey, orderStatusKey}, resetScore, statusExpireSec).Result()
+	statusResult, err := rdb.Eval(ctx, resetScoreLua, keys, resetScore, statusExpireSec, maxScore,
+		checkOld, expectedOld, member).Result()
 	if err != nil {
 		return nil, 0, err
 	}
@@ -250,8 +857,43 @@ func ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain
 	return parseStatus(cast.ToString(statusResult))
 }
 
+// 冲正订单, 对原订单做相反的操作. 冲正扣除积分后余额不能小于 minScore, 冲正后的余额不能大于 maxScore, maxScore 为0表示不限制.
+// rejectedOrderID 不为空时余额不足的订单状态写入这个订单id而不锁定冲正订单
+func ReverseOrder(ctx context.Context, originOrderID string, orderID string, scoreTypeID uint32, domain string, uid string,
+	statusExpireSec int64, minScore int64, maxScore int64, rejectedOrderID string) (*model.OrderData, model.OrderStatus, error) {
+	rejectedStatusKey := genOrderStatusKey(uid, orderID)
+	rejectedExpireSec := genOrderStatusExpireSec(rejectedOrderID, statusExpireSec)
+	if rejectedOrderID != "" {
+		rejectedStatusKey = genOrderStatusKey(uid, rejectedOrderID)
+	}
+	keys := []string{
+		genScoreDataKey(scoreTypeID, domain, uid),
+		genOrderStatusKey(uid, originOrderID),
+		genOrderStatusKey(uid, orderID),
+		genScoreSupplyKey(scoreTypeID, domain, uid),
+		genLinkedOrderKey(uid, originOrderID),
+		rejectedStatusKey,
+	}
+
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var statusResult interface{}
+	if reverseOrderLuaSha1 != "" {
+		statusResult, err = rdb.EvalSha(ctx, reverseOrderLuaSha1, keys, statusExpireSec, minScore, maxScore, rejectedExpireSec).Result()
+	} else {
+		statusResult, err = rdb.Eval(ctx, reverseOrderLua, keys, statusExpireSec, minScore, maxScore, rejectedExpireSec).Result()
+	}
+	if err != nil {
+		return nil, 0, parseLuaErr(err)
+	}
+	return parseStatus(cast.ToString(statusResult))
+}
+
 // 获取订单状态
-func GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.OrderData, model.OrderStatus, error) {
+func (redisStore) GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.OrderData, model.OrderStatus, error) {
 	orderStatusKey := genOrderStatusKey(uid, orderID)
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
@@ -268,7 +910,7 @@ func GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.Ord
 }
 
 // 获取订单副作用状态
-func GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int) (bool, error) {
+func (redisStore) GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int) (bool, error) {
 	key := genOrderSideEffectStatusKey(uid, orderID, sideEffectName, sideEffectType)
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
@@ -285,7 +927,7 @@ func GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, s
 }
 
 // 标记订单副作用状态已完成
-func MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int, statusExpireSec int64) error {
+func (redisStore) MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int, statusExpireSec int64) error {
 	key := genOrderSideEffectStatusKey(uid, orderID, sideEffectName, sideEffectType)
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
@@ -295,6 +937,71 @@ func MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string
 	return err
 }
 
+// 订单副作用状态
+type OrderSideEffectStatusItem struct {
+	OrderID        string
+	Uid            string
+	SideEffectName string
+	SideEffectType int
+}
+
+// 批量获取订单副作用状态, 通过一个pipeline发送, 返回结果与 items 一一对应. 只有redis实现
+func GetOrderSideEffectStatuses(ctx context.Context, items []*OrderSideEffectStatusItem) ([]bool, error) {
+	ret := make([]bool, len(items))
+	if len(items) == 0 {
+		return ret, nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.StringCmd, len(items))
+	pipe := rdb.Pipeline()
+	for i, item := range items {
+		cmds[i] = pipe.Get(ctx, genOrderSideEffectStatusKey(item.Uid, item.OrderID, item.SideEffectName, item.SideEffectType))
+	}
+	_, _ = pipe.Exec(ctx)
+	for i, cmd := range cmds {
+		err = cmd.Err()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		ret[i] = cmd.Val() == "1"
+	}
+	return ret, nil
+}
+
+// 批量标记订单副作用状态已完成, 通过一个pipeline发送. 只有redis实现
+func MarkOrderSideEffectStatusesOk(ctx context.Context, items []*OrderSideEffectStatusItem, statusExpireSec int64) error {
+	if len(items) == 0 {
+		return nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.Pipeline()
+	for _, item := range items {
+		key := genOrderSideEffectStatusKey(item.Uid, item.OrderID, item.SideEffectName, item.SideEffectType)
+		pipe.Set(ctx, key, "1", time.Duration(genOrderStatusExpireSec(item.OrderID, statusExpireSec))*time.Second)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// 将lua脚本返回的错误转为预定义的错误, 部分redis实现会给错误加上 ERR 前缀
+func parseLuaErr(err error) error {
+	msg := strings.TrimPrefix(err.Error(), "ERR ")
+	for _, e := range []error{ErrOrderNotFound, ErrOrderNotFrozen, ErrOrderReversed, ErrOrderNotReversible} {
+		if msg == e.Error() {
+			return e
+		}
+	}
+	return err
+}
+
 func parseStatus(statusValue string) (*model.OrderData, model.OrderStatus, error) {
 	ss := strings.Split(statusValue, "_")
 	if len(ss) != 6 {
@@ -321,6 +1028,10 @@ func TryInjectScript() {
 		log.Warn(ctx, "disable TryInjectScript")
 		return
 	}
+	if _, ok := store.(redisStore); !ok {
+		log.Warn(ctx, "store is not redis, skip TryInjectScript")
+		return
+	}
 
 	rdb, err := client.GetScoreRedisClient()
 	if err != nil {
@@ -335,6 +1046,13 @@ func TryInjectScript() {
 	}
 	addScoreLuaSha1 = sha1
 
+	sha1, err = rdb.ScriptLoad(ctx, moveScoreLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript moveScoreLua err", zap.Error(err))
+		return
+	}
+	moveScoreLuaSha1 = sha1
+
 	sha1, err = rdb.ScriptLoad(ctx, resetScoreLua).Result()
 	if err != nil {
 		log.Error(ctx, "TryInjectScript resetScoreLua err", zap.Error(err))
@@ -342,5 +1060,47 @@ func TryInjectScript() {
 	}
 	resetScoreLuaSha1 = sha1
 
+	sha1, err = rdb.ScriptLoad(ctx, reverseOrderLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript reverseOrderLua err", zap.Error(err))
+		return
+	}
+	reverseOrderLuaSha1 = sha1
+
+	sha1, err = rdb.ScriptLoad(ctx, multiOpLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript multiOpLua err", zap.Error(err))
+		return
+	}
+	multiOpLuaSha1 = sha1
+
+	sha1, err = rdb.ScriptLoad(ctx, priorityDeductLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript priorityDeductLua err", zap.Error(err))
+		return
+	}
+	priorityDeductLuaSha1 = sha1
+
+	sha1, err = rdb.ScriptLoad(ctx, getLotScoreLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript getLotScoreLua err", zap.Error(err))
+		return
+	}
+	getLotScoreLuaSha1 = sha1
+
+	sha1, err = rdb.ScriptLoad(ctx, freezeScoreLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript freezeScoreLua err", zap.Error(err))
+		return
+	}
+	freezeScoreLuaSha1 = sha1
+
+	sha1, err = rdb.ScriptLoad(ctx, settleFrozenLua).Result()
+	if err != nil {
+		log.Error(ctx, "TryInjectScript settleFrozenLua err", zap.Error(err))
+		return
+	}
+	settleFrozenLuaSha1 = sha1
+
 	log.Info(ctx, "TryInjectScript ok")
 }
@@ -0,0 +1,158 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/didi/gendry/builder"
+	"github.com/spf13/cast"
+	"github.com/zly-app/component/redis"
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/client"
+)
+
+// 积分余额镜像表
+const ScoreBalanceMirrorTableName = "score_balance_mirror"
+
+type ScoreBalanceMirrorModel struct {
+	ID          uint64 `db:"id"`            // 自增id, 写入时不需要填
+	ScoreTypeID uint32 `db:"score_type_id"` // 积分类型id
+	Domain      string `db:"domain"`        // 域
+	Uid         string `db:"uid"`           // 唯一标识一个用户
+	OrderID     string `db:"oid"`           // 最后一次变更余额的订单id
+	Score       int64  `db:"score"`         // 积分余额, 最后一次变更余额的结果积分
+
+	OrderTime time.Time `db:"otime"` // 最后一次变更余额的积分变更时间, 用于丢弃乱序写入的较早的订单. 为零值时写入当前时间
+	Utime     time.Time `db:"utime"` // 更新时间, 写入时不需要填
+}
+
+var scoreBalanceMirrorSelectFields = []string{
+	"id",
+	"score_type_id",
+	"domain",
+	"uid",
+	"oid",
+	"score",
+	"otime",
+	"utime",
+}
+
+// 写入积分余额镜像, 每个用户/积分类型/域只有一行. 已存在时只有积分变更时间不早于镜像中的积分变更时间才会覆盖订单id和余额,
+// 避免副作用通过mq重试时用较早的订单覆盖较新的订单
+func WriteScoreBalanceMirror(ctx context.Context, v *ScoreBalanceMirrorModel) error {
+	const where = ` where score_type_id=? and domain=? and uid=?`
+	const updateCond = `update ` + ScoreBalanceMirrorTableName + ` set oid=?, score=?, otime=?` + where + ` and otime<=?`
+	const insertCond = `insert into ` + ScoreBalanceMirrorTableName + ` (score_type_id, domain, uid, oid, score, otime) values (?, ?, ?, ?, ?, ?)`
+	const existsCond = `select count(1) from ` + ScoreBalanceMirrorTableName + where
+	otime := v.OrderTime
+	if otime.IsZero() {
+		otime = time.Now()
+	}
+	db := client.GetScoreBalanceMirrorSqlxClient()
+
+	// 镜像行不存在或镜像中的订单较新时影响行数为0, 此时插入会因为唯一索引冲突失败, 由 insertOrExists 忽略
+	result, err := db.Exec(ctx, updateCond, v.OrderID, v.Score, otime, v.ScoreTypeID, v.Domain, v.Uid, otime)
+	if err == nil {
+		var n int64
+		n, err = result.RowsAffected()
+		if err == nil && n == 0 {
+			err = insertOrExists(ctx, db, insertCond, []interface{}{v.ScoreTypeID, v.Domain, v.Uid, v.OrderID, v.Score, otime},
+				existsCond, v.ScoreTypeID, v.Domain, v.Uid)
+		}
+	}
+	if err != nil {
+		log.Error(ctx, "WriteScoreBalanceMirror err",
+			zap.Any("v", v),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 按id顺序获取积分余额镜像, 返回id大于 afterID 的最多 limit 行
+func GetScoreBalanceMirrors(ctx context.Context, afterID uint64, limit uint) ([]*ScoreBalanceMirrorModel, error) {
+	where := map[string]interface{}{
+		"id >":     afterID,
+		"_orderby": "id asc",
+		"_limit":   []uint{0, limit},
+	}
+	cond, vals, err := builder.BuildSelect(ScoreBalanceMirrorTableName, where, scoreBalanceMirrorSelectFields)
+	if err != nil {
+		log.Error(ctx, "GetScoreBalanceMirrors BuildSelect err",
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	var ret []*ScoreBalanceMirrorModel
+	err = client.GetScoreBalanceMirrorSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		log.Error(ctx, "GetScoreBalanceMirrors err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 修复积分余额镜像. 只有镜像的订单id和余额仍然是 old 中的值时才会修改, 避免覆盖在这期间由副作用写入的更新的数据
+func RepairScoreBalanceMirror(ctx context.Context, old *ScoreBalanceMirrorModel, orderID string, score int64) (bool, error) {
+	const cond = `update ` + ScoreBalanceMirrorTableName + ` set oid=?, score=? where id=? and oid=? and score=?`
+	result, err := client.GetScoreBalanceMirrorSqlxClient().Exec(ctx, cond, orderID, score, old.ID, old.OrderID, old.Score)
+	if err != nil {
+		log.Error(ctx, "RepairScoreBalanceMirror err",
+			zap.Any("old", old),
+			zap.String("orderID", orderID),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// 获取redis中的积分, 同时返回积分数据key是否存在
+func GetRedisScoreWithExists(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, bool, error) {
+	key := genScoreDataKey(scoreTypeID, domain, uid)
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, false, err
+	}
+	v, err := rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return cast.ToInt64(v), true, nil
+}
+
+// 恢复redis中的积分. 只有积分数据key不存在时才会写入, 返回是否写入
+func RestoreRedisScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, score int64) (bool, error) {
+	key := genScoreDataKey(scoreTypeID, domain, uid)
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return false, err
+	}
+	ok, err := rdb.SetNX(ctx, key, score, 0).Result()
+	if err != nil {
+		log.Error(ctx, "RestoreRedisScore err",
+			zap.String("key", key),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	return ok, nil
+}
@@ -0,0 +1,46 @@
+package dao
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zlyuancn/score/client"
+)
+
+func TestWriteScoreBalanceMirrorOrdering(t *testing.T) {
+	ctx := context.Background()
+	const uid = "mirror_ordering"
+	now := time.Now()
+	write := func(orderID string, score int64, otime time.Time) {
+		t.Helper()
+		err := WriteScoreBalanceMirror(ctx, &ScoreBalanceMirrorModel{
+			ScoreTypeID: testScoreTypeID, Domain: testDomain, Uid: uid, OrderID: orderID, Score: score, OrderTime: otime,
+		})
+		if err != nil {
+			t.Fatalf("WriteScoreBalanceMirror err: %v", err)
+		}
+	}
+	check := func(orderID string, score int64) {
+		t.Helper()
+		var row ScoreBalanceMirrorModel
+		err := client.GetScoreBalanceMirrorSqlxClient().FindOne(ctx, &row, `select oid,score from `+ScoreBalanceMirrorTableName+` where uid=?`, uid)
+		if err != nil {
+			t.Fatalf("select mirror err: %v", err)
+		}
+		if row.OrderID != orderID || row.Score != score {
+			t.Fatalf("mirror=%s %d, want %s %d", row.OrderID, row.Score, orderID, score)
+		}
+	}
+
+	write("o2", 20, now)
+	check("o2", 20)
+	// 较早的订单重试时不会覆盖较新的订单
+	write("o1", 10, now.Add(-time.Second))
+	check("o2", 20)
+	// 重复写入相同的订单不会失败
+	write("o2", 20, now)
+	check("o2", 20)
+	write("o3", 30, now.Add(time.Second))
+	check("o3", 30)
+}
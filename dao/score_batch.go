@@ -0,0 +1,196 @@
+package dao
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/component/redis"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/model"
+)
+
+// 批量增加积分数据
+type BatchAddScoreItem struct {
+	Uid     string // 用户id
+	OrderID string // 订单id
+	Score   int64  // 增加积分值
+}
+
+// 批量增加积分结果
+type BatchAddScoreResult struct {
+	Data   *model.OrderData
+	Status model.OrderStatus
+	Err    error
+}
+
+// 批量增加积分, 通过pipeline执行增加积分的lua脚本, 返回结果与 items 一一对应. 单个用户的失败不影响其它用户
+func BatchAddScore(ctx context.Context, scoreTypeID uint32, domain string, items []*BatchAddScoreItem, statusExpireSec int64,
+	opt *AddScoreOption) ([]*BatchAddScoreResult, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.Cmd, len(items))
+	for i, item := range items {
+		keys, args := genAddScoreArgs(item.OrderID, scoreTypeID, domain, item.Uid, item.Score, statusExpireSec, opt, now)
+		if addScoreLuaSha1 != "" {
+			cmds[i] = pipe.EvalSha(ctx, addScoreLuaSha1, keys, args...)
+		} else {
+			cmds[i] = pipe.Eval(ctx, addScoreLua, keys, args...)
+		}
+	}
+	// 每个命令的错误在下面单独处理
+	_, _ = pipe.Exec(ctx)
+
+	ret := make([]*BatchAddScoreResult, len(items))
+	for i, cmd := range cmds {
+		r := &BatchAddScoreResult{}
+		statusResult, err := cmd.Result()
+		if err != nil {
+			r.Err = err
+		} else {
+			r.Data, r.Status, r.Err = parseStatus(cast.ToString(statusResult))
+		}
+		ret[i] = r
+	}
+	return ret, nil
+}
+
+// 批量获取积分数据
+type GetScoresItem struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	Uid         string // 用户id
+	LotMode     bool   // 是否为批次模式
+}
+
+// 批量获取积分结果
+type GetScoresResult struct {
+	Score int64
+	Err   error
+}
+
+// 批量获取积分, 返回结果与 items 一一对应. 普通积分按redis集群的slot分组后通过 MGET 获取, 批次模式的积分通过lua脚本获取, 所有命令通过一个pipeline发送.
+// 注册了其它储存时通过储存逐个获取, 批次模式的积分返回 ErrStoreNotSupported
+func GetScores(ctx context.Context, items []*GetScoresItem, now int64) ([]*GetScoresResult, error) {
+	if CheckRedisStore() != nil {
+		return getScoresByStore(ctx, items), nil
+	}
+
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	type mgetGroup struct {
+		keys  []string
+		index []int // 对应 items 的下标
+		cmd   *redis.SliceCmd
+	}
+	groups := make(map[uint16]*mgetGroup)
+	slots := make([]uint16, 0) // 保持分组顺序
+	lotCmds := make(map[int]*redis.Cmd)
+
+	pipe := rdb.Pipeline()
+	for i, item := range items {
+		if item.LotMode {
+			keys := []string{
+				genScoreDataKey(item.ScoreTypeID, item.Domain, item.Uid),
+				genScoreLotKey(item.ScoreTypeID, item.Domain, item.Uid),
+				genScoreLotExpireKey(item.ScoreTypeID, item.Domain, item.Uid),
+			}
+			if getLotScoreLuaSha1 != "" {
+				lotCmds[i] = pipe.EvalSha(ctx, getLotScoreLuaSha1, keys, now)
+			} else {
+				lotCmds[i] = pipe.Eval(ctx, getLotScoreLua, keys, now)
+			}
+			continue
+		}
+
+		key := genScoreDataKey(item.ScoreTypeID, item.Domain, item.Uid)
+		slot := keySlot(key)
+		g, ok := groups[slot]
+		if !ok {
+			g = &mgetGroup{}
+			groups[slot] = g
+			slots = append(slots, slot)
+		}
+		g.keys = append(g.keys, key)
+		g.index = append(g.index, i)
+	}
+	for _, slot := range slots {
+		g := groups[slot]
+		g.cmd = pipe.MGet(ctx, g.keys...)
+	}
+	// 每个命令的错误在下面单独处理
+	_, _ = pipe.Exec(ctx)
+
+	ret := make([]*GetScoresResult, len(items))
+	for i, cmd := range lotCmds {
+		r := &GetScoresResult{}
+		v, err := cmd.Result()
+		if err != nil {
+			r.Err = err
+		} else {
+			r.Score = cast.ToInt64(v)
+		}
+		ret[i] = r
+	}
+	for _, slot := range slots {
+		g := groups[slot]
+		vs, err := g.cmd.Result()
+		for j, i := range g.index {
+			r := &GetScoresResult{Err: err}
+			if err == nil && j < len(vs) && vs[j] != nil {
+				r.Score = cast.ToInt64(vs[j])
+			}
+			ret[i] = r
+		}
+	}
+	return ret, nil
+}
+
+// redis集群中key所在的slot, 存在 hash tag 时只计算 hash tag 部分
+func keySlot(key string) uint16 {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return crc16(key) % 16384
+}
+
+// CRC16-CCITT (XMODEM), 与redis集群计算slot的算法相同
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// 通过注册的储存逐个获取积分, 批次模式的积分返回 ErrStoreNotSupported
+func getScoresByStore(ctx context.Context, items []*GetScoresItem) []*GetScoresResult {
+	ret := make([]*GetScoresResult, len(items))
+	for i, item := range items {
+		r := &GetScoresResult{Err: ErrStoreNotSupported}
+		if !item.LotMode {
+			r.Score, r.Err = store.GetScore(ctx, item.ScoreTypeID, item.Domain, item.Uid)
+		}
+		ret[i] = r
+	}
+	return ret
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"hash/crc32"
+	"time"
 
 	"github.com/didi/gendry/builder"
 	"github.com/spf13/cast"
@@ -12,35 +13,89 @@ import (
 
 	"github.com/zlyuancn/score/client"
 	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/model"
 )
 
 // 积分流水表
 const ScoreFlowTableName = "score_flow_"
 
 type ScoreFlowModel struct {
+	ID          uint64 `db:"id"`            // 自增id, 写入时不需要填
 	OrderID     string `db:"oid"`           // 订单id
 	ScoreTypeID uint32 `db:"score_type_id"` // 积分类型id
 	Domain      string `db:"domain"`        // 域
 
-	OpType   uint8 `db:"o_type"`   // 操作类型. 1=增加, 2=扣除, 3=重置
-	OpStatus uint8 `db:"o_status"` // 操作状态. 1=成功, 2=余额不足
+	OpType   uint8 `db:"o_type"`   // 操作类型. 1=增加, 2=扣除, 3=重置, 4=冻结, 5=确认冻结, 6=取消冻结
+	OpStatus uint8 `db:"o_status"` // 操作状态. 1=成功, 2=余额不足, 3=已冻结, 4=已确认冻结, 5=已取消冻结, 6=已冲正, 7=超过余额上限, 8=超过周期配额, 9=余额已变化
 
-	OldScore    uint64 `db:"old_score"`    // 原始积分
+	OldScore    int64  `db:"old_score"`    // 原始积分
 	ChangeScore uint64 `db:"change_score"` // 变更积分
-	ResultScore uint64 `db:"result_score"` // 结果积分
+	ResultScore int64  `db:"result_score"` // 结果积分
 
 	Uid    string `db:"uid"`    // 唯一标识一个用户
 	Remark string `db:"remark"` // 备注
+
+	LinkOrderID string `db:"link_oid"` // 关联订单id, 比如转账时另一方的订单id, 冲正时原订单的订单id, 余额不足不锁定订单时的原订单id
+
+	OrderTime time.Time `db:"otime"` // 积分变更时间, 流水由副作用写入, 所以创建时间可能晚于积分变更时间. 为零值时写入当前时间
+	Ctime     time.Time `db:"ctime"` // 创建时间, 写入时不需要填
+}
+
+// 生成积分流水分表名, 同一个用户的流水在同一个分表
+func genScoreFlowTableName(uid string) string {
+	shardID := crc32.ChecksumIEEE([]byte(uid)) % conf.Conf.ScoreFlowTableShardNums
+	return ScoreFlowTableName + cast.ToString(shardID)
+}
+
+// 生成所有积分流水分表名
+func genAllScoreFlowTableNames() []string {
+	ret := make([]string, conf.Conf.ScoreFlowTableShardNums)
+	for i := range ret {
+		ret[i] = ScoreFlowTableName + cast.ToString(i)
+	}
+	return ret
+}
+
+func (redisStore) WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error {
+	return writeScoreFlowBySqlx(ctx, uid, v)
 }
 
 // 写入积分流水
-func WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error {
+func writeScoreFlowBySqlx(ctx context.Context, uid string, v *ScoreFlowModel) error {
 	if v == nil {
 		return errors.New("CreateOneModel v is empty")
 	}
 
-	shardID := crc32.ChecksumIEEE([]byte(uid)) % conf.Conf.ScoreFlowTableShardNums
-	tabName := ScoreFlowTableName + cast.ToString(shardID)
+	tabName := genScoreFlowTableName(uid)
+	data := genScoreFlowData(v)
+	cond, vals, err := builder.BuildInsertIgnore(tabName, data)
+	if err != nil {
+		log.Error(ctx, "score CreateOneModel BuildSelect err",
+			zap.Any("data", data),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	result, err := client.GetScoreFlowSqlxClient().Exec(ctx, cond, vals...)
+	if err != nil {
+		log.Error(ctx, "score CreateOneModel err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return err
+	}
+	_, err = result.LastInsertId()
+	return err
+}
+
+// 生成写入积分流水的数据
+func genScoreFlowData(v *ScoreFlowModel) []map[string]interface{} {
+	otime := v.OrderTime
+	if otime.IsZero() {
+		otime = time.Now()
+	}
 
 	var data []map[string]interface{}
 	data = append(data, map[string]interface{}{
@@ -57,25 +112,185 @@ func WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error {
 
 		"uid":    v.Uid,
 		"remark": v.Remark,
+
+		"link_oid": v.LinkOrderID,
+		"otime":    otime,
 	})
-	cond, vals, err := builder.BuildInsertIgnore(tabName, data)
+	return data
+}
+
+// 积分流水的查询字段
+var scoreFlowSelectFields = []string{"id", "oid", "score_type_id", "domain", "o_type", "o_status", "old_score", "change_score", "result_score",
+	"uid", "remark", "link_oid", "otime", "ctime"}
+
+// 查询用户的积分流水, 按id从大到小排序. cursor 为上一页最后一条流水的id, 为0表示从最新的流水开始
+func ListScoreFlow(ctx context.Context, uid string, filter *model.ScoreFlowFilter, cursor uint64, limit int) ([]*ScoreFlowModel, error) {
+	where := map[string]interface{}{
+		"uid":      uid,
+		"_orderby": "id desc",
+		"_limit":   []uint{0, uint(limit)},
+	}
+	if cursor > 0 {
+		where["id <"] = cursor
+	}
+	if filter != nil {
+		if len(filter.ScoreTypeIDs) > 0 {
+			where["score_type_id in"] = toInterfaceSlice(filter.ScoreTypeIDs)
+		}
+		if len(filter.Domains) > 0 {
+			where["domain in"] = toInterfaceSlice(filter.Domains)
+		}
+		if len(filter.OpTypes) > 0 {
+			where["o_type in"] = toInterfaceSlice(filter.OpTypes)
+		}
+		if len(filter.OpStatuses) > 0 {
+			where["o_status in"] = toInterfaceSlice(filter.OpStatuses)
+		}
+		if filter.StartTime > 0 {
+			where["ctime >="] = time.Unix(filter.StartTime, 0)
+		}
+		if filter.EndTime > 0 {
+			where["ctime <"] = time.Unix(filter.EndTime, 0)
+		}
+	}
+
+	tabName := genScoreFlowTableName(uid)
+	cond, vals, err := builder.BuildSelect(tabName, where, scoreFlowSelectFields)
 	if err != nil {
-		log.Error(ctx, "score CreateOneModel BuildSelect err",
-			zap.Any("data", data),
+		log.Error(ctx, "score ListScoreFlow BuildSelect err",
+			zap.Any("where", where),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
 	}
 
-	result, err := client.GetScoreFlowSqlxClient().Exec(ctx, cond, vals...)
+	var ret []*ScoreFlowModel
+	err = client.GetScoreFlowSqlxClient().Find(ctx, &ret, cond, vals...)
 	if err != nil {
-		log.Error(ctx, "score CreateOneModel err",
+		log.Error(ctx, "score ListScoreFlow err",
 			zap.String("cond", cond),
 			zap.Any("vals", vals),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
 	}
-	_, err = result.LastInsertId()
-	return err
+	return ret, nil
+}
+
+// 获取用户在积分类型/域下积分变更时间不晚于 t 的最新一条流水, 没有流水时返回nil
+func GetLatestScoreFlowBefore(ctx context.Context, scoreTypeID uint32, domain string, uid string, t time.Time) (*ScoreFlowModel, error) {
+	where := map[string]interface{}{
+		"uid":           uid,
+		"score_type_id": scoreTypeID,
+		"domain":        domain,
+		"otime <=":      t,
+		"_orderby":      "otime desc, id desc",
+		"_limit":        []uint{0, 1},
+	}
+
+	tabName := genScoreFlowTableName(uid)
+	cond, vals, err := builder.BuildSelect(tabName, where, scoreFlowSelectFields)
+	if err != nil {
+		log.Error(ctx, "score GetLatestScoreFlowBefore BuildSelect err",
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	var ret []*ScoreFlowModel
+	err = client.GetScoreFlowSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		log.Error(ctx, "score GetLatestScoreFlowBefore err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return ret[0], nil
+}
+
+// 转为 builder 的 in 条件需要的 []interface{}
+func toInterfaceSlice[T any](vs []T) []interface{} {
+	ret := make([]interface{}, len(vs))
+	for i, v := range vs {
+		ret[i] = v
+	}
+	return ret
+}
+
+// 获取所有积分流水分表名
+func GetAllScoreFlowTableNames() []string {
+	return genAllScoreFlowTableNames()
+}
+
+// 按id从大到小扫描一个积分流水分表. cursor 为上一页最后一条流水的id, 为0表示从最新的流水开始
+func ScanScoreFlowTable(ctx context.Context, tabName string, cursor uint64, limit uint) ([]*ScoreFlowModel, error) {
+	where := map[string]interface{}{
+		"_orderby": "id desc",
+		"_limit":   []uint{0, limit},
+	}
+	if cursor > 0 {
+		where["id <"] = cursor
+	}
+
+	cond, vals, err := builder.BuildSelect(tabName, where, scoreFlowSelectFields)
+	if err != nil {
+		log.Error(ctx, "score ScanScoreFlowTable BuildSelect err",
+			zap.String("tabName", tabName),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	var ret []*ScoreFlowModel
+	err = client.GetScoreFlowSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		log.Error(ctx, "score ScanScoreFlowTable err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 获取订单的积分流水, 流水不存在时返回nil
+func GetScoreFlowByOrderID(ctx context.Context, uid string, orderID string) (*ScoreFlowModel, error) {
+	where := map[string]interface{}{
+		"uid":    uid,
+		"oid":    orderID,
+		"_limit": []uint{0, 1},
+	}
+
+	tabName := genScoreFlowTableName(uid)
+	cond, vals, err := builder.BuildSelect(tabName, where, scoreFlowSelectFields)
+	if err != nil {
+		log.Error(ctx, "score GetScoreFlowByOrderID BuildSelect err",
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	var ret []*ScoreFlowModel
+	err = client.GetScoreFlowSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		log.Error(ctx, "score GetScoreFlowByOrderID err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return ret[0], nil
 }
@@ -0,0 +1,139 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/model"
+)
+
+// 积分流水统计结果
+type ScoreFlowStatsModel struct {
+	Bucket       string `db:"bucket"`        // 统计周期的开始日期, 格式为 2006-01-02
+	ScoreTypeID  uint32 `db:"score_type_id"` // 积分类型id
+	Domain       string `db:"domain"`        // 域
+	Uid          string `db:"uid"`           // 用户id, 只有按用户分组时才有值
+	EarnedScore  int64  `db:"earned_score"`  // 增加的积分总值
+	SpentScore   int64  `db:"spent_score"`   // 扣除的积分总值
+	EarnedOrders int64  `db:"earned_orders"` // 增加积分的订单数
+	SpentOrders  int64  `db:"spent_orders"`  // 扣除积分的订单数
+}
+
+// 统计周期的开始日期表达式, 按数据库的时区计算
+var statsBucketFields = map[model.StatsPeriod]string{
+	model.StatsPeriod_Day:   "DATE_FORMAT(f.ctime, '%Y-%m-%d') AS bucket",
+	model.StatsPeriod_Week:  "DATE_FORMAT(DATE_SUB(DATE(f.ctime), INTERVAL WEEKDAY(f.ctime) DAY), '%Y-%m-%d') AS bucket",
+	model.StatsPeriod_Month: "DATE_FORMAT(f.ctime, '%Y-%m-01') AS bucket",
+}
+
+// 冲正流水与原订单流水在同一个分表, 冲正流水的 link_oid 为原订单id, 操作类型与原订单相反.
+// 转账/兑换/多积分类型原子操作的关联流水不在同一个分表或积分类型/域不同, 不会被匹配
+const (
+	// 流水是冲正流水
+	statsIsReversalCond = `exists (select 1 from %[1]s o where o.oid=f.link_oid and o.uid=f.uid and o.score_type_id=f.score_type_id and o.domain=f.domain and o.o_type+f.o_type=3 and o.o_status=1)`
+	// 流水已被冲正
+	statsIsReversedCond = `exists (select 1 from %[1]s r where r.link_oid=f.oid and r.uid=f.uid and r.score_type_id=f.score_type_id and r.domain=f.domain and r.o_type+f.o_type=3 and r.o_status=1)`
+)
+
+// 统计积分流水. uid 不为空时只统计这个用户所在的分表, 否则统计所有分表并合并结果.
+// 只统计成功的增加/扣除积分和确认冻结的流水, 已冲正的订单和冲正订单都不计入. 结果按周期/积分类型/域分组, filter.GroupByUid 为true时还按用户分组
+func StatsScoreFlow(ctx context.Context, uid string, filter *model.ScoreStatsFilter) ([]*ScoreFlowStatsModel, error) {
+	bucketField, ok := statsBucketFields[filter.Period]
+	if !ok {
+		bucketField = statsBucketFields[model.StatsPeriod_Day]
+	}
+
+	addOp := cast.ToString(uint8(model.OpType_Add))
+	fields := []string{
+		bucketField,
+		"f.score_type_id",
+		"f.domain",
+		"SUM(IF(f.o_type=" + addOp + ", f.change_score, 0)) AS earned_score",
+		"SUM(IF(f.o_type=" + addOp + ", 0, f.change_score)) AS spent_score",
+		"SUM(IF(f.o_type=" + addOp + ", 1, 0)) AS earned_orders",
+		"SUM(IF(f.o_type=" + addOp + ", 0, 1)) AS spent_orders",
+	}
+	groupBy := "bucket,f.score_type_id,f.domain"
+	if filter.GroupByUid {
+		fields = append(fields, "f.uid")
+		groupBy += ",f.uid"
+	}
+
+	where := []string{
+		"f.ctime >= ?",
+		"f.ctime < ?",
+		fmt.Sprintf("((f.o_type=%d and f.o_status=%d) or (f.o_type=%d and f.o_status=%d) or (f.o_type=%d and f.o_status=%d))",
+			model.OpType_Add, model.OrderStatus_Finish,
+			model.OpType_Deduct, model.OrderStatus_Finish,
+			model.OpType_ConfirmFrozen, model.OrderStatus_Confirmed),
+	}
+	vals := []interface{}{time.Unix(filter.StartTime, 0), time.Unix(filter.EndTime, 0)}
+	if uid != "" {
+		where = append(where, "f.uid = ?")
+		vals = append(vals, uid)
+	}
+	if len(filter.ScoreTypeIDs) > 0 {
+		where = append(where, "f.score_type_id in ("+genPlaceholders(len(filter.ScoreTypeIDs))+")")
+		vals = append(vals, toInterfaceSlice(filter.ScoreTypeIDs)...)
+	}
+	if len(filter.Domains) > 0 {
+		where = append(where, "f.domain in ("+genPlaceholders(len(filter.Domains))+")")
+		vals = append(vals, toInterfaceSlice(filter.Domains)...)
+	}
+
+	tabNames := []string{genScoreFlowTableName(uid)}
+	if uid == "" {
+		tabNames = genAllScoreFlowTableNames()
+	}
+
+	type statsKey struct {
+		bucket      string
+		scoreTypeID uint32
+		domain      string
+		uid         string
+	}
+	merged := make(map[statsKey]*ScoreFlowStatsModel)
+	ret := make([]*ScoreFlowStatsModel, 0)
+	for _, tabName := range tabNames {
+		cond := "select " + strings.Join(fields, ",") + " from " + tabName + " f where " + strings.Join(where, " and ") +
+			" and not " + fmt.Sprintf(statsIsReversalCond, tabName) + " and not " + fmt.Sprintf(statsIsReversedCond, tabName) +
+			" group by " + groupBy
+		var rows []*ScoreFlowStatsModel
+		err := client.GetScoreFlowSqlxClient().Find(ctx, &rows, cond, vals...)
+		if err != nil {
+			log.Error(ctx, "score StatsScoreFlow err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return nil, err
+		}
+
+		for _, row := range rows {
+			k := statsKey{row.Bucket, row.ScoreTypeID, row.Domain, row.Uid}
+			v, ok := merged[k]
+			if !ok {
+				merged[k] = row
+				ret = append(ret, row)
+				continue
+			}
+			v.EarnedScore += row.EarnedScore
+			v.SpentScore += row.SpentScore
+			v.EarnedOrders += row.EarnedOrders
+			v.SpentOrders += row.SpentOrders
+		}
+	}
+	return ret, nil
+}
+
+// 生成 n 个以逗号分隔的占位符
+func genPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,369 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/spf13/cast"
+	"github.com/zly-app/component/redis"
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/model"
+)
+
+// 冻结积分数据为hash, field为冻结订单的订单状态key, value为 冻结积分值_超时时间
+//
+// 冻结超时数据为zset, member为 FrozenTimeoutData 的json, score为超时时间. 在冻结和结算的lua脚本中写入和删除, 避免冻结成功后未记录超时.
+// 与供应量相同, 冻结超时数据按用户积分数据key所在的slot分片
+
+const (
+	// 冻结积分 KEYS=[积分数据key, 订单状态key, 冻结积分数据key, 用户钱包key, 冻结超时数据key]
+	// ARGV=[冻结积分值, 订单状态key有效期, 超时时间, 最小余额, 钱包成员, 冻结超时数据成员]
+	freezeScoreLua = `
+-- 获取订单状态
+local status = redis.call('GET', KEYS[2])
+-- 如果状态已写入则表示订单已完成, 直接返回状态
+if status ~= false then
+    return status .. '_1'
+end
+
+local changeScore = tonumber(ARGV[1])
+local ex = tonumber(ARGV[2])
+local deadline = ARGV[3]
+local minScore = tonumber(ARGV[4])
+
+-- 扣除积分
+local nowScore = redis.call('DECRBY', KEYS[1], changeScore)
+-- 检查余额不足
+if nowScore < minScore then
+    -- 回退
+    redis.call('INCRBY', KEYS[1], changeScore)
+    -- 余额不足状态
+    status = '4_2_' .. tostring(nowScore+changeScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore+changeScore)
+else
+    -- 写入冻结积分, 记录到用户钱包
+    redis.call('HSET', KEYS[3], KEYS[2], tostring(changeScore) .. '_' .. deadline)
+    redis.call('SADD', KEYS[4], ARGV[5])
+    -- 记录冻结超时
+    if tonumber(deadline) > 0 then
+        redis.call('ZADD', KEYS[5], deadline, ARGV[6])
+    end
+    -- 冻结状态
+    status = '4_3_' .. tostring(nowScore+changeScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+end
+
+-- 写入状态
+if ex < 1 then
+    redis.call('SET', KEYS[2], status)
+else
+    redis.call('SET', KEYS[2], status, 'ex', ex)
+end
+return status .. '_0'
+`
+
+	// 确认/取消冻结 KEYS=[积分数据key, 冻结订单状态key, 冻结积分数据key, 订单状态key, 积分供应量key, 冻结超时数据key]
+	// ARGV=[操作类型, 订单状态key有效期, 当前时间, 冻结超时数据成员]
+	settleFrozenLua = `
+-- 获取订单状态
+local status = redis.call('GET', KEYS[4])
+-- 如果状态已写入则表示订单已完成, 直接返回状态
+if status ~= false then
+    return status .. '_1'
+end
+
+local op = ARGV[1]
+local ex = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+-- 获取冻结订单状态
+local frozenStatus = redis.call('GET', KEYS[2])
+if frozenStatus == false then
+    return redis.error_reply('order not found')
+end
+local frozenOp, frozenState, frozenOld, frozenChange, frozenResult = string.match(frozenStatus, '^(%d+)_(%d+)_([^_]*)_([^_]*)_([^_]*)$')
+if frozenOp ~= '4' or (frozenState ~= '3' and frozenState ~= '4' and frozenState ~= '5') then
+    return redis.error_reply('order not frozen')
+end
+
+local changeScore = tonumber(frozenChange)
+local nowScore = tonumber(redis.call('GET', KEYS[1]) or '0')
+
+if frozenState == '3' then
+    -- 确认时已超时则取消冻结
+    local target = op
+    if op == '5' then
+        local hold = redis.call('HGET', KEYS[3], KEYS[2])
+        if hold ~= false then
+            local deadline = tonumber(string.match(hold, '_(%d+)$'))
+            if deadline > 0 and now > deadline then
+                target = '6'
+            end
+        end
+    end
+
+    redis.call('HDEL', KEYS[3], KEYS[2])
+    redis.call('ZREM', KEYS[6], ARGV[4])
+    if target == '5' then
+        -- 确认冻结时积分才被消耗
+        redis.call('HINCRBY', KEYS[5], 'deduct', changeScore)
+        frozenState = '4'
+        status = op .. '_4_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+    else
+        -- 返还积分
+        local resultScore = redis.call('INCRBY', KEYS[1], changeScore)
+        frozenState = '5'
+        status = op .. '_5_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(resultScore)
+    end
+
+    -- 修改冻结订单状态, 保留其有效期
+    frozenStatus = '4_' .. frozenState .. '_' .. frozenOld .. '_' .. frozenChange .. '_' .. frozenResult
+    local ttl = redis.call('PTTL', KEYS[2])
+    if ttl > 0 then
+        redis.call('SET', KEYS[2], frozenStatus, 'px', ttl)
+    else
+        redis.call('SET', KEYS[2], frozenStatus)
+    end
+else
+    -- 冻结订单已经确认或取消, 不做任何操作
+    status = op .. '_' .. frozenState .. '_' .. tostring(nowScore) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+end
+
+-- 写入状态
+if ex < 1 then
+    redis.call('SET', KEYS[4], status)
+else
+    redis.call('SET', KEYS[4], status, 'ex', ex)
+end
+return status .. '_0'
+`
+)
+
+// 脚本sha1值, 如果存在则使用 EVALSHA 执行脚本
+var (
+	freezeScoreLuaSha1  = ""
+	settleFrozenLuaSha1 = ""
+)
+
+// 冻结订单不是冻结成功的订单
+var ErrOrderNotFrozen = errors.New("order not frozen")
+
+// 确认/取消冻结时订单id的后缀
+const (
+	confirmFrozenOrderIDSuffix = "_confirm"
+	cancelFrozenOrderIDSuffix  = "_cancel"
+)
+
+// 生成确认/取消冻结的订单id, 使用这个订单id记录订单状态和流水
+func GenSettleFrozenOrderID(orderID string, op model.OpType) string {
+	if op == model.OpType_ConfirmFrozen {
+		return orderID + confirmFrozenOrderIDSuffix
+	}
+	return orderID + cancelFrozenOrderIDSuffix
+}
+
+// 生成冻结积分数据key
+func genScoreFrozenKey(scoreTypeID uint32, domain string, uid string) string {
+	text := conf.Conf.ScoreFrozenKeyFormat
+	text = strings.ReplaceAll(text, templateString_ScoreTypeID, strconv.FormatInt(int64(scoreTypeID), 10))
+	text = strings.ReplaceAll(text, templateString_Domain, domain)
+	text = strings.ReplaceAll(text, templateString_Uid, uid)
+	return text
+}
+
+// 冻结积分. 冻结后余额不能小于 minScore
+func FreezeScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+	deadline int64, minScore int64) (*model.OrderData, model.OrderStatus, error) {
+	timeout := &FrozenTimeoutData{ScoreTypeID: scoreTypeID, Domain: domain, Uid: uid, OrderID: orderID}
+	timeoutMember, err := sonic.MarshalString(timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := []string{
+		genScoreDataKey(scoreTypeID, domain, uid),
+		genOrderStatusKey(uid, orderID),
+		genScoreFrozenKey(scoreTypeID, domain, uid),
+		genScoreWalletKey(uid),
+		genFrozenTimeoutKey(timeout),
+	}
+	member := genWalletMember(scoreTypeID, domain)
+
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var statusResult interface{}
+	if freezeScoreLuaSha1 != "" {
+		statusResult, err = rdb.EvalSha(ctx, freezeScoreLuaSha1, keys, score, statusExpireSec, deadline, minScore, member, timeoutMember).Result()
+	} else {
+		statusResult, err = rdb.Eval(ctx, freezeScoreLua, keys, score, statusExpireSec, deadline, minScore, member, timeoutMember).Result()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseStatus(cast.ToString(statusResult))
+}
+
+// 确认/取消冻结. 订单状态为冻结订单最终的状态
+func SettleFrozen(ctx context.Context, op model.OpType, orderID string, scoreTypeID uint32, domain string, uid string, statusExpireSec int64,
+	now int64) (*model.OrderData, model.OrderStatus, error) {
+	timeout := &FrozenTimeoutData{ScoreTypeID: scoreTypeID, Domain: domain, Uid: uid, OrderID: orderID}
+	timeoutMember, err := sonic.MarshalString(timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := []string{
+		genScoreDataKey(scoreTypeID, domain, uid),
+		genOrderStatusKey(uid, orderID),
+		genScoreFrozenKey(scoreTypeID, domain, uid),
+		genOrderStatusKey(uid, GenSettleFrozenOrderID(orderID, op)),
+		genScoreSupplyKey(scoreTypeID, domain, uid),
+		genFrozenTimeoutKey(timeout),
+	}
+
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var statusResult interface{}
+	if settleFrozenLuaSha1 != "" {
+		statusResult, err = rdb.EvalSha(ctx, settleFrozenLuaSha1, keys, int(op), statusExpireSec, now, timeoutMember).Result()
+	} else {
+		statusResult, err = rdb.Eval(ctx, settleFrozenLua, keys, int(op), statusExpireSec, now, timeoutMember).Result()
+	}
+	if err != nil {
+		return nil, 0, parseLuaErr(err)
+	}
+	return parseStatus(cast.ToString(statusResult))
+}
+
+// 获取冻结中的积分
+func GetFrozenScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
+	key := genScoreFrozenKey(scoreTypeID, domain, uid)
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+	vs, err := rdb.HVals(ctx, key).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var score int64
+	for _, v := range vs {
+		score += cast.ToInt64(strings.SplitN(v, "_", 2)[0])
+	}
+	return score, nil
+}
+
+// 冻结超时数据
+type FrozenTimeoutData struct {
+	ScoreTypeID uint32 `json:"st"`  // 积分类型id
+	Domain      string `json:"d"`   // 积分域
+	Uid         string `json:"uid"` // 用户id
+	OrderID     string `json:"oid"` // 冻结订单id
+}
+
+// 生成冻结超时数据key, 与用户积分数据key在同一个slot
+func genFrozenTimeoutKey(data *FrozenTimeoutData) string {
+	if !useSlotShards(conf.Conf.FrozenTimeoutKeyFormat) {
+		return genFrozenTimeoutShardKey("")
+	}
+	slot := keySlot(genScoreDataKey(data.ScoreTypeID, data.Domain, data.Uid))
+	return genFrozenTimeoutShardKey(getSlotTag(slot))
+}
+
+func genFrozenTimeoutShardKey(slotTag string) string {
+	return strings.ReplaceAll(conf.Conf.FrozenTimeoutKeyFormat, templateString_SlotTag, slotTag)
+}
+
+// 获取所有冻结超时数据分片key
+func getAllFrozenTimeoutKeys() []string {
+	if !useSlotShards(conf.Conf.FrozenTimeoutKeyFormat) {
+		return []string{genFrozenTimeoutShardKey("")}
+	}
+	keys := make([]string, redisClusterSlots)
+	for i := range keys {
+		keys[i] = genFrozenTimeoutShardKey(getSlotTag(uint16(i)))
+	}
+	return keys
+}
+
+// 获取已超时的冻结数据, 从第 offset 个分片开始依次检查所有分片, 最多返回 limit 个.
+// 返回下次检查开始的分片, 即最后一个返回的数据所在分片的下一个分片, 避免靠前的分片一直占满 limit
+func GetFrozenTimeout(ctx context.Context, now int64, limit int64, offset int) ([]*FrozenTimeoutData, int, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := getAllFrozenTimeoutKeys()
+	if offset < 0 || offset >= len(keys) {
+		offset = 0
+	}
+	next := offset
+	ret := make([]*FrozenTimeoutData, 0)
+	for start := 0; start < len(keys) && int64(len(ret)) < limit; start += getSupplyPipelineSize {
+		end := start + getSupplyPipelineSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.Cmd, 0, end-start)
+		for i := start; i < end; i++ {
+			key := keys[(offset+i)%len(keys)]
+			cmds = append(cmds, pipe.Do(ctx, "ZRANGEBYSCORE", key, 0, now, "LIMIT", 0, limit))
+		}
+		_, err = pipe.Exec(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for i, cmd := range cmds {
+			if int64(len(ret)) >= limit {
+				break
+			}
+			shard := (offset + start + i) % len(keys)
+			members, _ := cmd.StringSlice()
+			for _, member := range members {
+				if int64(len(ret)) >= limit {
+					break
+				}
+				data := &FrozenTimeoutData{}
+				err = sonic.UnmarshalString(member, data)
+				if err != nil {
+					log.Error(ctx, "GetFrozenTimeout can't parse member", zap.String("member", member), zap.Error(err))
+					_ = rdb.ZRem(ctx, keys[shard], member).Err()
+					continue
+				}
+				ret = append(ret, data)
+				next = (shard + 1) % len(keys)
+			}
+		}
+	}
+	return ret, next, nil
+}
+
+// 删除冻结超时数据, 用于冻结订单不存在等无法通过lua脚本删除的情况
+func RemoveFrozenTimeout(ctx context.Context, data *FrozenTimeoutData) error {
+	member, err := sonic.MarshalString(data)
+	if err != nil {
+		return err
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return err
+	}
+	return rdb.ZRem(ctx, genFrozenTimeoutKey(data), member).Err()
+}
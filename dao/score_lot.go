@@ -0,0 +1,131 @@
+package dao
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/model"
+)
+
+// 积分批次数据为hash, field为增加积分的订单id, value为批次剩余积分
+// 积分批次过期时间为zset, member为增加积分的订单id, score为过期时间, 永不过期的批次为 +inf
+
+const (
+	// 获取批次模式的积分, 忽略已过期的批次 KEYS=[积分数据key, 积分批次数据key, 积分批次过期时间key]  ARGV=[当前时间]
+	getLotScoreLua = `
+local score = tonumber(redis.call('GET', KEYS[1]) or '0')
+local expired = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+for _, lot in ipairs(expired) do
+    score = score - tonumber(redis.call('HGET', KEYS[2], lot) or '0')
+end
+return score
+`
+)
+
+// 脚本sha1值, 如果存在则使用 EVALSHA 执行脚本
+var getLotScoreLuaSha1 = ""
+
+// 生成积分批次数据key
+func genScoreLotKey(scoreTypeID uint32, domain string, uid string) string {
+	text := conf.Conf.ScoreLotKeyFormat
+	text = strings.ReplaceAll(text, templateString_ScoreTypeID, strconv.FormatInt(int64(scoreTypeID), 10))
+	text = strings.ReplaceAll(text, templateString_Domain, domain)
+	text = strings.ReplaceAll(text, templateString_Uid, uid)
+	return text
+}
+
+// 生成积分批次过期时间key
+func genScoreLotExpireKey(scoreTypeID uint32, domain string, uid string) string {
+	text := conf.Conf.ScoreLotExpireKeyFormat
+	text = strings.ReplaceAll(text, templateString_ScoreTypeID, strconv.FormatInt(int64(scoreTypeID), 10))
+	text = strings.ReplaceAll(text, templateString_Domain, domain)
+	text = strings.ReplaceAll(text, templateString_Uid, uid)
+	return text
+}
+
+// 获取批次模式的积分, 已过期的批次不会计入
+func GetLotScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, now int64) (int64, error) {
+	keys := []string{
+		genScoreDataKey(scoreTypeID, domain, uid),
+		genScoreLotKey(scoreTypeID, domain, uid),
+		genScoreLotExpireKey(scoreTypeID, domain, uid),
+	}
+
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	var result interface{}
+	if getLotScoreLuaSha1 != "" {
+		result, err = rdb.EvalSha(ctx, getLotScoreLuaSha1, keys, now).Result()
+	} else {
+		result, err = rdb.Eval(ctx, getLotScoreLua, keys, now).Result()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cast.ToInt64(result), nil
+}
+
+// 获取未过期的积分批次, 按过期时间从早到晚排序
+func GetScoreLots(ctx context.Context, scoreTypeID uint32, domain string, uid string, now int64) ([]*model.ScoreLot, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := rdb.Do(ctx, "ZRANGEBYSCORE", genScoreLotExpireKey(scoreTypeID, domain, uid),
+		"("+strconv.FormatInt(now, 10), "+inf", "WITHSCORES").Slice()
+	if err != nil {
+		return nil, err
+	}
+	// RESP2 返回 member/score 交替的平铺数组, RESP3 返回 [member, score] 对
+	values := make([]interface{}, 0, len(reply)*2)
+	for _, v := range reply {
+		if pair, ok := v.([]interface{}); ok {
+			values = append(values, pair...)
+		} else {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	lots := make([]*model.ScoreLot, 0, len(values)/2)
+	fields := make([]string, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		lot := &model.ScoreLot{OrderID: cast.ToString(values[i])}
+		expire := cast.ToFloat64(values[i+1])
+		if !math.IsInf(expire, 1) {
+			lot.ExpireTime = int64(expire)
+		}
+		lots = append(lots, lot)
+		fields = append(fields, lot.OrderID)
+	}
+
+	amounts, err := rdb.HMGet(ctx, genScoreLotKey(scoreTypeID, domain, uid), fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取期间被消耗完的批次不返回
+	ret := lots[:0]
+	for i, lot := range lots {
+		if amounts[i] == nil {
+			continue
+		}
+		lot.Score = cast.ToInt64(amounts[i])
+		if lot.Score > 0 {
+			ret = append(ret, lot)
+		}
+	}
+	return ret, nil
+}
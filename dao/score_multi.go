@@ -0,0 +1,270 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cast"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/model"
+)
+
+const (
+	// 多积分类型原子操作 KEYS=[每个分项的(积分数据key, 订单状态key)..., 用户钱包key, 每个分项的积分供应量key..., 关联订单标记key]
+	// ARGV=[分项数量, 订单状态key有效期, 每个分项的(操作类型, 增加/扣除积分值, 最小余额, 最大余额)..., 每个分项的钱包成员...]
+	multiOpLua = `
+local n = tonumber(ARGV[1])
+local ex = tonumber(ARGV[2])
+
+-- 如果第一个分项的状态已写入则表示订单已完成, 直接返回所有分项的状态
+local status = redis.call('GET', KEYS[2])
+if status ~= false then
+    local ret = {}
+    for i = 1, n do
+        local s = redis.call('GET', KEYS[i * 2])
+        if s == false then
+            return redis.error_reply('order not found')
+        end
+        ret[i] = s .. '_1'
+    end
+    return ret
+end
+
+-- 检查所有分项的余额限制. 1=成功, 2=余额不足, 7=超过余额上限
+local state = '1'
+local olds = {}
+for i = 1, n do
+    local op = ARGV[i * 4 - 1]
+    local changeScore = tonumber(ARGV[i * 4])
+    local minScore = tonumber(ARGV[i * 4 + 1])
+    local maxScore = tonumber(ARGV[i * 4 + 2])
+    local oldScore = tonumber(redis.call('GET', KEYS[i * 2 - 1]) or '0')
+    olds[i] = oldScore
+    if state == '1' then
+        if op == '2' and oldScore - changeScore < minScore then
+            state = '2'
+        elseif op == '1' and maxScore > 0 and oldScore + changeScore > maxScore then
+            state = '7'
+        end
+    end
+end
+
+-- 全部成功才增减积分, 所有分项使用相同的状态
+local ret = {}
+for i = 1, n do
+    local op = ARGV[i * 4 - 1]
+    local changeScore = tonumber(ARGV[i * 4])
+    local nowScore = olds[i]
+    if state == '1' then
+        if op == '2' then
+            nowScore = redis.call('DECRBY', KEYS[i * 2 - 1], changeScore)
+            redis.call('HINCRBY', KEYS[n * 2 + 1 + i], 'deduct', changeScore)
+        else
+            nowScore = redis.call('INCRBY', KEYS[i * 2 - 1], changeScore)
+            redis.call('HINCRBY', KEYS[n * 2 + 1 + i], 'add', changeScore)
+        end
+        redis.call('SADD', KEYS[n * 2 + 1], ARGV[n * 4 + 2 + i])
+    end
+    status = op .. '_' .. state .. '_' .. tostring(olds[i]) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+
+    -- 写入状态
+    if ex < 1 then
+        redis.call('SET', KEYS[i * 2], status)
+    else
+        redis.call('SET', KEYS[i * 2], status, 'ex', ex)
+    end
+    ret[i] = status .. '_0'
+end
+
+-- 多于一个分项时标记第一个订单为关联订单, 冲正时拒绝
+if n > 1 then
+    if ex < 1 then
+        redis.call('SET', KEYS[n * 3 + 2], '1')
+    else
+        redis.call('SET', KEYS[n * 3 + 2], '1', 'ex', ex)
+    end
+end
+return ret
+`
+
+	// 按优先级扣除积分 KEYS=[每个积分类型的(积分数据key, 订单状态key)..., 用户钱包key, 每个积分类型的积分供应量key..., 关联订单标记key]
+	// ARGV=[积分类型数量, 订单状态key有效期, 扣除积分值, 每个积分类型的最小余额..., 每个积分类型的钱包成员...]
+	priorityDeductLua = `
+local n = tonumber(ARGV[1])
+local ex = tonumber(ARGV[2])
+local score = tonumber(ARGV[3])
+
+-- 如果第一个积分类型的状态已写入则表示订单已完成, 直接返回所有积分类型的状态
+local status = redis.call('GET', KEYS[2])
+if status ~= false then
+    local ret = {}
+    for i = 1, n do
+        local s = redis.call('GET', KEYS[i * 2])
+        if s == false then
+            return redis.error_reply('order not found')
+        end
+        ret[i] = s .. '_1'
+    end
+    return ret
+end
+
+-- 计算每个积分类型可扣除的积分
+local olds = {}
+local avails = {}
+local total = 0
+for i = 1, n do
+    local minScore = tonumber(ARGV[3 + i])
+    local oldScore = tonumber(redis.call('GET', KEYS[i * 2 - 1]) or '0')
+    local avail = oldScore - minScore
+    if avail < 0 then
+        avail = 0
+    end
+    olds[i] = oldScore
+    avails[i] = avail
+    total = total + avail
+end
+
+-- 总和不足时所有积分类型都不扣除. 1=成功, 2=余额不足
+local state = '1'
+if total < score then
+    state = '2'
+end
+
+-- 按顺序扣除直到扣完
+local remain = score
+local ret = {}
+for i = 1, n do
+    local changeScore = 0
+    local nowScore = olds[i]
+    if state == '1' and remain > 0 then
+        changeScore = math.min(avails[i], remain)
+        remain = remain - changeScore
+        if changeScore > 0 then
+            nowScore = redis.call('DECRBY', KEYS[i * 2 - 1], changeScore)
+            redis.call('SADD', KEYS[n * 2 + 1], ARGV[3 + n + i])
+            redis.call('HINCRBY', KEYS[n * 2 + 1 + i], 'deduct', changeScore)
+        end
+    end
+    status = '2_' .. state .. '_' .. tostring(olds[i]) .. '_' .. tostring(changeScore) .. '_' .. tostring(nowScore)
+
+    -- 写入状态
+    if ex < 1 then
+        redis.call('SET', KEYS[i * 2], status)
+    else
+        redis.call('SET', KEYS[i * 2], status, 'ex', ex)
+    end
+    ret[i] = status .. '_0'
+end
+
+-- 多于一个积分类型时标记第一个订单为关联订单, 冲正时拒绝
+if n > 1 then
+    if ex < 1 then
+        redis.call('SET', KEYS[n * 3 + 2], '1')
+    else
+        redis.call('SET', KEYS[n * 3 + 2], '1', 'ex', ex)
+    end
+end
+return ret
+`
+)
+
+// 脚本sha1值, 如果存在则使用 EVALSHA 执行脚本
+var (
+	multiOpLuaSha1        = ""
+	priorityDeductLuaSha1 = ""
+)
+
+// 生成多积分类型原子操作第 index 个分项的订单id, 第一个分项直接使用订单id
+func GenMultiOpOrderID(orderID string, index int) string {
+	if index == 0 {
+		return orderID
+	}
+	return orderID + "_" + strconv.Itoa(index)
+}
+
+// 多积分类型原子操作的分项
+type MultiOpLeg struct {
+	ScoreTypeID uint32       // 积分类型id
+	Domain      string       // 域
+	Op          model.OpType // 操作类型, 只支持增加和扣除
+	Score       int64        // 增加/扣除积分值
+	MinScore    int64        // 扣除后余额不能小于这个值
+	MaxScore    int64        // 增加后余额不能大于这个值, 0表示不限制
+}
+
+// 多积分类型原子操作. 所有分项全部成功或全部失败, 返回每个分项的订单数据和订单状态
+func MultiOp(ctx context.Context, orderID string, uid string, legs []*MultiOpLeg, statusExpireSec int64) ([]*model.OrderData, model.OrderStatus, error) {
+	keys := make([]string, 0, len(legs)*2)
+	args := make([]interface{}, 0, 2+len(legs)*4)
+	args = append(args, len(legs), statusExpireSec)
+	for i, leg := range legs {
+		keys = append(keys, genScoreDataKey(leg.ScoreTypeID, leg.Domain, uid), genOrderStatusKey(uid, GenMultiOpOrderID(orderID, i)))
+		args = append(args, int(leg.Op), leg.Score, leg.MinScore, leg.MaxScore)
+	}
+	keys = append(keys, genScoreWalletKey(uid))
+	for _, leg := range legs {
+		keys = append(keys, genScoreSupplyKey(leg.ScoreTypeID, leg.Domain, uid))
+		args = append(args, genWalletMember(leg.ScoreTypeID, leg.Domain))
+	}
+	keys = append(keys, genLinkedOrderKey(uid, orderID))
+
+	return evalMultiStatus(ctx, multiOpLua, multiOpLuaSha1, keys, args, len(legs))
+}
+
+// 按优先级扣除积分的积分来源
+type PriorityDeductSource struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	MinScore    int64  // 扣除后余额不能小于这个值
+}
+
+// 按优先级扣除积分. 按 sources 的顺序扣除直到扣完, 所有来源的可用积分总和不足时全部不扣除. 返回每个来源的订单数据和订单状态
+func PriorityDeduct(ctx context.Context, orderID string, uid string, sources []*PriorityDeductSource, score int64, statusExpireSec int64) ([]*model.OrderData, model.OrderStatus, error) {
+	keys := make([]string, 0, len(sources)*2)
+	args := make([]interface{}, 0, 3+len(sources))
+	args = append(args, len(sources), statusExpireSec, score)
+	for i, src := range sources {
+		keys = append(keys, genScoreDataKey(src.ScoreTypeID, src.Domain, uid), genOrderStatusKey(uid, GenMultiOpOrderID(orderID, i)))
+		args = append(args, src.MinScore)
+	}
+	keys = append(keys, genScoreWalletKey(uid))
+	for _, src := range sources {
+		keys = append(keys, genScoreSupplyKey(src.ScoreTypeID, src.Domain, uid))
+		args = append(args, genWalletMember(src.ScoreTypeID, src.Domain))
+	}
+	keys = append(keys, genLinkedOrderKey(uid, orderID))
+	return evalMultiStatus(ctx, priorityDeductLua, priorityDeductLuaSha1, keys, args, len(sources))
+}
+
+// 执行返回多个订单状态的脚本, 所有订单状态相同
+func evalMultiStatus(ctx context.Context, script, sha1 string, keys []string, args []interface{}, n int) ([]*model.OrderData, model.OrderStatus, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var statusResult []interface{}
+	if sha1 != "" {
+		statusResult, err = rdb.EvalSha(ctx, sha1, keys, args...).Slice()
+	} else {
+		statusResult, err = rdb.Eval(ctx, script, keys, args...).Slice()
+	}
+	if err != nil {
+		return nil, 0, parseLuaErr(err)
+	}
+	if len(statusResult) != n {
+		return nil, 0, fmt.Errorf("parse multi statusResult err. statusResult=%v", statusResult)
+	}
+
+	ret := make([]*model.OrderData, n)
+	var status model.OrderStatus
+	for i, v := range statusResult {
+		ret[i], status, err = parseStatus(cast.ToString(v))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return ret, status, nil
+}
@@ -0,0 +1,93 @@
+package dao
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/zly-app/component/redis"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/model"
+)
+
+// 排行榜为zset, member为用户id, score为用户的积分余额, 由积分变更后的副作用写入.
+// 排行榜key是全局的, 在redis集群中无法与用户的积分数据key在同一个slot, 所以不能在积分变更的lua脚本中写入.
+// zset的score为float64, 积分余额的绝对值超过 2^53 时排序可能不准确
+
+// 生成排行榜key
+func genLeaderboardKey(scoreTypeID uint32, domain string) string {
+	text := conf.Conf.LeaderboardKeyFormat
+	text = strings.ReplaceAll(text, templateString_ScoreTypeID, strconv.FormatInt(int64(scoreTypeID), 10))
+	text = strings.ReplaceAll(text, templateString_Domain, domain)
+	return text
+}
+
+// 更新用户在排行榜中的积分
+func UpdateLeaderboard(ctx context.Context, scoreTypeID uint32, domain string, uid string, score int64) error {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return err
+	}
+	return rdb.ZAdd(ctx, genLeaderboardKey(scoreTypeID, domain), redis.Z{Score: float64(score), Member: uid}).Err()
+}
+
+// 获取排行榜中名次在 [start, stop] 的用户, 名次从0开始, 按积分从高到低排序
+func GetLeaderboardRange(ctx context.Context, scoreTypeID uint32, domain string, start, stop int64) ([]*model.RankItem, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+	zs, err := rdb.ZRevRangeWithScores(ctx, genLeaderboardKey(scoreTypeID, domain), start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*model.RankItem, len(zs))
+	for i, z := range zs {
+		uid, _ := z.Member.(string)
+		ret[i] = &model.RankItem{
+			Uid:   uid,
+			Score: int64(z.Score),
+			Rank:  start + int64(i) + 1,
+		}
+	}
+	return ret, nil
+}
+
+// 获取用户在排行榜中的名次, 用户不在排行榜中时 Rank 为0
+func GetLeaderboardRank(ctx context.Context, scoreTypeID uint32, domain string, uid string) (*model.RankItem, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	key := genLeaderboardKey(scoreTypeID, domain)
+	pipe := rdb.Pipeline()
+	rankCmd := pipe.ZRevRank(ctx, key, uid)
+	scoreCmd := pipe.ZScore(ctx, key, uid)
+	_, err = pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	ret := &model.RankItem{Uid: uid}
+	rank, err := rankCmd.Result()
+	if err == redis.Nil {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	score, err := scoreCmd.Result()
+	if err == redis.Nil { // 两个命令之间用户被移出排行榜
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret.Score = int64(score)
+	ret.Rank = rank + 1
+	return ret, nil
+}
@@ -0,0 +1,320 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/spf13/cast"
+	"github.com/zly-app/component/redis"
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/model"
+)
+
+// 修改订单状态的操作状态, 保留其有效期. 只有当前的操作状态为指定的值时才会修改
+// KEYS=[订单状态key]  ARGV=[当前的操作状态, 新的操作状态]
+const changeOrderStateLua = `
+local status = redis.call('GET', KEYS[1])
+if status == false then
+    return 0
+end
+local op, state, rest = string.match(status, '^(%d+)_(%d+)_(.*)$')
+if state ~= ARGV[1] then
+    return 0
+end
+
+status = op .. '_' .. ARGV[2] .. '_' .. rest
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+    redis.call('SET', KEYS[1], status, 'px', ttl)
+else
+    redis.call('SET', KEYS[1], status)
+end
+return 1
+`
+
+// 恢复冻结积分数据和冻结超时, 只有冻结订单状态仍为已冻结时才会写入, 已存在的冻结积分数据不会被覆盖
+// KEYS=[冻结订单状态key, 冻结积分数据key, 冻结超时数据key]  ARGV=[冻结积分值_超时时间, 超时时间, 冻结超时数据成员]
+const restoreFrozenLua = `
+local status = redis.call('GET', KEYS[1])
+if status == false or string.match(status, '^4_3_') == nil then
+    return 0
+end
+if redis.call('HSETNX', KEYS[2], KEYS[1], ARGV[1]) == 0 then
+    return 0
+end
+if tonumber(ARGV[2]) > 0 then
+    redis.call('ZADD', KEYS[3], 'NX', ARGV[2], ARGV[3])
+end
+return 1
+`
+
+// 需要恢复的积分数据
+type RestoreScoreItem struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	Score       int64
+}
+
+// 需要恢复的订单状态
+type RestoreOrderStatusItem struct {
+	Uid       string
+	OrderID   string
+	Data      *model.OrderData
+	Status    model.OrderStatus
+	ExpireSec int64 // 订单状态有效期, 小于1表示永不过期
+}
+
+// 需要恢复的关联订单标记
+type RestoreLinkedOrderItem struct {
+	Uid       string
+	OrderID   string // 生成订单id的订单id
+	ExpireSec int64  // 标记有效期, 与订单状态相同, 小于1表示永不过期
+}
+
+// 需要恢复的冻结积分
+type RestoreFrozenItem struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	OrderID     string // 冻结订单id
+	Score       int64  // 冻结积分值
+	Deadline    int64  // 超时时间, 0表示不会超时
+}
+
+// 从流水累计的积分供应量, key为供应量分片key
+type RestoreSupplies map[string]*ScoreSupply
+
+// 将用户的积分变更累计到所在的供应量分片
+func (r RestoreSupplies) Add(scoreTypeID uint32, domain string, uid string, v *ScoreSupply) {
+	key := genScoreSupplyKey(scoreTypeID, domain, uid)
+	s, ok := r[key]
+	if !ok {
+		s = &ScoreSupply{}
+		r[key] = s
+	}
+	s.Added += v.Added
+	s.Deducted += v.Deducted
+	s.Reset += v.Reset
+	s.Expired += v.Expired
+}
+
+// 生成订单状态值, 与lua脚本写入的格式相同
+func formatOrderStatus(data *model.OrderData, status model.OrderStatus) string {
+	return fmt.Sprintf("%d_%d_%d_%d_%d", data.OpType, status, data.OldScore, data.ChangeScore, data.ResultScore)
+}
+
+// 批量恢复积分数据并将积分类型和域写入用户钱包. overwrite 为false时只写入不存在的积分数据. 返回写入的积分数据数量
+func RestoreScores(ctx context.Context, items []*RestoreScoreItem, overwrite bool) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	setCmds := make([]*redis.StatusCmd, 0, len(items))
+	setNXCmds := make([]*redis.BoolCmd, 0, len(items))
+	pipe := rdb.Pipeline()
+	for _, item := range items {
+		key := genScoreDataKey(item.ScoreTypeID, item.Domain, item.Uid)
+		if overwrite {
+			setCmds = append(setCmds, pipe.Set(ctx, key, item.Score, 0))
+		} else {
+			setNXCmds = append(setNXCmds, pipe.SetNX(ctx, key, item.Score, 0))
+		}
+		pipe.SAdd(ctx, genScoreWalletKey(item.Uid), genWalletMember(item.ScoreTypeID, item.Domain))
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.Error(ctx, "RestoreScores err", zap.Int("count", len(items)), zap.Bool("overwrite", overwrite), zap.Error(err))
+		return 0, err
+	}
+
+	n := len(setCmds)
+	for _, cmd := range setNXCmds {
+		if cmd.Val() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 批量恢复订单状态, 只写入不存在的订单状态. 返回写入的订单状态数量
+func RestoreOrderStatuses(ctx context.Context, items []*RestoreOrderStatusItem) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	cmds := make([]*redis.BoolCmd, len(items))
+	pipe := rdb.Pipeline()
+	for i, item := range items {
+		key := genOrderStatusKey(item.Uid, item.OrderID)
+		var ex time.Duration
+		if item.ExpireSec > 0 {
+			ex = time.Duration(item.ExpireSec) * time.Second
+		}
+		cmds[i] = pipe.SetNX(ctx, key, formatOrderStatus(item.Data, item.Status), ex)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.Error(ctx, "RestoreOrderStatuses err", zap.Int("count", len(items)), zap.Error(err))
+		return 0, err
+	}
+
+	n := 0
+	for _, cmd := range cmds {
+		if cmd.Val() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 批量恢复关联订单标记, 只写入不存在的标记. 返回写入的标记数量
+func RestoreLinkedOrders(ctx context.Context, items []*RestoreLinkedOrderItem) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	cmds := make([]*redis.BoolCmd, len(items))
+	pipe := rdb.Pipeline()
+	for i, item := range items {
+		var ex time.Duration
+		if item.ExpireSec > 0 {
+			ex = time.Duration(item.ExpireSec) * time.Second
+		}
+		cmds[i] = pipe.SetNX(ctx, genLinkedOrderKey(item.Uid, item.OrderID), "1", ex)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.Error(ctx, "RestoreLinkedOrders err", zap.Int("count", len(items)), zap.Error(err))
+		return 0, err
+	}
+
+	n := 0
+	for _, cmd := range cmds {
+		if cmd.Val() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 批量恢复冻结积分数据和冻结超时, 需要在订单状态恢复后调用. 只恢复订单状态仍为已冻结且不存在冻结积分数据的订单. 返回写入的冻结积分数量
+func RestoreFrozens(ctx context.Context, items []*RestoreFrozenItem) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	cmds := make([]*redis.Cmd, len(items))
+	pipe := rdb.Pipeline()
+	for i, item := range items {
+		timeout := &FrozenTimeoutData{ScoreTypeID: item.ScoreTypeID, Domain: item.Domain, Uid: item.Uid, OrderID: item.OrderID}
+		timeoutMember, err := sonic.MarshalString(timeout)
+		if err != nil {
+			return 0, err
+		}
+		keys := []string{
+			genOrderStatusKey(item.Uid, item.OrderID),
+			genScoreFrozenKey(item.ScoreTypeID, item.Domain, item.Uid),
+			genFrozenTimeoutKey(timeout),
+		}
+		value := strconv.FormatInt(item.Score, 10) + "_" + strconv.FormatInt(item.Deadline, 10)
+		cmds[i] = pipe.Eval(ctx, restoreFrozenLua, keys, value, item.Deadline, timeoutMember)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.Error(ctx, "RestoreFrozens err", zap.Int("count", len(items)), zap.Error(err))
+		return 0, err
+	}
+
+	n := 0
+	for _, cmd := range cmds {
+		if cast.ToInt(cmd.Val()) == 1 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 批量恢复积分供应量的 add/deduct/reset. overwrite 为false时只写入不存在的field. 返回写入的供应量分片数量
+func RestoreScoreSupplies(ctx context.Context, supplies RestoreSupplies, overwrite bool) (int, error) {
+	if len(supplies) == 0 {
+		return 0, nil
+	}
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	pipe := rdb.Pipeline()
+	var setNXCmds [][]*redis.BoolCmd
+	for key, s := range supplies {
+		if overwrite {
+			pipe.HSet(ctx, key, "add", s.Added, "deduct", s.Deducted, "reset", s.Reset)
+			n++
+			continue
+		}
+		setNXCmds = append(setNXCmds, []*redis.BoolCmd{
+			pipe.HSetNX(ctx, key, "add", s.Added),
+			pipe.HSetNX(ctx, key, "deduct", s.Deducted),
+			pipe.HSetNX(ctx, key, "reset", s.Reset),
+		})
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.Error(ctx, "RestoreScoreSupplies err", zap.Int("count", len(supplies)), zap.Bool("overwrite", overwrite), zap.Error(err))
+		return 0, err
+	}
+
+	for _, cmds := range setNXCmds {
+		for _, cmd := range cmds {
+			if cmd.Val() {
+				n++
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// 修改订单状态的操作状态, 保留其有效期. 只有当前的操作状态为 from 时才会修改为 to, 返回是否修改
+func ChangeOrderState(ctx context.Context, uid string, orderID string, from model.OrderStatus, to model.OrderStatus) (bool, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return false, err
+	}
+	key := genOrderStatusKey(uid, orderID)
+	result, err := rdb.Eval(ctx, changeOrderStateLua, []string{key}, int(from), int(to)).Result()
+	if err != nil {
+		log.Error(ctx, "ChangeOrderState err",
+			zap.String("key", key),
+			zap.Int8("from", int8(from)),
+			zap.Int8("to", int8(to)),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	return cast.ToInt(result) == 1, nil
+}
@@ -0,0 +1,389 @@
+package dao
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zlyuancn/score/model"
+)
+
+// 测试redis地址的环境变量, 为空时跳过依赖redis的测试. 测试会写入数据, 应该使用单独的redis
+const testRedisAddrEnv = "SCORE_TEST_REDIS_ADDR"
+
+// 测试订单状态有效期
+const testStatusExpireSec = 600
+
+// 没有配置测试redis时跳过, 返回这次测试使用的uid前缀, 避免重复运行时读到之前的订单状态
+func requireRedis(t *testing.T) string {
+	t.Helper()
+	if os.Getenv(testRedisAddrEnv) == "" {
+		t.Skip(testRedisAddrEnv + " is empty")
+	}
+	return t.Name() + "_" + strconv.FormatInt(time.Now().UnixNano(), 10) + "_"
+}
+
+func redisAddScore(t *testing.T, orderID string, scoreTypeID uint32, uid string, score int64, opt *AddScoreOption) (*model.OrderData, model.OrderStatus) {
+	t.Helper()
+	if opt == nil {
+		opt = &AddScoreOption{}
+	}
+	data, status, err := redisStore{}.AddScore(context.Background(), orderID, scoreTypeID, testDomain, uid, score, testStatusExpireSec, opt)
+	if err != nil {
+		t.Fatalf("AddScore %s err: %v", orderID, err)
+	}
+	return data, status
+}
+
+func checkRedisScore(t *testing.T, scoreTypeID uint32, uid string, want int64) {
+	t.Helper()
+	got, err := redisStore{}.GetScore(context.Background(), scoreTypeID, testDomain, uid)
+	if err != nil {
+		t.Fatalf("GetScore err: %v", err)
+	}
+	if got != want {
+		t.Fatalf("%s score=%d, want %d", uid, got, want)
+	}
+}
+
+func checkRedisOrderStatus(t *testing.T, orderID string, uid string, want model.OrderStatus) {
+	t.Helper()
+	_, status, err := redisStore{}.GetOrderStatus(context.Background(), orderID, uid)
+	if err != nil {
+		t.Fatalf("GetOrderStatus %s err: %v", orderID, err)
+	}
+	if status != want {
+		t.Fatalf("%s status=%d, want %d", orderID, status, want)
+	}
+}
+
+func TestRedisFreezeAndSettle(t *testing.T) {
+	uid := requireRedis(t) + "u"
+	ctx := context.Background()
+	redisAddScore(t, "add", testScoreTypeID, uid, 100, nil)
+
+	freeze := func(orderID string, score int64, deadline int64) (*model.OrderData, model.OrderStatus) {
+		t.Helper()
+		data, status, err := FreezeScore(ctx, orderID, testScoreTypeID, testDomain, uid, score, testStatusExpireSec, deadline, 0)
+		if err != nil {
+			t.Fatalf("FreezeScore %s err: %v", orderID, err)
+		}
+		return data, status
+	}
+	settle := func(op model.OpType, orderID string, now int64) (*model.OrderData, model.OrderStatus, error) {
+		return SettleFrozen(ctx, op, orderID, testScoreTypeID, testDomain, uid, testStatusExpireSec, now)
+	}
+	checkFrozen := func(want int64) {
+		t.Helper()
+		got, err := GetFrozenScore(ctx, testScoreTypeID, testDomain, uid)
+		if err != nil {
+			t.Fatalf("GetFrozenScore err: %v", err)
+		}
+		if got != want {
+			t.Fatalf("frozen=%d, want %d", got, want)
+		}
+	}
+	now := time.Now().Unix()
+
+	// 冻结和重入
+	if _, status := freeze("f1", 30, 0); status != model.OrderStatus_Frozen {
+		t.Fatalf("freeze status=%d, want %d", status, model.OrderStatus_Frozen)
+	}
+	if data, status := freeze("f1", 30, 0); !data.IsReentry || status != model.OrderStatus_Frozen {
+		t.Fatalf("freeze reentry=%v status=%d", data.IsReentry, status)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 70)
+	checkFrozen(30)
+
+	// 余额不足
+	if _, status := freeze("f2", 100, 0); status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("freeze status=%d, want %d", status, model.OrderStatus_InsufficientBalance)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 70)
+
+	// 确认冻结, 重复确认为重入, 确认后取消不会返还积分
+	_, status, err := settle(model.OpType_ConfirmFrozen, "f1", now)
+	if err != nil || status != model.OrderStatus_Confirmed {
+		t.Fatalf("confirm status=%d err=%v", status, err)
+	}
+	data, status, err := settle(model.OpType_ConfirmFrozen, "f1", now)
+	if err != nil || !data.IsReentry || status != model.OrderStatus_Confirmed {
+		t.Fatalf("confirm again reentry=%v status=%d err=%v", data.IsReentry, status, err)
+	}
+	_, status, err = settle(model.OpType_CancelFrozen, "f1", now)
+	if err != nil || status != model.OrderStatus_Confirmed {
+		t.Fatalf("cancel confirmed status=%d err=%v", status, err)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 70)
+	checkFrozen(0)
+	checkRedisOrderStatus(t, "f1", uid, model.OrderStatus_Confirmed)
+
+	// 取消冻结返还积分, 取消后确认不会扣除
+	freeze("f3", 20, 0)
+	_, status, err = settle(model.OpType_CancelFrozen, "f3", now)
+	if err != nil || status != model.OrderStatus_Cancelled {
+		t.Fatalf("cancel status=%d err=%v", status, err)
+	}
+	_, status, err = settle(model.OpType_ConfirmFrozen, "f3", now)
+	if err != nil || status != model.OrderStatus_Cancelled {
+		t.Fatalf("confirm cancelled status=%d err=%v", status, err)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 70)
+
+	// 超时后确认会取消冻结
+	freeze("f4", 10, now-1)
+	_, status, err = settle(model.OpType_ConfirmFrozen, "f4", now)
+	if err != nil || status != model.OrderStatus_Cancelled {
+		t.Fatalf("confirm timeout status=%d err=%v", status, err)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 70)
+
+	// 订单不存在或不是冻结订单
+	if _, _, err = settle(model.OpType_ConfirmFrozen, "f5", now); err != ErrOrderNotFound {
+		t.Fatalf("settle missing err=%v, want %v", err, ErrOrderNotFound)
+	}
+	if _, _, err = settle(model.OpType_ConfirmFrozen, "add", now); err != ErrOrderNotFrozen {
+		t.Fatalf("settle add err=%v, want %v", err, ErrOrderNotFrozen)
+	}
+}
+
+func TestRedisReverseOrder(t *testing.T) {
+	prefix := requireRedis(t)
+	uid := prefix + "u"
+	ctx := context.Background()
+	reverse := func(originOrderID string, orderID string, maxScore int64, rejectedOrderID string) (*model.OrderData, model.OrderStatus, error) {
+		return ReverseOrder(ctx, originOrderID, orderID, testScoreTypeID, testDomain, uid, testStatusExpireSec, 0, maxScore, rejectedOrderID)
+	}
+
+	// 冲正增加积分, 重试为重入, 使用其它订单号冲正已冲正的订单失败
+	redisAddScore(t, "a1", testScoreTypeID, uid, 100, nil)
+	_, status, err := reverse("a1", "r1", 0, "")
+	if err != nil || status != model.OrderStatus_Finish {
+		t.Fatalf("reverse status=%d err=%v", status, err)
+	}
+	data, status, err := reverse("a1", "r1", 0, "")
+	if err != nil || !data.IsReentry || status != model.OrderStatus_Finish {
+		t.Fatalf("reverse again reentry=%v status=%d err=%v", data.IsReentry, status, err)
+	}
+	if _, _, err = reverse("a1", "r2", 0, ""); err != ErrOrderReversed {
+		t.Fatalf("reverse reversed err=%v, want %v", err, ErrOrderReversed)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 0)
+	checkRedisOrderStatus(t, "a1", uid, model.OrderStatus_Reversed)
+
+	// 余额不足时不锁定冲正订单, 充值后使用相同的冲正订单号重试
+	redisAddScore(t, "a2", testScoreTypeID, uid, 50, nil)
+	redisAddScore(t, "d1", testScoreTypeID, uid, -40, nil)
+	rejectedOrderID := GenRejectedOrderID("r3")
+	_, status, err = reverse("a2", "r3", 0, rejectedOrderID)
+	if err != nil || status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("reverse insufficient status=%d err=%v", status, err)
+	}
+	checkRedisOrderStatus(t, rejectedOrderID, uid, model.OrderStatus_InsufficientBalance)
+	checkRedisOrderStatus(t, "a2", uid, model.OrderStatus_Finish)
+	redisAddScore(t, "a3", testScoreTypeID, uid, 100, nil)
+	data, status, err = reverse("a2", "r3", 0, GenRejectedOrderID("r3"))
+	if err != nil || data.IsReentry || status != model.OrderStatus_Finish {
+		t.Fatalf("reverse retry reentry=%v status=%d err=%v", data.IsReentry, status, err)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 60)
+
+	// 冲正扣除积分超过余额上限
+	_, status, err = reverse("d1", "r4", 80, "")
+	if err != nil || status != model.OrderStatus_ExceedLimit {
+		t.Fatalf("reverse exceed status=%d err=%v", status, err)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 60)
+	checkRedisOrderStatus(t, "d1", uid, model.OrderStatus_Finish)
+
+	// 转账的订单不允许冲正
+	_, _, status, err = TransferScore(ctx, "t1", testScoreTypeID, testDomain, uid, prefix+"to", 10, testStatusExpireSec, 0, 0)
+	if err != nil || status != model.OrderStatus_Finish {
+		t.Fatalf("transfer status=%d err=%v", status, err)
+	}
+	if _, _, err = reverse("t1", "r5", 0, ""); err != ErrOrderNotReversible {
+		t.Fatalf("reverse linked err=%v, want %v", err, ErrOrderNotReversible)
+	}
+	checkRedisScore(t, testScoreTypeID, uid, 50)
+}
+
+func TestRedisTransferAndExchange(t *testing.T) {
+	prefix := requireRedis(t)
+	from, to := prefix+"from", prefix+"to"
+	ctx := context.Background()
+	redisAddScore(t, "a1", testScoreTypeID, from, 100, nil)
+
+	transfer := func(orderID string, score int64, maxScore int64) (*model.OrderData, *model.OrderData, model.OrderStatus) {
+		t.Helper()
+		fromData, toData, status, err := TransferScore(ctx, orderID, testScoreTypeID, testDomain, from, to, score, testStatusExpireSec, 0, maxScore)
+		if err != nil {
+			t.Fatalf("TransferScore %s err: %v", orderID, err)
+		}
+		return fromData, toData, status
+	}
+
+	// 转账和重入
+	if _, _, status := transfer("t1", 30, 0); status != model.OrderStatus_Finish {
+		t.Fatalf("transfer status=%d", status)
+	}
+	if fromData, toData, status := transfer("t1", 30, 0); !fromData.IsReentry || !toData.IsReentry || status != model.OrderStatus_Finish {
+		t.Fatalf("transfer reentry=%v/%v status=%d", fromData.IsReentry, toData.IsReentry, status)
+	}
+	checkRedisScore(t, testScoreTypeID, from, 70)
+	checkRedisScore(t, testScoreTypeID, to, 30)
+	checkRedisOrderStatus(t, GenTransferInOrderID("t1"), to, model.OrderStatus_Finish)
+	if linked, err := IsLinkedOrder(ctx, "t1", from); err != nil || !linked {
+		t.Fatalf("IsLinkedOrder=%v err=%v, want true", linked, err)
+	}
+
+	// 余额不足和超过余额上限时双方都不变更
+	if _, _, status := transfer("t2", 100, 0); status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("transfer status=%d, want %d", status, model.OrderStatus_InsufficientBalance)
+	}
+	if _, _, status := transfer("t3", 30, 50); status != model.OrderStatus_ExceedLimit {
+		t.Fatalf("transfer status=%d, want %d", status, model.OrderStatus_ExceedLimit)
+	}
+	checkRedisScore(t, testScoreTypeID, from, 70)
+	checkRedisScore(t, testScoreTypeID, to, 30)
+
+	// 兑换为另一个积分类型
+	const toScoreTypeID = testScoreTypeID + 1
+	_, _, status, err := ExchangeScore(ctx, "e1", testScoreTypeID, testDomain, toScoreTypeID, testDomain, from, 50, 5, testStatusExpireSec, 0, 0)
+	if err != nil || status != model.OrderStatus_Finish {
+		t.Fatalf("exchange status=%d err=%v", status, err)
+	}
+	_, _, status, err = ExchangeScore(ctx, "e2", testScoreTypeID, testDomain, toScoreTypeID, testDomain, from, 50, 5, testStatusExpireSec, 0, 0)
+	if err != nil || status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("exchange status=%d err=%v", status, err)
+	}
+	checkRedisScore(t, testScoreTypeID, from, 20)
+	checkRedisScore(t, toScoreTypeID, from, 5)
+}
+
+func TestRedisMultiOp(t *testing.T) {
+	uid := requireRedis(t) + "u"
+	ctx := context.Background()
+	const scoreTypeA, scoreTypeB = testScoreTypeID, testScoreTypeID + 1
+	redisAddScore(t, "a1", scoreTypeB, uid, 20, nil)
+
+	multiOp := func(orderID string, deductB int64) ([]*model.OrderData, model.OrderStatus) {
+		t.Helper()
+		datas, status, err := MultiOp(ctx, orderID, uid, []*MultiOpLeg{
+			{ScoreTypeID: scoreTypeA, Domain: testDomain, Op: model.OpType_Add, Score: 10},
+			{ScoreTypeID: scoreTypeB, Domain: testDomain, Op: model.OpType_Deduct, Score: deductB},
+		}, testStatusExpireSec)
+		if err != nil {
+			t.Fatalf("MultiOp %s err: %v", orderID, err)
+		}
+		return datas, status
+	}
+
+	// 任意分项失败时所有分项都不变更
+	if _, status := multiOp("m1", 50); status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("multiOp status=%d, want %d", status, model.OrderStatus_InsufficientBalance)
+	}
+	checkRedisScore(t, scoreTypeA, uid, 0)
+	checkRedisScore(t, scoreTypeB, uid, 20)
+
+	// 成功和重入
+	if _, status := multiOp("m2", 15); status != model.OrderStatus_Finish {
+		t.Fatalf("multiOp status=%d", status)
+	}
+	datas, status := multiOp("m2", 15)
+	if status != model.OrderStatus_Finish || !datas[0].IsReentry || !datas[1].IsReentry {
+		t.Fatalf("multiOp reentry status=%d", status)
+	}
+	checkRedisScore(t, scoreTypeA, uid, 10)
+	checkRedisScore(t, scoreTypeB, uid, 5)
+	checkRedisOrderStatus(t, GenMultiOpOrderID("m2", 1), uid, model.OrderStatus_Finish)
+	if linked, err := IsLinkedOrder(ctx, "m2", uid); err != nil || !linked {
+		t.Fatalf("IsLinkedOrder=%v err=%v, want true", linked, err)
+	}
+}
+
+func TestRedisPriorityDeduct(t *testing.T) {
+	uid := requireRedis(t) + "u"
+	ctx := context.Background()
+	const scoreTypeA, scoreTypeB = testScoreTypeID, testScoreTypeID + 1
+	redisAddScore(t, "a1", scoreTypeA, uid, 30, nil)
+	redisAddScore(t, "a2", scoreTypeB, uid, 50, nil)
+
+	deduct := func(orderID string, score int64) ([]*model.OrderData, model.OrderStatus) {
+		t.Helper()
+		datas, status, err := PriorityDeduct(ctx, orderID, uid, []*PriorityDeductSource{
+			{ScoreTypeID: scoreTypeA, Domain: testDomain},
+			{ScoreTypeID: scoreTypeB, Domain: testDomain},
+		}, score, testStatusExpireSec)
+		if err != nil {
+			t.Fatalf("PriorityDeduct %s err: %v", orderID, err)
+		}
+		return datas, status
+	}
+
+	// 可用积分总和不足时全部不扣除
+	if _, status := deduct("p1", 100); status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("deduct status=%d, want %d", status, model.OrderStatus_InsufficientBalance)
+	}
+	checkRedisScore(t, scoreTypeA, uid, 30)
+	checkRedisScore(t, scoreTypeB, uid, 50)
+
+	// 按顺序扣除, 重试为重入
+	datas, status := deduct("p2", 60)
+	if status != model.OrderStatus_Finish || datas[0].ChangeScore != 30 || datas[1].ChangeScore != 30 {
+		t.Fatalf("deduct status=%d changes=%d/%d, want 30/30", status, datas[0].ChangeScore, datas[1].ChangeScore)
+	}
+	datas, status = deduct("p2", 60)
+	if status != model.OrderStatus_Finish || !datas[0].IsReentry || !datas[1].IsReentry {
+		t.Fatalf("deduct reentry status=%d", status)
+	}
+	checkRedisScore(t, scoreTypeA, uid, 0)
+	checkRedisScore(t, scoreTypeB, uid, 20)
+}
+
+func TestRedisLotFIFO(t *testing.T) {
+	uid := requireRedis(t) + "u"
+	ctx := context.Background()
+	now := time.Now().Unix()
+	lot := func(expireTime int64) *AddScoreOption {
+		return &AddScoreOption{LotMode: true, LotExpireTime: expireTime}
+	}
+
+	redisAddScore(t, "l1", testScoreTypeID, uid, 10, lot(0))
+	redisAddScore(t, "l2", testScoreTypeID, uid, 20, lot(now+3600))
+	redisAddScore(t, "l3", testScoreTypeID, uid, 5, lot(now+60))
+
+	// 先消耗最早过期的批次
+	_, status := redisAddScore(t, "d1", testScoreTypeID, uid, -15, lot(0))
+	if status != model.OrderStatus_Finish {
+		t.Fatalf("deduct status=%d", status)
+	}
+	lots, err := GetScoreLots(ctx, testScoreTypeID, testDomain, uid, now)
+	if err != nil {
+		t.Fatalf("GetScoreLots err: %v", err)
+	}
+	want := []model.ScoreLot{{OrderID: "l2", Score: 10, ExpireTime: now + 3600}, {OrderID: "l1", Score: 10}}
+	if len(lots) != len(want) {
+		t.Fatalf("lots=%d, want %d", len(lots), len(want))
+	}
+	for i := range want {
+		if *lots[i] != want[i] {
+			t.Fatalf("lot %d=%+v, want %+v", i, *lots[i], want[i])
+		}
+	}
+
+	// 余额不足时不消耗批次
+	if _, status = redisAddScore(t, "d2", testScoreTypeID, uid, -30, lot(0)); status != model.OrderStatus_InsufficientBalance {
+		t.Fatalf("deduct status=%d, want %d", status, model.OrderStatus_InsufficientBalance)
+	}
+
+	// 过期的批次不计入积分
+	score, err := GetLotScore(ctx, testScoreTypeID, testDomain, uid, now+7200)
+	if err != nil {
+		t.Fatalf("GetLotScore err: %v", err)
+	}
+	if score != 10 {
+		t.Fatalf("lot score=%d, want 10", score)
+	}
+}
@@ -0,0 +1,170 @@
+package dao
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/component/redis"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/conf"
+)
+
+// 积分供应量为hash, 在积分变更的lua脚本中写入. field如下
+//   add    增加的积分总值, 包含冲正扣除积分的订单
+//   deduct 扣除的积分总值, 包含确认冻结和冲正增加积分的订单
+//   reset  重设积分对余额的净影响
+//   expire 批次模式下已清理的过期积分总值
+//
+// 由于lua脚本要求操作的key在同一个slot, 在redis集群中供应量按用户积分数据key所在的slot分片, 每个分片的key使用一个能落在这个slot的 hash tag.
+// 非集群的redis或供应量key格式化字符串中不包含 <slot_tag> 时只有一个key
+
+const templateString_SlotTag = "<slot_tag>"
+
+// redis集群的slot数量
+const redisClusterSlots = 16384
+
+var (
+	slotTagsOnce sync.Once
+	slotTags     []string // 下标为slot, 值为落在这个slot的 hash tag
+)
+
+// 获取落在 slot 的 hash tag
+func getSlotTag(slot uint16) string {
+	slotTagsOnce.Do(func() {
+		tags := make([]string, redisClusterSlots)
+		for i, n := 0, 0; n < redisClusterSlots; i++ {
+			tag := strconv.Itoa(i)
+			s := crc16(tag) % redisClusterSlots
+			if tags[s] == "" {
+				tags[s] = tag
+				n++
+			}
+		}
+		slotTags = tags
+	})
+	return slotTags[slot]
+}
+
+// 积分数据redis是否为集群客户端. 非集群的redis所有key都在同一个节点, 不需要按slot分片
+func isRedisCluster() bool {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return false
+	}
+	_, ok := rdb.(interface{ ReloadState(ctx context.Context) })
+	return ok
+}
+
+// key格式化字符串是否需要按slot分片
+func useSlotShards(format string) bool {
+	return strings.Contains(format, templateString_SlotTag) && isRedisCluster()
+}
+
+// 生成积分供应量key, 与用户的积分数据key在同一个slot
+func genScoreSupplyKey(scoreTypeID uint32, domain string, uid string) string {
+	if !useSlotShards(conf.Conf.ScoreSupplyKeyFormat) {
+		return genScoreSupplyShardKey(scoreTypeID, domain, "")
+	}
+	slot := keySlot(genScoreDataKey(scoreTypeID, domain, uid))
+	return genScoreSupplyShardKey(scoreTypeID, domain, getSlotTag(slot))
+}
+
+func genScoreSupplyShardKey(scoreTypeID uint32, domain string, slotTag string) string {
+	text := conf.Conf.ScoreSupplyKeyFormat
+	text = strings.ReplaceAll(text, templateString_ScoreTypeID, strconv.FormatInt(int64(scoreTypeID), 10))
+	text = strings.ReplaceAll(text, templateString_Domain, domain)
+	text = strings.ReplaceAll(text, templateString_SlotTag, slotTag)
+	return text
+}
+
+// 积分供应量
+type ScoreSupply struct {
+	Added    int64 // 增加的积分总值
+	Deducted int64 // 扣除的积分总值
+	Reset    int64 // 重设积分对余额的净影响
+	Expired  int64 // 已清理的过期积分总值
+}
+
+// 每个pipeline最多发送的命令数
+const getSupplyPipelineSize = 1000
+
+// 缓存的供应量分片合并结果
+type scoreSupplyCache struct {
+	expire int64
+	supply ScoreSupply
+}
+
+// key为 积分类型id:域
+var scoreSupplyCaches sync.Map
+
+// 获取积分类型在一个域的供应量. redis集群中会读取并合并所有分片(16384个), 合并结果缓存 ScoreSupplyCacheSec 秒
+func GetScoreSupply(ctx context.Context, scoreTypeID uint32, domain string) (*ScoreSupply, error) {
+	if !useSlotShards(conf.Conf.ScoreSupplyKeyFormat) {
+		return getScoreSupply(ctx, []string{genScoreSupplyShardKey(scoreTypeID, domain, "")})
+	}
+
+	cacheKey := strconv.FormatInt(int64(scoreTypeID), 10) + ":" + domain
+	now := time.Now().Unix()
+	if v, ok := scoreSupplyCaches.Load(cacheKey); ok {
+		c := v.(*scoreSupplyCache)
+		if c.expire > now {
+			ret := c.supply
+			return &ret, nil
+		}
+	}
+
+	keys := make([]string, redisClusterSlots)
+	for i := range keys {
+		keys[i] = genScoreSupplyShardKey(scoreTypeID, domain, getSlotTag(uint16(i)))
+	}
+	ret, err := getScoreSupply(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Conf.ScoreSupplyCacheSec > 0 {
+		scoreSupplyCaches.Store(cacheKey, &scoreSupplyCache{expire: now + int64(conf.Conf.ScoreSupplyCacheSec), supply: *ret})
+	}
+	return ret, nil
+}
+
+// 读取并合并供应量key
+func getScoreSupply(ctx context.Context, keys []string) (*ScoreSupply, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ScoreSupply{}
+	for start := 0; start < len(keys); start += getSupplyPipelineSize {
+		end := start + getSupplyPipelineSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.SliceCmd, 0, end-start)
+		for _, key := range keys[start:end] {
+			cmds = append(cmds, pipe.HMGet(ctx, key, "add", "deduct", "reset", "expire"))
+		}
+		_, err = pipe.Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cmd := range cmds {
+			vs := cmd.Val()
+			if len(vs) != 4 {
+				continue
+			}
+			ret.Added += cast.ToInt64(vs[0])
+			ret.Deducted += cast.ToInt64(vs[1])
+			ret.Reset += cast.ToInt64(vs[2])
+			ret.Expired += cast.ToInt64(vs[3])
+		}
+	}
+	return ret, nil
+}
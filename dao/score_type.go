@@ -11,6 +11,7 @@ import (
 
 	"github.com/zlyuancn/score/client"
 	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/model"
 )
 
 type ScoreTypeRedisModel struct {
@@ -20,6 +21,16 @@ type ScoreTypeRedisModel struct {
 	EndTime                   int64  `json:"end_time"`                      // 失效时间, 0 表示不限制
 	OrderStatusExpireDay      uint16 `json:"order_status_expire_day"`       // 订单状态保留多少天
 	VerifyOrderCreateLessThan uint16 `json:"verify_order_create_less_than"` // 操作时验证订单id创建时间小于多少天
+	FrozenTimeoutSec          uint32 `json:"frozen_timeout_sec"`            // 冻结积分超时秒数, 超时后自动取消冻结, 0表示不超时
+	MinBalance                int64  `json:"min_balance"`                   // 最小余额, 负数表示允许透支
+	MaxBalance                int64  `json:"max_balance"`                   // 最大余额, 0表示不限制
+	LotMode                   bool   `json:"lot_mode"`                      // 是否按批次储存积分
+	LotExpireSec              int64  `json:"lot_expire_sec"`                // 批次模式下增加的积分默认多少秒后过期, 0表示永不过期
+	NoLockOnInsufficient      bool   `json:"no_lock_on_insufficient"`       // 扣除积分余额不足时不锁定订单
+	Leaderboard               bool   `json:"leaderboard"`                   // 是否启用排行榜
+
+	ExchangeRates map[uint32]*model.ExchangeRate `json:"exchange_rates"` // 兑换为其它积分类型的比例, key为目标积分类型id
+	Quotas        []*model.Quota                 `json:"quotas"`         // 周期配额
 }
 
 // 获取所有积分类型
@@ -60,11 +71,21 @@ type ScoreTypeSqlxModel struct {
 	EndTime                   sql.NullTime `db:"end_time"`                      // 失效时间
 	OrderStatusExpireDay      uint16       `db:"order_status_expire_day"`       // 订单状态保留多少天
 	VerifyOrderCreateLessThan uint16       `db:"verify_order_create_less_than"` // 操作时验证订单id创建时间小于多少天
+	FrozenTimeoutSec          uint32       `db:"frozen_timeout_sec"`            // 冻结积分超时秒数, 超时后自动取消冻结, 0表示不超时
+	MinBalance                int64        `db:"min_balance"`                   // 最小余额, 负数表示允许透支
+	MaxBalance                int64        `db:"max_balance"`                   // 最大余额, 0表示不限制
+	LotMode                   bool         `db:"lot_mode"`                      // 是否按批次储存积分
+	LotExpireSec              int64        `db:"lot_expire_sec"`                // 批次模式下增加的积分默认多少秒后过期, 0表示永不过期
+	NoLockOnInsufficient      bool         `db:"no_lock_on_insufficient"`       // 扣除积分余额不足时不锁定订单
+	Leaderboard               bool         `db:"leaderboard"`                   // 是否启用排行榜
+
+	ExchangeRates string `db:"exchange_rates"` // 兑换为其它积分类型的比例, json格式, key为目标积分类型id
+	Quotas        string `db:"quotas"`         // 周期配额, json格式
 }
 
 // 获取所有积分类型
 func GetAllScoreTypeBySqlx(ctx context.Context) ([]*ScoreTypeSqlxModel, error) {
-	const cond = `select id,score_name,start_time,end_time,order_status_expire_day,verify_order_create_less_than from score_type`
+	const cond = `select id,score_name,start_time,end_time,order_status_expire_day,verify_order_create_less_than,frozen_timeout_sec,min_balance,max_balance,lot_mode,lot_expire_sec,no_lock_on_insufficient,leaderboard,exchange_rates,quotas from score_type`
 
 	var ret []*ScoreTypeSqlxModel
 	err := client.GetScoreTypeSqlxClient().Find(ctx, &ret, cond)
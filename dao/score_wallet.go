@@ -0,0 +1,72 @@
+package dao
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/conf"
+)
+
+// 用户钱包为set, member为 <积分类型id>:<域>, 在增加/扣除/重设/转移/冻结积分的lua脚本中积分变更成功时写入
+
+// 用户钱包中的积分类型和域
+type WalletItem struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+}
+
+// 生成用户钱包key
+func genScoreWalletKey(uid string) string {
+	text := conf.Conf.ScoreWalletKeyFormat
+	text = strings.ReplaceAll(text, templateString_Uid, uid)
+	return text
+}
+
+// 生成用户钱包成员
+func genWalletMember(scoreTypeID uint32, domain string) string {
+	return strconv.FormatInt(int64(scoreTypeID), 10) + ":" + domain
+}
+
+// 解析用户钱包成员, 域中可能包含 ':', 所以只按第一个 ':' 分割
+func parseWalletMember(member string) (*WalletItem, bool) {
+	ss := strings.SplitN(member, ":", 2)
+	if len(ss) != 2 {
+		return nil, false
+	}
+	scoreTypeID, err := strconv.ParseUint(ss[0], 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	return &WalletItem{ScoreTypeID: uint32(scoreTypeID), Domain: ss[1]}, true
+}
+
+// 获取用户钱包, 返回用户有积分数据的所有积分类型和域, 按积分类型id和域排序
+func GetWallet(ctx context.Context, uid string) ([]*WalletItem, error) {
+	rdb, err := client.GetScoreRedisClient()
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := rdb.SMembers(ctx, genScoreWalletKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*WalletItem, 0, len(members))
+	for _, m := range members {
+		item, ok := parseWalletMember(m)
+		if !ok {
+			continue
+		}
+		ret = append(ret, item)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].ScoreTypeID != ret[j].ScoreTypeID {
+			return ret[i].ScoreTypeID < ret[j].ScoreTypeID
+		}
+		return ret[i].Domain < ret[j].Domain
+	})
+	return ret, nil
+}
@@ -0,0 +1,225 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zlyuancn/score/model"
+)
+
+// 储存不支持这个操作
+var ErrStoreNotSupported = errors.New("operation not supported by store")
+
+// 储存, 负责积分数据/订单状态/订单副作用状态/订单序列号/流水的读写.
+// 实现必须保证同一个订单id的操作可重入: 订单状态已存在时不再变更积分, 直接返回已有的状态并标记为重入.
+// 批量增加/转账/兑换/多积分类型操作/按优先级扣除/冲正/冻结/批次/钱包/供应量/重建/余额镜像核对等功能目前只有redis实现, 不经过这个接口,
+// 注册了其它储存时这些功能返回 ErrStoreNotSupported
+type Store interface {
+	// 获取积分
+	GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error)
+	// 生成订单序列号
+	GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error)
+	// 增加/扣除积分
+	AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+		opt *AddScoreOption) (*model.OrderData, model.OrderStatus, error)
+	// 重设积分. 重设结果不能大于 maxScore, maxScore 为0表示不限制. expectedOldScore 不为nil时只有当前余额等于这个值才会重设
+	ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, resetScore int64, statusExpireSec int64,
+		maxScore int64, expectedOldScore *int64) (*model.OrderData, model.OrderStatus, error)
+	// 获取订单状态, 订单不存在时返回 ErrOrderNotFound
+	GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.OrderData, model.OrderStatus, error)
+	// 获取订单副作用状态
+	GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int) (bool, error)
+	// 标记订单副作用状态已完成
+	MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int, statusExpireSec int64) error
+	// 写入积分流水, 同一个订单id只会写入一次
+	WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error
+}
+
+// 能提供积分类型的储存. 注册的储存实现了这个接口时从储存加载积分类型, 不再从redis/mysql加载
+type ScoreTypeStore interface {
+	// 获取所有积分类型, key为积分类型id
+	GetAllScoreType(ctx context.Context) (map[uint32]*model.ScoreType, error)
+}
+
+// redis储存积分数据/订单状态/订单序列号, sqlx储存流水
+type redisStore struct{}
+
+var store Store = redisStore{}
+
+// 注册储存, 需要在app启动前注册
+func RegistryStore(s Store) { store = s }
+
+// 获取当前的储存
+func GetStore() Store { return store }
+
+// 检查当前储存是否为redis储存, 只有redis实现的功能在注册了其它储存时返回 ErrStoreNotSupported
+func CheckRedisStore() error {
+	if _, ok := store.(redisStore); !ok {
+		return ErrStoreNotSupported
+	}
+	return nil
+}
+
+// 获取积分
+func GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
+	return store.GetScore(ctx, scoreTypeID, domain, uid)
+}
+
+// 生成订单序列号
+func GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
+	return store.GenOrderSeqNo(ctx, scoreTypeID, domain, uid)
+}
+
+// 增加/扣除积分
+func AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+	opt *AddScoreOption) (*model.OrderData, model.OrderStatus, error) {
+	return store.AddScore(ctx, orderID, scoreTypeID, domain, uid, score, statusExpireSec, opt)
+}
+
+// 重设积分
+func ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, resetScore int64, statusExpireSec int64,
+	maxScore int64, expectedOldScore *int64) (*model.OrderData, model.OrderStatus, error) {
+	return store.ResetScore(ctx, orderID, scoreTypeID, domain, uid, resetScore, statusExpireSec, maxScore, expectedOldScore)
+}
+
+// 获取订单状态
+func GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.OrderData, model.OrderStatus, error) {
+	return store.GetOrderStatus(ctx, orderID, uid)
+}
+
+// 获取订单副作用状态
+func GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int) (bool, error) {
+	return store.GetOrderSideEffectStatus(ctx, orderID, uid, sideEffectName, sideEffectType)
+}
+
+// 标记订单副作用状态已完成, 余额不足时不锁定订单的本次尝试的订单id使用较短的有效期
+func MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int, statusExpireSec int64) error {
+	return store.MarkOrderSideEffectStatusOk(ctx, orderID, uid, sideEffectName, sideEffectType, genOrderStatusExpireSec(orderID, statusExpireSec))
+}
+
+// 写入积分流水
+func WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error {
+	return store.WriteScoreFlow(ctx, uid, v)
+}
+
+// 周期配额, 用于非redis的储存实现
+type storeQuota struct {
+	Key       string // 配额key, 包含周期, 周期变化后为新的key
+	MaxScore  int64  // 周期内最多变更的积分值, 0表示不限制
+	MaxOrders int64  // 周期内最多成功的订单数, 0表示不限制
+	PeriodSec int64  // 周期秒数, 配额数据在一个周期后过期
+}
+
+// 配额已使用的积分值和订单数
+type storeQuotaUsed struct {
+	Score  int64
+	Orders int64
+}
+
+// 生成操作需要检查的配额, 周期与redis实现相同
+func genStoreQuotas(scoreTypeID uint32, domain string, uid string, score int64, quotas []*model.Quota, now time.Time) []*storeQuota {
+	op := model.OpType_Deduct
+	if score > 0 {
+		op = model.OpType_Add
+	}
+	keys, args := genQuotaArgs(scoreTypeID, domain, uid, op, quotas, now)
+	ret := make([]*storeQuota, len(keys))
+	for i, key := range keys {
+		ret[i] = &storeQuota{
+			Key:       key,
+			MaxScore:  args[i*3].(int64),
+			MaxOrders: args[i*3+1].(int64),
+			PeriodSec: args[i*3+2].(int64),
+		}
+	}
+	return ret
+}
+
+// 计算增加/扣除积分的结果, 与 addScoreLua 的逻辑相同(不支持批次模式). used 为每个配额已使用的量, 与 quotas 一一对应.
+// 返回订单数据/订单状态/订单状态需要写入的订单id. 订单状态为成功时调用方需要将余额改为结果积分, 并为每个配额增加 ChangeScore 和1个订单
+func calcAddScore(orderID string, oldScore int64, score int64, opt *AddScoreOption, quotas []*storeQuota, used []storeQuotaUsed) (
+	model.OrderData, model.OrderStatus, string) {
+	changeScore := score
+
+	// 检查当前余额
+	status := model.OrderStatus_Finish
+	if opt.ExpectedOldScore != nil && oldScore != *opt.ExpectedOldScore {
+		status = model.OrderStatus_BalanceChanged
+	}
+
+	// 部分扣除时最多扣除到最小余额
+	if opt.UpTo && changeScore < 0 {
+		available := oldScore - opt.MinScore
+		if available < 0 {
+			available = 0
+		}
+		if -changeScore > available {
+			changeScore = -available
+		}
+	}
+	absScore := changeScore
+	if absScore < 0 {
+		absScore = -absScore
+	}
+
+	// 检查配额
+	for i, q := range quotas {
+		if status != model.OrderStatus_Finish {
+			break
+		}
+		if (q.MaxScore > 0 && used[i].Score+absScore > q.MaxScore) || (q.MaxOrders > 0 && used[i].Orders+1 > q.MaxOrders) {
+			status = model.OrderStatus_QuotaExceeded
+		}
+	}
+
+	// 检查余额限制
+	resultScore := oldScore
+	if status == model.OrderStatus_Finish {
+		resultScore = oldScore + changeScore
+		if changeScore < 0 && resultScore < opt.MinScore {
+			status = model.OrderStatus_InsufficientBalance
+		} else if changeScore > 0 && opt.MaxScore > 0 && resultScore > opt.MaxScore {
+			status = model.OrderStatus_ExceedLimit
+		}
+		if status != model.OrderStatus_Finish {
+			resultScore = oldScore
+		}
+	}
+
+	data := model.OrderData{
+		OpType:      model.OpType_Deduct,
+		OldScore:    oldScore,
+		ChangeScore: absScore,
+		ResultScore: resultScore,
+	}
+	if changeScore > 0 {
+		data.OpType = model.OpType_Add
+	}
+
+	// 余额不足时可能写入到另一个订单状态中, 此时订单不会被锁定
+	statusOrderID := orderID
+	if status == model.OrderStatus_InsufficientBalance && opt.RejectedOrderID != "" {
+		statusOrderID = opt.RejectedOrderID
+	}
+	return data, status, statusOrderID
+}
+
+// 计算重设积分的结果, 与 resetScoreLua 的逻辑相同. 订单状态为成功时调用方需要将余额改为结果积分
+func calcResetScore(oldScore int64, resetScore int64, maxScore int64, expectedOldScore *int64) (model.OrderData, model.OrderStatus) {
+	status := model.OrderStatus_Finish
+	resultScore := resetScore
+	if expectedOldScore != nil && oldScore != *expectedOldScore {
+		status = model.OrderStatus_BalanceChanged
+		resultScore = oldScore
+	} else if maxScore > 0 && resetScore > maxScore {
+		status = model.OrderStatus_ExceedLimit
+		resultScore = oldScore
+	}
+	return model.OrderData{
+		OpType:      model.OpType_Reset,
+		OldScore:    oldScore,
+		ChangeScore: resetScore,
+		ResultScore: resultScore,
+	}, status
+}
@@ -0,0 +1,275 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zlyuancn/score/model"
+)
+
+// 内存储存, 用于业务在没有redis和mysql的环境下运行单元测试. 订单可重入/余额不足/余额上限/周期配额/期望余额/部分扣除的语义与redis实现相同.
+// 不支持批次模式, 不记录用户钱包和积分供应量, 数据在进程退出后丢失
+type MemoryStore struct {
+	mx sync.Mutex
+
+	scoreTypes   map[uint32]*model.ScoreType
+	scores       map[memoryScoreKey]int64
+	orders       map[memoryOrderKey]*memoryOrder
+	sideEffects  map[memorySideEffectKey]time.Time // value为过期时间, 零值表示永不过期
+	quotas       map[string]*memoryQuota
+	seqNos       map[uint32]uint64
+	flows        []*ScoreFlowModel
+	flowOrderIDs map[memoryFlowKey]struct{}
+}
+
+type memoryScoreKey struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+}
+
+type memoryOrderKey struct {
+	Uid     string
+	OrderID string
+}
+
+// 与流水表的唯一索引相同, 同一个分表内订单id唯一
+type memoryFlowKey struct {
+	TableName string
+	OrderID   string
+}
+
+type memorySideEffectKey struct {
+	Uid            string
+	OrderID        string
+	SideEffectName string
+	SideEffectType int
+}
+
+type memoryOrder struct {
+	Data     model.OrderData
+	Status   model.OrderStatus
+	ExpireAt time.Time // 零值表示永不过期
+}
+
+type memoryQuota struct {
+	Score    int64
+	Orders   int64
+	ExpireAt time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+var _ ScoreTypeStore = (*MemoryStore)(nil)
+
+// 创建内存储存
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		scoreTypes:   make(map[uint32]*model.ScoreType),
+		scores:       make(map[memoryScoreKey]int64),
+		orders:       make(map[memoryOrderKey]*memoryOrder),
+		sideEffects:  make(map[memorySideEffectKey]time.Time),
+		quotas:       make(map[string]*memoryQuota),
+		seqNos:       make(map[uint32]uint64),
+		flowOrderIDs: make(map[memoryFlowKey]struct{}),
+	}
+}
+
+// 设置积分类型, 积分类型在app启动时和之后每次重新加载时生效
+func (m *MemoryStore) SetScoreType(st *model.ScoreType) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.scoreTypes[st.ID] = st
+}
+
+func (m *MemoryStore) GetAllScoreType(ctx context.Context) (map[uint32]*model.ScoreType, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	ret := make(map[uint32]*model.ScoreType, len(m.scoreTypes))
+	for id, st := range m.scoreTypes {
+		ret[id] = st
+	}
+	return ret, nil
+}
+
+// 获取用户的所有流水, 按写入顺序排序
+func (m *MemoryStore) ScoreFlows(uid string) []*ScoreFlowModel {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	ret := make([]*ScoreFlowModel, 0)
+	for _, f := range m.flows {
+		if f.Uid == uid {
+			v := *f
+			ret = append(ret, &v)
+		}
+	}
+	return ret
+}
+
+func (m *MemoryStore) GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.scores[memoryScoreKey{scoreTypeID, domain, uid}], nil
+}
+
+func (m *MemoryStore) GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
+	m.mx.Lock()
+	m.seqNos[scoreTypeID]++
+	no := m.seqNos[scoreTypeID]
+	m.mx.Unlock()
+	return formatOrderSeqNo(time.Now().Unix(), 0, no, scoreTypeID, domain, uid), nil
+}
+
+func (m *MemoryStore) AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+	opt *AddScoreOption) (*model.OrderData, model.OrderStatus, error) {
+	if opt.LotMode {
+		return nil, 0, ErrStoreNotSupported
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	now := time.Now()
+	if data, status, ok := m.getOrder(uid, orderID, now); ok {
+		return data, status, nil
+	}
+
+	scoreKey := memoryScoreKey{scoreTypeID, domain, uid}
+	quotas := genStoreQuotas(scoreTypeID, domain, uid, score, opt.Quotas, now)
+	used := make([]storeQuotaUsed, len(quotas))
+	for i, q := range quotas {
+		u := m.getQuota(q.Key, now)
+		used[i] = storeQuotaUsed{Score: u.Score, Orders: u.Orders}
+	}
+
+	data, status, statusOrderID := calcAddScore(orderID, m.scores[scoreKey], score, opt, quotas, used)
+
+	// 变更积分, 占用配额
+	if status == model.OrderStatus_Finish {
+		m.scores[scoreKey] = data.ResultScore
+		for _, q := range quotas {
+			u := m.getQuota(q.Key, now)
+			u.Score += data.ChangeScore
+			u.Orders++
+			if u.ExpireAt.IsZero() {
+				u.ExpireAt = now.Add(time.Duration(q.PeriodSec) * time.Second)
+			}
+		}
+	}
+	m.setOrder(uid, statusOrderID, data, status, genOrderStatusExpireSec(statusOrderID, statusExpireSec), now)
+	return &data, status, nil
+}
+
+func (m *MemoryStore) ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, resetScore int64, statusExpireSec int64,
+	maxScore int64, expectedOldScore *int64) (*model.OrderData, model.OrderStatus, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	now := time.Now()
+	if data, status, ok := m.getOrder(uid, orderID, now); ok {
+		return data, status, nil
+	}
+
+	scoreKey := memoryScoreKey{scoreTypeID, domain, uid}
+	data, status := calcResetScore(m.scores[scoreKey], resetScore, maxScore, expectedOldScore)
+	if status == model.OrderStatus_Finish {
+		m.scores[scoreKey] = data.ResultScore
+	}
+	m.setOrder(uid, orderID, data, status, statusExpireSec, now)
+	return &data, status, nil
+}
+
+func (m *MemoryStore) GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.OrderData, model.OrderStatus, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	data, status, ok := m.getOrder(uid, orderID, time.Now())
+	if !ok {
+		return nil, 0, ErrOrderNotFound
+	}
+	data.IsReentry = false
+	return data, status, nil
+}
+
+func (m *MemoryStore) GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int) (bool, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	key := memorySideEffectKey{uid, orderID, sideEffectName, sideEffectType}
+	expireAt, ok := m.sideEffects[key]
+	if !ok {
+		return false, nil
+	}
+	if !expireAt.IsZero() && !time.Now().Before(expireAt) {
+		delete(m.sideEffects, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int, statusExpireSec int64) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	var expireAt time.Time
+	if statusExpireSec > 0 {
+		expireAt = time.Now().Add(time.Duration(statusExpireSec) * time.Second)
+	}
+	m.sideEffects[memorySideEffectKey{uid, orderID, sideEffectName, sideEffectType}] = expireAt
+	return nil
+}
+
+func (m *MemoryStore) WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	// 与 insert ignore 相同, 分表内订单id已存在时忽略
+	flowKey := memoryFlowKey{genScoreFlowTableName(uid), v.OrderID}
+	if _, ok := m.flowOrderIDs[flowKey]; ok {
+		return nil
+	}
+	flow := *v
+	flow.ID = uint64(len(m.flows) + 1)
+	flow.Ctime = time.Now()
+	if flow.OrderTime.IsZero() {
+		flow.OrderTime = flow.Ctime
+	}
+	m.flows = append(m.flows, &flow)
+	m.flowOrderIDs[flowKey] = struct{}{}
+	return nil
+}
+
+// 获取未过期的订单状态, 返回的订单数据标记为重入
+func (m *MemoryStore) getOrder(uid string, orderID string, now time.Time) (*model.OrderData, model.OrderStatus, bool) {
+	key := memoryOrderKey{uid, orderID}
+	o, ok := m.orders[key]
+	if !ok {
+		return nil, 0, false
+	}
+	if !o.ExpireAt.IsZero() && !now.Before(o.ExpireAt) {
+		delete(m.orders, key)
+		return nil, 0, false
+	}
+	data := o.Data
+	data.IsReentry = true
+	return &data, o.Status, true
+}
+
+// 写入订单状态, statusExpireSec 小于1表示永不过期
+func (m *MemoryStore) setOrder(uid string, orderID string, data model.OrderData, status model.OrderStatus, statusExpireSec int64, now time.Time) {
+	o := &memoryOrder{Data: data, Status: status}
+	if statusExpireSec > 0 {
+		o.ExpireAt = now.Add(time.Duration(statusExpireSec) * time.Second)
+	}
+	m.orders[memoryOrderKey{uid, orderID}] = o
+}
+
+// 获取未过期的配额使用量, 不存在时创建
+func (m *MemoryStore) getQuota(key string, now time.Time) *memoryQuota {
+	q, ok := m.quotas[key]
+	if !ok || (!q.ExpireAt.IsZero() && !now.Before(q.ExpireAt)) {
+		q = &memoryQuota{}
+		m.quotas[key] = q
+	}
+	return q
+}
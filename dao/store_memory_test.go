@@ -0,0 +1,334 @@
+package dao
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zlyuancn/score/model"
+)
+
+const (
+	testScoreTypeID uint32 = 1
+	testDomain             = "test"
+)
+
+// 通过内存储存增加/扣除积分, 非重入时检查结果与 calcAddScore 相同
+func memoryAddScore(t *testing.T, m *MemoryStore, orderID string, uid string, score int64, opt *AddScoreOption) (*model.OrderData, model.OrderStatus) {
+	t.Helper()
+	ctx := context.Background()
+
+	oldScore, err := m.GetScore(ctx, testScoreTypeID, testDomain, uid)
+	if err != nil {
+		t.Fatalf("GetScore err: %v", err)
+	}
+	now := time.Now()
+	quotas := genStoreQuotas(testScoreTypeID, testDomain, uid, score, opt.Quotas, now)
+	used := make([]storeQuotaUsed, len(quotas))
+	m.mx.Lock()
+	for i, q := range quotas {
+		u := m.getQuota(q.Key, now)
+		used[i] = storeQuotaUsed{Score: u.Score, Orders: u.Orders}
+	}
+	_, reentry := m.orders[memoryOrderKey{uid, orderID}]
+	m.mx.Unlock()
+	wantData, wantStatus, _ := calcAddScore(orderID, oldScore, score, opt, quotas, used)
+
+	data, status, err := m.AddScore(ctx, orderID, testScoreTypeID, testDomain, uid, score, 0, opt)
+	if err != nil {
+		t.Fatalf("AddScore err: %v", err)
+	}
+	if data.IsReentry != reentry {
+		t.Fatalf("AddScore %s IsReentry=%v, want %v", orderID, data.IsReentry, reentry)
+	}
+	if !reentry && (*data != wantData || status != wantStatus) {
+		t.Fatalf("AddScore %s = %+v %d, calcAddScore = %+v %d", orderID, *data, status, wantData, wantStatus)
+	}
+	return data, status
+}
+
+// 通过内存储存重设积分, 非重入时检查结果与 calcResetScore 相同
+func memoryResetScore(t *testing.T, m *MemoryStore, orderID string, uid string, resetScore int64, maxScore int64, expectedOldScore *int64) (
+	*model.OrderData, model.OrderStatus) {
+	t.Helper()
+	ctx := context.Background()
+
+	oldScore, err := m.GetScore(ctx, testScoreTypeID, testDomain, uid)
+	if err != nil {
+		t.Fatalf("GetScore err: %v", err)
+	}
+	m.mx.Lock()
+	_, reentry := m.orders[memoryOrderKey{uid, orderID}]
+	m.mx.Unlock()
+	wantData, wantStatus := calcResetScore(oldScore, resetScore, maxScore, expectedOldScore)
+
+	data, status, err := m.ResetScore(ctx, orderID, testScoreTypeID, testDomain, uid, resetScore, 0, maxScore, expectedOldScore)
+	if err != nil {
+		t.Fatalf("ResetScore err: %v", err)
+	}
+	if data.IsReentry != reentry {
+		t.Fatalf("ResetScore %s IsReentry=%v, want %v", orderID, data.IsReentry, reentry)
+	}
+	if !reentry && (*data != wantData || status != wantStatus) {
+		t.Fatalf("ResetScore %s = %+v %d, calcResetScore = %+v %d", orderID, *data, status, wantData, wantStatus)
+	}
+	return data, status
+}
+
+func assertMemoryScore(t *testing.T, m *MemoryStore, uid string, want int64) {
+	t.Helper()
+	score, err := m.GetScore(context.Background(), testScoreTypeID, testDomain, uid)
+	if err != nil {
+		t.Fatalf("GetScore err: %v", err)
+	}
+	if score != want {
+		t.Fatalf("score=%d, want %d", score, want)
+	}
+}
+
+func assertOrderStatus(t *testing.T, status model.OrderStatus, want model.OrderStatus) {
+	t.Helper()
+	if status != want {
+		t.Fatalf("status=%d, want %d", status, want)
+	}
+}
+
+func TestMemoryStoreReentry(t *testing.T) {
+	m := NewMemoryStore()
+	opt := &AddScoreOption{}
+
+	_, status := memoryAddScore(t, m, "o1", "u1", 100, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+
+	// 相同的订单id即使参数不同也返回已有的结果, 不再变更积分
+	data, status := memoryAddScore(t, m, "o1", "u1", 50, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if !data.IsReentry || data.ChangeScore != 100 || data.ResultScore != 100 {
+		t.Fatalf("reentry data=%+v", *data)
+	}
+	assertMemoryScore(t, m, "u1", 100)
+
+	_, status = memoryResetScore(t, m, "o2", "u1", 10, 0, nil)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	data, _ = memoryResetScore(t, m, "o2", "u1", 20, 0, nil)
+	if !data.IsReentry || data.ResultScore != 10 {
+		t.Fatalf("reset reentry data=%+v", *data)
+	}
+	assertMemoryScore(t, m, "u1", 10)
+
+	// 查询订单状态不标记为重入
+	data, status, err := m.GetOrderStatus(context.Background(), "o1", "u1")
+	if err != nil {
+		t.Fatalf("GetOrderStatus err: %v", err)
+	}
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if data.IsReentry {
+		t.Fatalf("GetOrderStatus IsReentry=true")
+	}
+	_, _, err = m.GetOrderStatus(context.Background(), "o3", "u1")
+	if err != ErrOrderNotFound {
+		t.Fatalf("GetOrderStatus err=%v, want %v", err, ErrOrderNotFound)
+	}
+}
+
+func TestMemoryStoreInsufficientBalance(t *testing.T) {
+	m := NewMemoryStore()
+	memoryAddScore(t, m, "o1", "u1", 10, &AddScoreOption{})
+
+	data, status := memoryAddScore(t, m, "o2", "u1", -50, &AddScoreOption{})
+	assertOrderStatus(t, status, model.OrderStatus_InsufficientBalance)
+	if data.ResultScore != 10 {
+		t.Fatalf("data=%+v", *data)
+	}
+
+	// 余额不足时订单被锁定, 补足余额后重试仍然是余额不足
+	memoryAddScore(t, m, "o3", "u1", 100, &AddScoreOption{})
+	_, status = memoryAddScore(t, m, "o2", "u1", -50, &AddScoreOption{})
+	assertOrderStatus(t, status, model.OrderStatus_InsufficientBalance)
+	assertMemoryScore(t, m, "u1", 110)
+
+	// 允许透支到最小余额
+	_, status = memoryAddScore(t, m, "o4", "u1", -150, &AddScoreOption{MinScore: -50})
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	assertMemoryScore(t, m, "u1", -40)
+}
+
+func TestMemoryStoreInsufficientBalanceNoLock(t *testing.T) {
+	m := NewMemoryStore()
+	opt := &AddScoreOption{RejectedOrderID: GenRejectedOrderID("o1")}
+
+	_, status := memoryAddScore(t, m, "o1", "u1", -50, opt)
+	assertOrderStatus(t, status, model.OrderStatus_InsufficientBalance)
+
+	// 订单状态写入拒绝订单id, 原订单没有被锁定
+	_, status, err := m.GetOrderStatus(context.Background(), opt.RejectedOrderID, "u1")
+	if err != nil {
+		t.Fatalf("GetOrderStatus err: %v", err)
+	}
+	assertOrderStatus(t, status, model.OrderStatus_InsufficientBalance)
+	_, _, err = m.GetOrderStatus(context.Background(), "o1", "u1")
+	if err != ErrOrderNotFound {
+		t.Fatalf("GetOrderStatus err=%v, want %v", err, ErrOrderNotFound)
+	}
+
+	memoryAddScore(t, m, "o2", "u1", 100, &AddScoreOption{})
+	data, status := memoryAddScore(t, m, "o1", "u1", -50, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if data.IsReentry || data.ResultScore != 50 {
+		t.Fatalf("data=%+v", *data)
+	}
+}
+
+func TestMemoryStoreExceedLimit(t *testing.T) {
+	m := NewMemoryStore()
+	opt := &AddScoreOption{MaxScore: 100}
+
+	_, status := memoryAddScore(t, m, "o1", "u1", 60, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	data, status := memoryAddScore(t, m, "o2", "u1", 60, opt)
+	assertOrderStatus(t, status, model.OrderStatus_ExceedLimit)
+	if data.ResultScore != 60 {
+		t.Fatalf("data=%+v", *data)
+	}
+	_, status = memoryAddScore(t, m, "o3", "u1", 40, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	assertMemoryScore(t, m, "u1", 100)
+
+	// 扣除不受余额上限限制
+	_, status = memoryAddScore(t, m, "o4", "u1", -10, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+
+	_, status = memoryResetScore(t, m, "o5", "u1", 200, 100, nil)
+	assertOrderStatus(t, status, model.OrderStatus_ExceedLimit)
+	assertMemoryScore(t, m, "u1", 90)
+}
+
+func TestMemoryStoreQuota(t *testing.T) {
+	m := NewMemoryStore()
+	opt := &AddScoreOption{Quotas: []*model.Quota{
+		{Op: model.OpType_Add, PeriodSec: 86400, MaxScore: 100, MaxOrders: 3},
+		{Op: model.OpType_Deduct, PeriodSec: 86400, MaxOrders: 1},
+	}}
+
+	_, status := memoryAddScore(t, m, "o1", "u1", 60, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	_, status = memoryAddScore(t, m, "o2", "u1", 50, opt)
+	assertOrderStatus(t, status, model.OrderStatus_QuotaExceeded)
+	assertMemoryScore(t, m, "u1", 60)
+
+	// 失败的订单不占用配额
+	_, status = memoryAddScore(t, m, "o3", "u1", 30, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	_, status = memoryAddScore(t, m, "o4", "u1", 5, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	_, status = memoryAddScore(t, m, "o5", "u1", 1, opt)
+	assertOrderStatus(t, status, model.OrderStatus_QuotaExceeded)
+
+	// 扣除只检查扣除的配额
+	_, status = memoryAddScore(t, m, "o6", "u1", -10, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	_, status = memoryAddScore(t, m, "o7", "u1", -10, opt)
+	assertOrderStatus(t, status, model.OrderStatus_QuotaExceeded)
+	assertMemoryScore(t, m, "u1", 85)
+
+	// 配额按用户区分
+	_, status = memoryAddScore(t, m, "o1", "u2", 100, opt)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+}
+
+func TestMemoryStoreCAS(t *testing.T) {
+	m := NewMemoryStore()
+	memoryAddScore(t, m, "o1", "u1", 100, &AddScoreOption{})
+
+	expected := int64(50)
+	data, status := memoryAddScore(t, m, "o2", "u1", -10, &AddScoreOption{ExpectedOldScore: &expected})
+	assertOrderStatus(t, status, model.OrderStatus_BalanceChanged)
+	if data.ResultScore != 100 {
+		t.Fatalf("data=%+v", *data)
+	}
+	expected = 100
+	_, status = memoryAddScore(t, m, "o3", "u1", -10, &AddScoreOption{ExpectedOldScore: &expected})
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	assertMemoryScore(t, m, "u1", 90)
+
+	_, status = memoryResetScore(t, m, "o4", "u1", 0, 0, &expected)
+	assertOrderStatus(t, status, model.OrderStatus_BalanceChanged)
+	expected = 90
+	_, status = memoryResetScore(t, m, "o5", "u1", 0, 0, &expected)
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	assertMemoryScore(t, m, "u1", 0)
+}
+
+func TestMemoryStoreUpTo(t *testing.T) {
+	m := NewMemoryStore()
+	memoryAddScore(t, m, "o1", "u1", 30, &AddScoreOption{})
+
+	data, status := memoryAddScore(t, m, "o2", "u1", -50, &AddScoreOption{UpTo: true, MinScore: 10})
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if data.ChangeScore != 20 || data.ResultScore != 10 {
+		t.Fatalf("data=%+v", *data)
+	}
+	data, status = memoryAddScore(t, m, "o3", "u1", -50, &AddScoreOption{UpTo: true})
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if data.ChangeScore != 10 || data.ResultScore != 0 {
+		t.Fatalf("data=%+v", *data)
+	}
+
+	// 没有可用的积分时扣除0
+	data, status = memoryAddScore(t, m, "o4", "u1", -50, &AddScoreOption{UpTo: true})
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if data.ChangeScore != 0 || data.ResultScore != 0 {
+		t.Fatalf("data=%+v", *data)
+	}
+}
+
+func TestMemoryStoreLotModeNotSupported(t *testing.T) {
+	m := NewMemoryStore()
+	_, _, err := m.AddScore(context.Background(), "o1", testScoreTypeID, testDomain, "u1", 10, 0, &AddScoreOption{LotMode: true})
+	if err != ErrStoreNotSupported {
+		t.Fatalf("err=%v, want %v", err, ErrStoreNotSupported)
+	}
+}
+
+func TestMemoryStoreWriteScoreFlowDedup(t *testing.T) {
+	// 找到流水在不同分表和同一个分表的用户
+	uid := "u0"
+	var otherShardUid, sameShardUid string
+	for i := 1; otherShardUid == "" || sameShardUid == ""; i++ {
+		u := "u" + strconv.Itoa(i)
+		if genScoreFlowTableName(u) == genScoreFlowTableName(uid) {
+			if sameShardUid == "" {
+				sameShardUid = u
+			}
+		} else if otherShardUid == "" {
+			otherShardUid = u
+		}
+	}
+
+	m := NewMemoryStore()
+	ctx := context.Background()
+	write := func(uid string, orderID string) {
+		t.Helper()
+		err := m.WriteScoreFlow(ctx, uid, &ScoreFlowModel{OrderID: orderID, ScoreTypeID: testScoreTypeID, Domain: testDomain, Uid: uid})
+		if err != nil {
+			t.Fatalf("WriteScoreFlow err: %v", err)
+		}
+	}
+	write(uid, "o1")
+	write(uid, "o1")
+	write(otherShardUid, "o1")
+	write(sameShardUid, "o1")
+	write(uid, "o2")
+
+	if n := len(m.ScoreFlows(uid)); n != 2 {
+		t.Fatalf("uid flows=%d, want 2", n)
+	}
+	// 不同分表的相同订单id各自写入, 同一个分表与唯一索引相同只写入一次
+	if n := len(m.ScoreFlows(otherShardUid)); n != 1 {
+		t.Fatalf("other shard flows=%d, want 1", n)
+	}
+	if n := len(m.ScoreFlows(sameShardUid)); n != 0 {
+		t.Fatalf("same shard flows=%d, want 0", n)
+	}
+}
@@ -0,0 +1,516 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/didi/gendry/builder"
+	"github.com/zly-app/component/sqlx"
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/model"
+)
+
+// mysql储存的表
+const (
+	ScoreBalanceTableName         = "score_balance"           // 积分余额
+	ScoreOrderTableName           = "score_order"             // 订单状态
+	ScoreOrderSideEffectTableName = "score_order_side_effect" // 订单副作用状态
+	ScoreQuotaTableName           = "score_quota"             // 周期配额
+	ScoreSeqNoTableName           = "score_seq_no"            // 订单序列号
+)
+
+// mysql储存, 积分余额/订单状态/订单副作用状态/周期配额/订单序列号储存在mysql表中, 流水与redis储存相同写入流水分表.
+// 每个订单在一个事务中完成: 先通过更新余额行锁定余额行, 同一个用户/积分类型/域的操作串行执行, 再检查订单状态, 变更余额并写入订单状态.
+// 订单可重入/余额不足/余额上限/周期配额/期望余额/部分扣除/余额不足不锁定订单的语义与redis实现相同. 不支持批次模式.
+// 只使用通用的sql语句, 不依赖 for update/insert ignore/on duplicate key update 等mysql语法, 也可以使用sqlite等数据库
+type MysqlStore struct{}
+
+var _ Store = (*MysqlStore)(nil)
+
+// 创建mysql储存, 使用配置 ScoreStoreSqlxName 指定的sqlx组件
+func NewMysqlStore() *MysqlStore {
+	return &MysqlStore{}
+}
+
+type scoreOrderModel struct {
+	OpType      uint8 `db:"o_type"`       // 操作类型
+	OpStatus    uint8 `db:"o_status"`     // 操作状态
+	OldScore    int64 `db:"old_score"`    // 原始积分
+	ChangeScore int64 `db:"change_score"` // 变更积分
+	ResultScore int64 `db:"result_score"` // 结果积分
+	ExpireTime  int64 `db:"expire_time"`  // 过期时间, 秒级时间戳, 0表示永不过期
+}
+
+// 需要锁定的行不存在, 需要在事务外创建后重试
+var errStoreRowNotFound = errors.New("store row not found")
+
+// 可以执行语句和查询的sqlx客户端或事务
+type sqlxExecer interface {
+	Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	FindOne(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+type scoreQuotaModel struct {
+	UsedScore  int64 `db:"used_score"`  // 周期内已变更的积分值
+	UsedOrders int64 `db:"used_orders"` // 周期内已成功的订单数
+	ExpireTime int64 `db:"expire_time"` // 过期时间, 秒级时间戳
+}
+
+// 是否已过期
+func isExpired(expireTime int64, now int64) bool {
+	return expireTime > 0 && expireTime <= now
+}
+
+// 生成过期时间, statusExpireSec 小于1表示永不过期
+func genExpireTime(statusExpireSec int64, now int64) int64 {
+	if statusExpireSec < 1 {
+		return 0
+	}
+	return now + statusExpireSec
+}
+
+func (*MysqlStore) GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
+	const cond = `select score from ` + ScoreBalanceTableName + ` where score_type_id=? and domain=? and uid=?`
+	var score int64
+	err := client.GetScoreStoreSqlxClient().FindOne(ctx, &score, cond, scoreTypeID, domain, uid)
+	if err == sqlx.ErrNoRows {
+		return 0, nil
+	}
+	return score, err
+}
+
+func (s *MysqlStore) GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
+	// 在事务中自增并取回序列号, 序列号行不存在时创建后重试
+	const updateCond = `update ` + ScoreSeqNoTableName + ` set seq_no=seq_no+1 where score_type_id=? and shard=?`
+	const cond = `select seq_no from ` + ScoreSeqNoTableName + ` where score_type_id=? and shard=?`
+	const insertCond = `insert into ` + ScoreSeqNoTableName + ` (score_type_id, shard, seq_no) values (?, ?, 0)`
+	const existsCond = `select count(1) from ` + ScoreSeqNoTableName + ` where score_type_id=? and shard=?`
+	shard := rand.Int31n(conf.Conf.GenOrderSeqNoKeyShardNum)
+	var no uint64
+	err := s.transaction(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		result, err := tx.Exec(ctx, updateCond, scoreTypeID, shard)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errStoreRowNotFound
+		}
+		return tx.FindOne(ctx, &no, cond, scoreTypeID, shard)
+	}, func(ctx context.Context) error {
+		return insertOrExists(ctx, client.GetScoreStoreSqlxClient(), insertCond, []interface{}{scoreTypeID, shard}, existsCond, scoreTypeID, shard)
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatOrderSeqNo(time.Now().Unix(), shard, no, scoreTypeID, domain, uid), nil
+}
+
+func (s *MysqlStore) AddScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, score int64, statusExpireSec int64,
+	opt *AddScoreOption) (*model.OrderData, model.OrderStatus, error) {
+	if opt.LotMode {
+		return nil, 0, ErrStoreNotSupported
+	}
+
+	var data model.OrderData
+	var status model.OrderStatus
+	err := s.balanceTransaction(ctx, scoreTypeID, domain, uid, func(ctx context.Context, tx sqlx.Txx, oldScore int64) error {
+		now := time.Now()
+
+		// 订单状态已存在则直接返回
+		order, err := s.getOrder(ctx, tx, uid, orderID, now.Unix())
+		if err != nil {
+			return err
+		}
+		if order != nil {
+			data, status = s.parseOrder(order)
+			return nil
+		}
+
+		quotas := genStoreQuotas(scoreTypeID, domain, uid, score, opt.Quotas, now)
+		quotaRows := make([]*scoreQuotaModel, len(quotas))
+		used := make([]storeQuotaUsed, len(quotas))
+		for i, q := range quotas {
+			quotaRows[i], err = s.getQuota(ctx, tx, q.Key)
+			if err != nil {
+				return err
+			}
+			used[i] = quotaUsed(quotaRows[i], now.Unix())
+		}
+
+		var statusOrderID string
+		data, status, statusOrderID = calcAddScore(orderID, oldScore, score, opt, quotas, used)
+
+		// 变更积分, 占用配额
+		if status == model.OrderStatus_Finish {
+			err = s.updateBalance(ctx, tx, scoreTypeID, domain, uid, data.ResultScore)
+			if err != nil {
+				return err
+			}
+			for i, q := range quotas {
+				err = s.saveQuota(ctx, tx, q, quotaRows[i], data.ChangeScore, now.Unix())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return s.saveOrder(ctx, tx, uid, statusOrderID, &data, status, genExpireTime(genOrderStatusExpireSec(statusOrderID, statusExpireSec), now.Unix()))
+	})
+	if err != nil {
+		log.Error(ctx, "MysqlStore.AddScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, 0, err
+	}
+	return &data, status, nil
+}
+
+func (s *MysqlStore) ResetScore(ctx context.Context, orderID string, scoreTypeID uint32, domain string, uid string, resetScore int64, statusExpireSec int64,
+	maxScore int64, expectedOldScore *int64) (*model.OrderData, model.OrderStatus, error) {
+	var data model.OrderData
+	var status model.OrderStatus
+	err := s.balanceTransaction(ctx, scoreTypeID, domain, uid, func(ctx context.Context, tx sqlx.Txx, oldScore int64) error {
+		now := time.Now().Unix()
+
+		// 订单状态已存在则直接返回
+		order, err := s.getOrder(ctx, tx, uid, orderID, now)
+		if err != nil {
+			return err
+		}
+		if order != nil {
+			data, status = s.parseOrder(order)
+			return nil
+		}
+
+		data, status = calcResetScore(oldScore, resetScore, maxScore, expectedOldScore)
+		if status == model.OrderStatus_Finish {
+			err = s.updateBalance(ctx, tx, scoreTypeID, domain, uid, data.ResultScore)
+			if err != nil {
+				return err
+			}
+		}
+		return s.saveOrder(ctx, tx, uid, orderID, &data, status, genExpireTime(statusExpireSec, now))
+	})
+	if err != nil {
+		log.Error(ctx, "MysqlStore.ResetScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("resetScore", resetScore),
+			zap.Error(err),
+		)
+		return nil, 0, err
+	}
+	return &data, status, nil
+}
+
+func (s *MysqlStore) GetOrderStatus(ctx context.Context, orderID string, uid string) (*model.OrderData, model.OrderStatus, error) {
+	const cond = `select o_type,o_status,old_score,change_score,result_score,expire_time from ` + ScoreOrderTableName + ` where uid=? and oid=?`
+	order := scoreOrderModel{}
+	err := client.GetScoreStoreSqlxClient().FindOne(ctx, &order, cond, uid, orderID)
+	if err == sqlx.ErrNoRows {
+		return nil, 0, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if isExpired(order.ExpireTime, time.Now().Unix()) {
+		return nil, 0, ErrOrderNotFound
+	}
+	data, status := s.parseOrder(&order)
+	data.IsReentry = false
+	return &data, status, nil
+}
+
+func (*MysqlStore) GetOrderSideEffectStatus(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int) (bool, error) {
+	const cond = `select expire_time from ` + ScoreOrderSideEffectTableName + ` where uid=? and oid=? and side_effect_type=? and side_effect=?`
+	var expireTime int64
+	err := client.GetScoreStoreSqlxClient().FindOne(ctx, &expireTime, cond, uid, orderID, sideEffectType, sideEffectName)
+	if err == sqlx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !isExpired(expireTime, time.Now().Unix()), nil
+}
+
+func (*MysqlStore) MarkOrderSideEffectStatusOk(ctx context.Context, orderID string, uid string, sideEffectName string, sideEffectType int, statusExpireSec int64) error {
+	const where = ` where uid=? and oid=? and side_effect_type=? and side_effect=?`
+	const updateCond = `update ` + ScoreOrderSideEffectTableName + ` set expire_time=?` + where
+	const insertCond = `insert into ` + ScoreOrderSideEffectTableName + ` (uid, oid, side_effect_type, side_effect, expire_time) values (?, ?, ?, ?, ?)`
+	const existsCond = `select count(1) from ` + ScoreOrderSideEffectTableName + where
+	expireTime := genExpireTime(statusExpireSec, time.Now().Unix())
+	db := client.GetScoreStoreSqlxClient()
+
+	// 副作用状态已存在时只更新过期时间. mysql在值没有变化时影响行数为0, 此时插入会因为唯一索引冲突失败, 由 insertOrExists 忽略
+	result, err := db.Exec(ctx, updateCond, expireTime, uid, orderID, sideEffectType, sideEffectName)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	return insertOrExists(ctx, db, insertCond, []interface{}{uid, orderID, sideEffectType, sideEffectName, expireTime},
+		existsCond, uid, orderID, sideEffectType, sideEffectName)
+}
+
+func (*MysqlStore) WriteScoreFlow(ctx context.Context, uid string, v *ScoreFlowModel) error {
+	if v == nil {
+		return errors.New("MysqlStore.WriteScoreFlow v is empty")
+	}
+
+	// 与 insert ignore 相同, 分表内订单id已存在时忽略
+	tabName := genScoreFlowTableName(uid)
+	cond, vals, err := builder.BuildInsert(tabName, genScoreFlowData(v))
+	if err != nil {
+		return err
+	}
+	existsCond := `select count(1) from ` + tabName + ` where oid=?`
+	err = insertOrExists(ctx, client.GetScoreFlowSqlxClient(), cond, vals, existsCond, v.OrderID)
+	if err != nil {
+		log.Error(ctx, "MysqlStore.WriteScoreFlow err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+	}
+	return err
+}
+
+// 每次清理过期行的数量
+const purgeExpiredBatchSize = 1000
+
+// 清理已过期的订单状态/订单副作用状态/周期配额. 已过期的行在读取时视为不存在, 这里只是释放空间. 返回删除的行数
+func (*MysqlStore) PurgeExpired(ctx context.Context, now int64) (int64, error) {
+	var total int64
+	for _, tabName := range []string{ScoreOrderTableName, ScoreOrderSideEffectTableName, ScoreQuotaTableName} {
+		n, err := purgeExpiredTable(ctx, tabName, now)
+		total += n
+		if err != nil {
+			log.Error(ctx, "MysqlStore.PurgeExpired err", zap.String("tabName", tabName), zap.Error(err))
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// 分批删除一个表中已过期的行. 先查询id再按id删除, 不依赖 delete ... limit 语法. 删除时再次检查过期时间, 避免删除查询后被更新的行
+func purgeExpiredTable(ctx context.Context, tabName string, now int64) (int64, error) {
+	selectCond := `select id from ` + tabName + ` where expire_time>0 and expire_time<=? order by id limit ` + strconv.Itoa(purgeExpiredBatchSize)
+	db := client.GetScoreStoreSqlxClient()
+	var total int64
+	for {
+		var ids []int64
+		err := db.Find(ctx, &ids, selectCond, now)
+		if err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		cond := `delete from ` + tabName + ` where id in (?` + strings.Repeat(`,?`, len(ids)-1) + `) and expire_time>0 and expire_time<=?`
+		vals := make([]interface{}, 0, len(ids)+1)
+		for _, id := range ids {
+			vals = append(vals, id)
+		}
+		vals = append(vals, now)
+		result, err := db.Exec(ctx, cond, vals...)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+		if len(ids) < purgeExpiredBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// 执行事务, fn 返回 errStoreRowNotFound 时通过 create 在事务外创建需要锁定的行后重试一次
+func (*MysqlStore) transaction(ctx context.Context, fn sqlx.TxxFunc, create func(ctx context.Context) error) error {
+	db := client.GetScoreStoreSqlxClient()
+	err := db.TransactionX(ctx, fn)
+	if !errors.Is(err, errStoreRowNotFound) {
+		return err
+	}
+	err = create(ctx)
+	if err != nil {
+		return err
+	}
+	return db.TransactionX(ctx, fn)
+}
+
+// 在锁定余额行的事务中执行 fn, oldScore 为当前余额. 余额行不存在时先创建
+func (s *MysqlStore) balanceTransaction(ctx context.Context, scoreTypeID uint32, domain string, uid string,
+	fn func(ctx context.Context, tx sqlx.Txx, oldScore int64) error) error {
+	const insertCond = `insert into ` + ScoreBalanceTableName + ` (score_type_id, domain, uid, score) values (?, ?, ?, 0)`
+	const existsCond = `select count(1) from ` + ScoreBalanceTableName + ` where score_type_id=? and domain=? and uid=?`
+	return s.transaction(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		oldScore, err := s.lockBalance(ctx, tx, scoreTypeID, domain, uid)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, tx, oldScore)
+	}, func(ctx context.Context) error {
+		return insertOrExists(ctx, client.GetScoreStoreSqlxClient(), insertCond, []interface{}{scoreTypeID, domain, uid},
+			existsCond, scoreTypeID, domain, uid)
+	})
+}
+
+// 锁定余额行并返回余额, 余额行不存在时返回 errStoreRowNotFound.
+// 通过更新余额行获取行锁, 更新不会修改数据, 所以不能根据影响行数判断余额行是否存在
+func (*MysqlStore) lockBalance(ctx context.Context, tx sqlx.Txx, scoreTypeID uint32, domain string, uid string) (int64, error) {
+	const lockCond = `update ` + ScoreBalanceTableName + ` set score=score where score_type_id=? and domain=? and uid=?`
+	const cond = `select score from ` + ScoreBalanceTableName + ` where score_type_id=? and domain=? and uid=?`
+	_, err := tx.Exec(ctx, lockCond, scoreTypeID, domain, uid)
+	if err != nil {
+		return 0, err
+	}
+	var score int64
+	err = tx.FindOne(ctx, &score, cond, scoreTypeID, domain, uid)
+	if err == sqlx.ErrNoRows {
+		return 0, errStoreRowNotFound
+	}
+	return score, err
+}
+
+// 插入一行, 插入失败时如果 existsCond 查询到行已存在则忽略错误, 用于代替 insert ignore. 不能在事务中使用, 部分数据库的事务在语句失败后无法继续
+func insertOrExists(ctx context.Context, db sqlxExecer, cond string, vals []interface{}, existsCond string, existsVals ...interface{}) error {
+	_, err := db.Exec(ctx, cond, vals...)
+	if err == nil {
+		return nil
+	}
+	var n int64
+	if e := db.FindOne(ctx, &n, existsCond, existsVals...); e == nil && n > 0 {
+		return nil
+	}
+	return err
+}
+
+// 修改余额, 调用前需要通过 lockBalance 锁定余额行
+func (*MysqlStore) updateBalance(ctx context.Context, tx sqlx.Txx, scoreTypeID uint32, domain string, uid string, score int64) error {
+	const cond = `update ` + ScoreBalanceTableName + ` set score=? where score_type_id=? and domain=? and uid=?`
+	_, err := tx.Exec(ctx, cond, score, scoreTypeID, domain, uid)
+	return err
+}
+
+// 获取未过期的订单状态, 订单状态不存在或已过期时返回nil. 已过期的订单状态会被删除, 之后可以使用相同的订单id重新写入
+func (*MysqlStore) getOrder(ctx context.Context, tx sqlx.Txx, uid string, orderID string, now int64) (*scoreOrderModel, error) {
+	const cond = `select o_type,o_status,old_score,change_score,result_score,expire_time from ` + ScoreOrderTableName + ` where uid=? and oid=?`
+	order := scoreOrderModel{}
+	err := tx.FindOne(ctx, &order, cond, uid, orderID)
+	if err == sqlx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isExpired(order.ExpireTime, now) {
+		return &order, nil
+	}
+
+	const deleteCond = `delete from ` + ScoreOrderTableName + ` where uid=? and oid=?`
+	_, err = tx.Exec(ctx, deleteCond, uid, orderID)
+	return nil, err
+}
+
+// 写入订单状态
+func (*MysqlStore) saveOrder(ctx context.Context, tx sqlx.Txx, uid string, orderID string, data *model.OrderData, status model.OrderStatus, expireTime int64) error {
+	cond, vals, err := builder.BuildInsert(ScoreOrderTableName, []map[string]interface{}{{
+		"uid":          uid,
+		"oid":          orderID,
+		"o_type":       uint8(data.OpType),
+		"o_status":     uint8(status),
+		"old_score":    data.OldScore,
+		"change_score": data.ChangeScore,
+		"result_score": data.ResultScore,
+		"expire_time":  expireTime,
+	}})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, cond, vals...)
+	return err
+}
+
+// 订单状态转为订单数据, 订单数据标记为重入
+func (*MysqlStore) parseOrder(order *scoreOrderModel) (model.OrderData, model.OrderStatus) {
+	return model.OrderData{
+		OpType:      model.OpType(order.OpType),
+		OldScore:    order.OldScore,
+		ChangeScore: order.ChangeScore,
+		ResultScore: order.ResultScore,
+		IsReentry:   true,
+	}, model.OrderStatus(order.OpStatus)
+}
+
+// 获取配额行, 配额行不存在时返回nil. 配额key包含用户/积分类型/域, 调用前通过 lockBalance 锁定余额行后不需要单独锁定配额行
+func (*MysqlStore) getQuota(ctx context.Context, tx sqlx.Txx, quotaKey string) (*scoreQuotaModel, error) {
+	const cond = `select used_score,used_orders,expire_time from ` + ScoreQuotaTableName + ` where quota_key=?`
+	q := scoreQuotaModel{}
+	err := tx.FindOne(ctx, &q, cond, quotaKey)
+	if err == sqlx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// 配额已使用的量, 配额行不存在或已过期时返回0
+func quotaUsed(q *scoreQuotaModel, now int64) storeQuotaUsed {
+	if q == nil || isExpired(q.ExpireTime, now) {
+		return storeQuotaUsed{}
+	}
+	return storeQuotaUsed{Score: q.UsedScore, Orders: q.UsedOrders}
+}
+
+// 占用配额, old 为 getQuota 返回的配额行
+func (*MysqlStore) saveQuota(ctx context.Context, tx sqlx.Txx, q *storeQuota, old *scoreQuotaModel, score int64, now int64) error {
+	used := quotaUsed(old, now)
+	expireTime := now + q.PeriodSec
+	if used.Orders > 0 {
+		// 配额未过期, 保留原来的过期时间
+		expireTime = old.ExpireTime
+	}
+	if old == nil {
+		const insertCond = `insert into ` + ScoreQuotaTableName + ` (quota_key, used_score, used_orders, expire_time) values (?, ?, ?, ?)`
+		_, err := tx.Exec(ctx, insertCond, q.Key, used.Score+score, used.Orders+1, expireTime)
+		return err
+	}
+	const updateCond = `update ` + ScoreQuotaTableName + ` set used_score=?, used_orders=?, expire_time=? where quota_key=?`
+	result, err := tx.Exec(ctx, updateCond, used.Score+score, used.Orders+1, expireTime, q.Key)
+	if err != nil {
+		return err
+	}
+	// 已过期的配额行可能在读取后被 PurgeExpired 删除, 此时重新插入. 占用配额后订单数一定变化, 影响行数为0只会是行不存在
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	const insertCond = `insert into ` + ScoreQuotaTableName + ` (quota_key, used_score, used_orders, expire_time) values (?, ?, ?, ?)`
+	_, err = tx.Exec(ctx, insertCond, q.Key, used.Score+score, used.Orders+1, expireTime)
+	return err
+}
@@ -0,0 +1,431 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/zly-app/zapp"
+	"github.com/zly-app/zapp/config"
+
+	"github.com/zlyuancn/score/client"
+	"github.com/zlyuancn/score/model"
+)
+
+// sqlite中创建mysql储存/余额镜像/流水的表, 字段与 db_table 中的表相同
+var sqliteStoreTables = []string{
+	`create table score_balance (
+		id integer primary key autoincrement,
+		score_type_id integer not null default 0,
+		domain varchar(64) not null default '',
+		uid varchar(64) not null default '',
+		score bigint not null default 0,
+		ctime datetime not null default current_timestamp,
+		utime datetime not null default current_timestamp,
+		unique (score_type_id, domain, uid)
+	)`,
+	`create table score_order (
+		id integer primary key autoincrement,
+		uid varchar(64) not null default '',
+		oid varchar(128) not null default '',
+		o_type tinyint not null default 0,
+		o_status tinyint not null default 0,
+		old_score bigint not null default 0,
+		change_score bigint not null default 0,
+		result_score bigint not null default 0,
+		expire_time bigint not null default 0,
+		ctime datetime not null default current_timestamp,
+		unique (uid, oid)
+	)`,
+	`create table score_order_side_effect (
+		id integer primary key autoincrement,
+		uid varchar(64) not null default '',
+		oid varchar(128) not null default '',
+		side_effect_type tinyint not null default 0,
+		side_effect varchar(64) not null default '',
+		expire_time bigint not null default 0,
+		ctime datetime not null default current_timestamp,
+		unique (uid, oid, side_effect_type, side_effect)
+	)`,
+	`create table score_quota (
+		id integer primary key autoincrement,
+		quota_key varchar(255) not null default '',
+		used_score bigint not null default 0,
+		used_orders bigint not null default 0,
+		expire_time bigint not null default 0,
+		ctime datetime not null default current_timestamp,
+		unique (quota_key)
+	)`,
+	`create table score_balance_mirror (
+		id integer primary key autoincrement,
+		score_type_id integer not null default 0,
+		domain varchar(64) not null default '',
+		uid varchar(64) not null default '',
+		oid varchar(128) not null default '',
+		score bigint not null default 0,
+		otime datetime not null default current_timestamp,
+		ctime datetime not null default current_timestamp,
+		utime datetime not null default current_timestamp,
+		unique (score_type_id, domain, uid)
+	)`,
+	`create table score_seq_no (
+		score_type_id integer not null default 0,
+		shard integer not null default 0,
+		seq_no bigint not null default 0,
+		primary key (score_type_id, shard)
+	)`,
+}
+
+const sqliteScoreFlowTable = `create table %s (
+	id integer primary key autoincrement,
+	oid varchar(128) not null default '',
+	score_type_id integer not null default 0,
+	domain varchar(64) not null default '',
+	o_type tinyint not null default 0,
+	o_status tinyint not null default 1,
+	old_score bigint not null default 0,
+	change_score bigint not null default 0,
+	result_score bigint not null default 0,
+	uid varchar(128) not null default '',
+	remark varchar(1024) not null default '',
+	link_oid varchar(128) not null default '',
+	otime datetime not null default current_timestamp,
+	ctime datetime not null default current_timestamp,
+	unique (oid)
+)`
+
+// 使用sqlite作为mysql储存/余额镜像/流水的sqlx组件. 设置了环境变量 SCORE_TEST_REDIS_ADDR 时同时配置积分数据redis组件
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "score_store_test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	confFile := filepath.Join(dir, "test.yaml")
+	confText := fmt.Sprintf(`
+components:
+  sqlx:
+    score:
+      Driver: sqlite3
+      Source: "file:%s?_txlock=immediate&_busy_timeout=5000"
+`, filepath.Join(dir, "score.db"))
+	if addr := os.Getenv(testRedisAddrEnv); addr != "" {
+		confText += fmt.Sprintf(`
+  redis:
+    score:
+      Address: %q
+`, addr)
+	}
+	err = os.WriteFile(confFile, []byte(confText), 0o644)
+	if err == nil {
+		zapp.NewApp("score.test", zapp.WithConfigOption(config.WithFiles(confFile), config.WithoutFlag()))
+		err = createSqliteTables(context.Background())
+	}
+	code := 1
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		code = m.Run()
+	}
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func createSqliteTables(ctx context.Context) error {
+	tables := append([]string{}, sqliteStoreTables...)
+	for _, tabName := range genAllScoreFlowTableNames() {
+		tables = append(tables, fmt.Sprintf(sqliteScoreFlowTable, tabName))
+	}
+	for _, cond := range tables {
+		if _, err := client.GetScoreStoreSqlxClient().Exec(ctx, cond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 储存操作, Reset 为true时重设积分, 否则增加/扣除积分
+type storeOp struct {
+	OrderID string
+	Score   int64
+	Opt     *AddScoreOption
+
+	Reset            bool
+	MaxScore         int64
+	ExpectedOldScore *int64
+}
+
+// 对内存储存和mysql储存执行相同的操作, 检查结果相同. 内存储存的结果与 calcAddScore/calcResetScore 的比较见 memoryAddScore/memoryResetScore
+func checkMysqlStoreParity(t *testing.T, uid string, ops []storeOp) {
+	t.Helper()
+	ctx := context.Background()
+	mem := NewMemoryStore()
+	s := NewMysqlStore()
+	for i, op := range ops {
+		var want, got *model.OrderData
+		var wantStatus, gotStatus model.OrderStatus
+		var err error
+		if op.Reset {
+			want, wantStatus = memoryResetScore(t, mem, op.OrderID, uid, op.Score, op.MaxScore, op.ExpectedOldScore)
+			got, gotStatus, err = s.ResetScore(ctx, op.OrderID, testScoreTypeID, testDomain, uid, op.Score, 0, op.MaxScore, op.ExpectedOldScore)
+		} else {
+			opt := op.Opt
+			if opt == nil {
+				opt = &AddScoreOption{}
+			}
+			want, wantStatus = memoryAddScore(t, mem, op.OrderID, uid, op.Score, opt)
+			got, gotStatus, err = s.AddScore(ctx, op.OrderID, testScoreTypeID, testDomain, uid, op.Score, 0, opt)
+		}
+		if err != nil {
+			t.Fatalf("op %d %s err: %v", i, op.OrderID, err)
+		}
+		if *got != *want || gotStatus != wantStatus {
+			t.Fatalf("op %d %s = %+v %d, want %+v %d", i, op.OrderID, *got, gotStatus, *want, wantStatus)
+		}
+
+		wantScore, _ := mem.GetScore(ctx, testScoreTypeID, testDomain, uid)
+		gotScore, err := s.GetScore(ctx, testScoreTypeID, testDomain, uid)
+		if err != nil {
+			t.Fatalf("op %d GetScore err: %v", i, err)
+		}
+		if gotScore != wantScore {
+			t.Fatalf("op %d score=%d, want %d", i, gotScore, wantScore)
+		}
+	}
+}
+
+func TestMysqlStoreReentry(t *testing.T) {
+	checkMysqlStoreParity(t, "mysql_reentry", []storeOp{
+		{OrderID: "o1", Score: 100},
+		{OrderID: "o1", Score: 50},
+		{OrderID: "o2", Score: -30},
+		{OrderID: "o2", Score: -30},
+		{OrderID: "o3", Score: 10, Reset: true},
+		{OrderID: "o3", Score: 20, Reset: true},
+		{OrderID: "o1", Score: 100},
+	})
+
+	// 查询订单状态不标记为重入
+	data, status, err := NewMysqlStore().GetOrderStatus(context.Background(), "o1", "mysql_reentry")
+	if err != nil {
+		t.Fatalf("GetOrderStatus err: %v", err)
+	}
+	assertOrderStatus(t, status, model.OrderStatus_Finish)
+	if data.IsReentry || data.ResultScore != 100 {
+		t.Fatalf("data=%+v", *data)
+	}
+	_, _, err = NewMysqlStore().GetOrderStatus(context.Background(), "o4", "mysql_reentry")
+	if err != ErrOrderNotFound {
+		t.Fatalf("GetOrderStatus err=%v, want %v", err, ErrOrderNotFound)
+	}
+}
+
+func TestMysqlStoreInsufficientBalance(t *testing.T) {
+	noLock := &AddScoreOption{RejectedOrderID: GenRejectedOrderID("o5")}
+	checkMysqlStoreParity(t, "mysql_insufficient", []storeOp{
+		{OrderID: "o1", Score: 10},
+		{OrderID: "o2", Score: -50},
+		{OrderID: "o3", Score: 100},
+		{OrderID: "o2", Score: -50},
+		{OrderID: "o4", Score: -150, Opt: &AddScoreOption{MinScore: -50}},
+		{OrderID: "o5", Score: -50, Opt: noLock},
+		{OrderID: "o6", Score: 100},
+		{OrderID: "o5", Score: -50, Opt: noLock},
+		{OrderID: "o5", Score: -50, Opt: noLock},
+	})
+}
+
+func TestMysqlStoreExceedLimit(t *testing.T) {
+	opt := &AddScoreOption{MaxScore: 100}
+	checkMysqlStoreParity(t, "mysql_limit", []storeOp{
+		{OrderID: "o1", Score: 60, Opt: opt},
+		{OrderID: "o2", Score: 60, Opt: opt},
+		{OrderID: "o3", Score: 40, Opt: opt},
+		{OrderID: "o4", Score: -10, Opt: opt},
+		{OrderID: "o5", Score: 200, Reset: true, MaxScore: 100},
+	})
+}
+
+func TestMysqlStoreQuota(t *testing.T) {
+	opt := &AddScoreOption{Quotas: []*model.Quota{
+		{Op: model.OpType_Add, PeriodSec: 86400, MaxScore: 100, MaxOrders: 3},
+		{Op: model.OpType_Deduct, PeriodSec: 86400, MaxOrders: 1},
+	}}
+	checkMysqlStoreParity(t, "mysql_quota", []storeOp{
+		{OrderID: "o1", Score: 60, Opt: opt},
+		{OrderID: "o2", Score: 50, Opt: opt},
+		{OrderID: "o3", Score: 30, Opt: opt},
+		{OrderID: "o4", Score: 5, Opt: opt},
+		{OrderID: "o5", Score: 1, Opt: opt},
+		{OrderID: "o6", Score: -10, Opt: opt},
+		{OrderID: "o7", Score: -10, Opt: opt},
+	})
+}
+
+func TestMysqlStoreCASAndUpTo(t *testing.T) {
+	wrong, right, resetRight := int64(50), int64(100), int64(90)
+	checkMysqlStoreParity(t, "mysql_cas", []storeOp{
+		{OrderID: "o1", Score: 100},
+		{OrderID: "o2", Score: -10, Opt: &AddScoreOption{ExpectedOldScore: &wrong}},
+		{OrderID: "o3", Score: -10, Opt: &AddScoreOption{ExpectedOldScore: &right}},
+		{OrderID: "o4", Score: 30, Reset: true, ExpectedOldScore: &right},
+		{OrderID: "o5", Score: 30, Reset: true, ExpectedOldScore: &resetRight},
+		{OrderID: "o6", Score: -50, Opt: &AddScoreOption{UpTo: true, MinScore: 10}},
+		{OrderID: "o7", Score: -50, Opt: &AddScoreOption{UpTo: true}},
+		{OrderID: "o8", Score: -50, Opt: &AddScoreOption{UpTo: true}},
+	})
+}
+
+func TestMysqlStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := NewMysqlStore()
+	const uid = "mysql_concurrent"
+
+	// 余额行不存在时并发创建, 每个订单都只变更一次积分
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := s.AddScore(ctx, "o"+strconv.Itoa(i%10), testScoreTypeID, testDomain, uid, 10, 0, &AddScoreOption{})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("AddScore err: %v", err)
+		}
+	}
+	score, err := s.GetScore(ctx, testScoreTypeID, testDomain, uid)
+	if err != nil {
+		t.Fatalf("GetScore err: %v", err)
+	}
+	if score != 100 {
+		t.Fatalf("score=%d, want 100", score)
+	}
+}
+
+func TestMysqlStoreGenOrderSeqNo(t *testing.T) {
+	ctx := context.Background()
+	s := NewMysqlStore()
+	seen := make(map[string]struct{})
+	for i := 0; i < 20; i++ {
+		no, err := s.GenOrderSeqNo(ctx, testScoreTypeID, testDomain, "mysql_seq")
+		if err != nil {
+			t.Fatalf("GenOrderSeqNo err: %v", err)
+		}
+		if _, ok := seen[no]; ok {
+			t.Fatalf("GenOrderSeqNo duplicate %s", no)
+		}
+		seen[no] = struct{}{}
+	}
+}
+
+func TestMysqlStoreSideEffectStatus(t *testing.T) {
+	ctx := context.Background()
+	s := NewMysqlStore()
+	ok, err := s.GetOrderSideEffectStatus(ctx, "o1", "mysql_se", "test", 1)
+	if err != nil || ok {
+		t.Fatalf("GetOrderSideEffectStatus=%v err=%v, want false", ok, err)
+	}
+	// 重复标记不会失败
+	for i := 0; i < 2; i++ {
+		err = s.MarkOrderSideEffectStatusOk(ctx, "o1", "mysql_se", "test", 1, 0)
+		if err != nil {
+			t.Fatalf("MarkOrderSideEffectStatusOk err: %v", err)
+		}
+	}
+	ok, err = s.GetOrderSideEffectStatus(ctx, "o1", "mysql_se", "test", 1)
+	if err != nil || !ok {
+		t.Fatalf("GetOrderSideEffectStatus=%v err=%v, want true", ok, err)
+	}
+}
+
+func TestMysqlStoreWriteScoreFlowDedup(t *testing.T) {
+	ctx := context.Background()
+	s := NewMysqlStore()
+	countFlows := func(uid string) int {
+		t.Helper()
+		var n int
+		err := client.GetScoreFlowSqlxClient().FindOne(ctx, &n, `select count(1) from `+genScoreFlowTableName(uid)+` where uid=?`, uid)
+		if err != nil {
+			t.Fatalf("count flows err: %v", err)
+		}
+		return n
+	}
+
+	uids := make([]string, 3)
+	for i := range uids {
+		uids[i] = "mysql_flow_" + strconv.Itoa(i)
+	}
+	for _, uid := range uids {
+		for i := 0; i < 2; i++ {
+			err := s.WriteScoreFlow(ctx, uid, &ScoreFlowModel{OrderID: uid + "_o1", ScoreTypeID: testScoreTypeID, Domain: testDomain, Uid: uid})
+			if err != nil {
+				t.Fatalf("WriteScoreFlow err: %v", err)
+			}
+		}
+		if n := countFlows(uid); n != 1 {
+			t.Fatalf("%s flows=%d, want 1", uid, n)
+		}
+	}
+}
+
+func TestMysqlStorePurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	s := NewMysqlStore()
+	db := client.GetScoreStoreSqlxClient()
+	// 过期时间为0表示永不过期, 不会被清理
+	expireTimes := []int64{0, 100, 500, 2000}
+	for i, expireTime := range expireTimes {
+		oid := "o" + strconv.Itoa(i)
+		stmts := []struct {
+			cond string
+			vals []interface{}
+		}{
+			{`insert into ` + ScoreOrderTableName + ` (uid, oid, expire_time) values (?, ?, ?)`, []interface{}{"mysql_purge", oid, expireTime}},
+			{`insert into ` + ScoreOrderSideEffectTableName + ` (uid, oid, side_effect_type, side_effect, expire_time) values (?, ?, ?, ?, ?)`, []interface{}{"mysql_purge", oid, 1, "test", expireTime}},
+			{`insert into ` + ScoreQuotaTableName + ` (quota_key, expire_time) values (?, ?)`, []interface{}{"mysql_purge_" + oid, expireTime}},
+		}
+		for _, stmt := range stmts {
+			_, err := db.Exec(ctx, stmt.cond, stmt.vals...)
+			if err != nil {
+				t.Fatalf("insert err: %v", err)
+			}
+		}
+	}
+
+	n, err := s.PurgeExpired(ctx, 1000)
+	if err != nil {
+		t.Fatalf("PurgeExpired err: %v", err)
+	}
+	if n != 6 {
+		t.Fatalf("PurgeExpired deleted %d, want 6", n)
+	}
+
+	counts := []struct {
+		cond string
+		val  string
+	}{
+		{`select count(1) from ` + ScoreOrderTableName + ` where uid=?`, "mysql_purge"},
+		{`select count(1) from ` + ScoreOrderSideEffectTableName + ` where uid=?`, "mysql_purge"},
+		{`select count(1) from ` + ScoreQuotaTableName + ` where quota_key like ?`, "mysql_purge_%"},
+	}
+	for _, c := range counts {
+		var count int
+		err = db.FindOne(ctx, &count, c.cond, c.val)
+		if err != nil {
+			t.Fatalf("count err: %v", err)
+		}
+		if count != 2 {
+			t.Fatalf("%s count=%d, want 2", c.cond, count)
+		}
+	}
+}
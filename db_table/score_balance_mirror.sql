@@ -0,0 +1,16 @@
+create table score_balance_mirror
+(
+    id            bigint unsigned auto_increment
+        primary key,
+    score_type_id int unsigned default 0                                             not null comment '积分类型id',
+    domain        varchar(64)  default ''                                            not null comment '域',
+    uid           varchar(64)  default ''                                            not null comment '用户id',
+    oid           varchar(128) default ''                                            not null comment '最后一次变更余额的订单id',
+    score         bigint       default 0                                             not null comment '积分余额',
+    otime         datetime(3)  default current_timestamp(3)                          not null comment '最后一次变更余额的积分变更时间, 用于丢弃乱序写入的较早的订单',
+    ctime         datetime     default current_timestamp                             not null comment '创建时间',
+    utime         datetime     default current_timestamp ON UPDATE CURRENT_TIMESTAMP not null comment '更新时间',
+    constraint balance_index
+        unique (score_type_id, domain, uid)
+)
+    comment '积分余额镜像';
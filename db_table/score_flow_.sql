@@ -6,16 +6,18 @@ create table score_flow_
     score_type_id int unsigned     default 0                 not null comment '积分类型id',
     domain        varchar(64)      default ''                not null comment '域',
 
-    o_type        tinyint unsigned default 0                 not null comment '操作类型. 1=增加, 2=扣除, 3=重置',
-    o_status      tinyint unsigned default 1                 not null comment '操作状态. 1=成功, 2=余额不足',
+    o_type        tinyint unsigned default 0                 not null comment '操作类型. 1=增加, 2=扣除, 3=重置, 4=冻结, 5=确认冻结, 6=取消冻结',
+    o_status      tinyint unsigned default 1                 not null comment '操作状态. 1=成功, 2=余额不足, 3=已冻结, 4=已确认冻结, 5=已取消冻结, 6=已冲正, 7=超过余额上限, 8=超过周期配额, 9=余额已变化',
 
-    old_score     bigint unsigned  default 0                 not null comment '原始积分',
+    old_score     bigint           default 0                 not null comment '原始积分',
     change_score  bigint unsigned  default 0                 not null comment '变更积分',
-    result_score  bigint unsigned  default 0                 not null comment '结果积分',
+    result_score  bigint           default 0                 not null comment '结果积分',
 
     uid           varchar(128)     default ''                not null comment '用户唯一标识',
     remark        varchar(1024)    default ''                not null comment '备注',
+    link_oid      varchar(128)     default ''                not null comment '关联订单id, 比如转账时另一方的订单id, 冲正时原订单的订单id, 余额不足不锁定订单时的原订单id',
 
+    otime         datetime(3)      default current_timestamp(3) not null comment '积分变更时间, 流水由副作用写入, 所以可能早于ctime',
     ctime         datetime         default current_timestamp not null,
     constraint oid_index
         unique (oid)
@@ -23,3 +25,9 @@ create table score_flow_
     comment '积分流水';
 
 create index uid_index on score_flow_ (uid);
+
+create index ctime_index on score_flow_ (ctime);
+
+create index uid_otime_index on score_flow_ (uid, otime);
+
+create index link_oid_index on score_flow_ (link_oid);
@@ -0,0 +1,76 @@
+create table score_balance
+(
+    id            bigint unsigned auto_increment
+        primary key,
+    score_type_id int unsigned default 0                                             not null comment '积分类型id',
+    domain        varchar(64)  default ''                                            not null comment '域',
+    uid           varchar(64)  default ''                                            not null comment '用户id',
+    score         bigint       default 0                                             not null comment '积分余额',
+    ctime         datetime     default current_timestamp                             not null comment '创建时间',
+    utime         datetime     default current_timestamp ON UPDATE CURRENT_TIMESTAMP not null comment '更新时间',
+    constraint balance_index
+        unique (score_type_id, domain, uid)
+)
+    comment '积分余额';
+
+create table score_order
+(
+    id           bigint unsigned auto_increment
+        primary key,
+    uid          varchar(64)      default ''                not null comment '用户id',
+    oid          varchar(128)     default ''                not null comment '订单id',
+    o_type       tinyint unsigned default 0                 not null comment '操作类型',
+    o_status     tinyint unsigned default 0                 not null comment '操作状态',
+    old_score    bigint           default 0                 not null comment '原始积分',
+    change_score bigint           default 0                 not null comment '变更积分',
+    result_score bigint           default 0                 not null comment '结果积分',
+    expire_time  bigint           default 0                 not null comment '过期时间, 秒级时间戳, 0表示永不过期',
+    ctime        datetime         default current_timestamp not null comment '创建时间',
+    constraint order_index
+        unique (uid, oid)
+)
+    comment '积分订单状态';
+
+create index expire_time_index on score_order (expire_time);
+
+create table score_order_side_effect
+(
+    id               bigint unsigned auto_increment
+        primary key,
+    uid              varchar(64)      default ''                not null comment '用户id',
+    oid              varchar(128)     default ''                not null comment '订单id',
+    side_effect_type tinyint unsigned default 0                 not null comment '副作用类型',
+    side_effect      varchar(64)      default ''                not null comment '副作用名',
+    expire_time      bigint           default 0                 not null comment '过期时间, 秒级时间戳, 0表示永不过期',
+    ctime            datetime         default current_timestamp not null comment '创建时间',
+    constraint side_effect_index
+        unique (uid, oid, side_effect_type, side_effect)
+)
+    comment '积分订单副作用状态';
+
+create index expire_time_index on score_order_side_effect (expire_time);
+
+create table score_quota
+(
+    id          bigint unsigned auto_increment
+        primary key,
+    quota_key   varchar(255) default ''                not null comment '配额key, 包含周期',
+    used_score  bigint       default 0                 not null comment '周期内已变更的积分值',
+    used_orders bigint       default 0                 not null comment '周期内已成功的订单数',
+    expire_time bigint       default 0                 not null comment '过期时间, 秒级时间戳',
+    ctime       datetime     default current_timestamp not null comment '创建时间',
+    constraint quota_key_index
+        unique (quota_key)
+)
+    comment '积分周期配额';
+
+create index expire_time_index on score_quota (expire_time);
+
+create table score_seq_no
+(
+    score_type_id int unsigned    default 0 not null comment '积分类型id',
+    shard         int unsigned    default 0 not null comment '分片',
+    seq_no        bigint unsigned default 0 not null comment '序列号',
+    primary key (score_type_id, shard)
+)
+    comment '积分订单序列号';
@@ -8,6 +8,15 @@ create table score_type
 
     order_status_expire_day       smallint unsigned default 30                                            not null comment '订单状态保留多少天, 0表示永久',
     verify_order_create_less_than smallint unsigned default 7                                             not null comment '操作时验证订单id创建时间小于多少天, 不要超过积分状态储存时间, 否则可能导致在重入时由于查不到积分状态重新操作了用户积分',
+    frozen_timeout_sec            int unsigned      default 0                                             not null comment '冻结积分超时秒数, 超时后自动取消冻结, 0表示不超时',
+    min_balance                   bigint            default 0                                             not null comment '最小余额, 负数表示允许透支',
+    max_balance                   bigint            default 0                                             not null comment '最大余额, 0表示不限制',
+    lot_mode                      tinyint unsigned  default 0                                             not null comment '是否按批次储存积分, 每次增加的积分为一个批次, 扣除时优先消耗最早过期的批次',
+    lot_expire_sec                int unsigned      default 0                                             not null comment '批次模式下增加的积分默认多少秒后过期, 0表示永不过期',
+    no_lock_on_insufficient       tinyint unsigned  default 0                                             not null comment '扣除积分余额不足时不锁定订单, 充值后可以使用相同的订单id重试',
+    leaderboard                   tinyint unsigned  default 0                                             not null comment '是否启用排行榜',
+    exchange_rates                varchar(1024)     default ''                                            not null comment '兑换为其它积分类型的比例, json格式, 如 {"2":{"from":100,"to":1,"rounding":0}}',
+    quotas                        varchar(1024)     default ''                                            not null comment '周期配额, json格式, 如 [{"op":1,"period_sec":86400,"max_score":1000,"max_orders":10}]',
 
     remark                        varchar(1024)     default ''                                            not null comment '备注',
     ctime                         datetime          default current_timestamp                             not null comment '创建时间',
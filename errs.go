@@ -12,13 +12,65 @@ var (
 	ErrScoreTypeNotFound = score_type.ErrScoreTypeNotFound
 	// 积分类型未生效
 	ErrScoreTypeInvalid = score_type.ErrScoreTypeInvalid
+	// 兑换比例不存在
+	ErrExchangeRateNotFound = score_type.ErrExchangeRateNotFound
+	// 兑换比例无效
+	ErrExchangeRateInvalid = score_type.ErrExchangeRateInvalid
+	// 兑换积分值不能整除
+	ErrExchangeScoreNotDivisible = score_type.ErrExchangeScoreNotDivisible
+	// 兑换结果积分值为0
+	ErrExchangeResultIsZero = score_type.ErrExchangeResultIsZero
+	// 兑换结果积分值溢出
+	ErrExchangeResultOverflow = score_type.ErrExchangeResultOverflow
 	// 变更积分值小于0
 	ErrChangeScoreValueIsLessThanZero = errors.New("change score value is less than zero")
+	// 不能转账给自己
+	ErrTransferToSelf = errors.New("can't transfer to self")
 )
 
 var (
 	// 余额不足
 	ErrInsufficientBalance = errors.New("Insufficient Balance")
+	// 超过余额上限
+	ErrExceedLimit = errors.New("exceed balance limit")
+	// 超过周期配额
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// 余额已变化, 当前余额不等于期望的值
+	ErrBalanceChanged = errors.New("balance changed")
+	// 批次模式的积分类型不支持这个操作
+	ErrLotModeNotSupported = errors.New("operation not supported in lot mode")
+	// 配置了周期配额的积分类型不支持这个操作
+	ErrQuotaNotSupported = errors.New("operation not supported with quotas")
+	// 配置了余额不足时不锁定订单的积分类型不支持这个操作
+	ErrNoLockNotSupported = errors.New("operation not supported with no lock on insufficient")
+	// 多积分类型原子操作的分项无效
+	ErrInvalidMultiOpLegs = errors.New("invalid multi op legs")
+	// 批量增加积分的分项为nil
+	ErrInvalidGrant = errors.New("invalid grant")
+	// 按优先级扣除积分的积分来源无效
+	ErrInvalidDeductSources = errors.New("invalid deduct sources")
+	// 积分统计条件无效
+	ErrInvalidStatsFilter = errors.New("invalid stats filter")
+	// 积分类型未启用排行榜
+	ErrLeaderboardNotEnabled = errors.New("leaderboard is not enabled")
+	// 积分类型不是批次模式
+	ErrNotLotMode = errors.New("score type is not in lot mode")
+	// 批次过期时间无效
+	ErrInvalidLotExpireTime = errors.New("invalid lot expire time")
+	// 储存不支持这个操作
+	ErrStoreNotSupported = dao.ErrStoreNotSupported
 	// 订单不存在
 	ErrOrderNotFound = dao.ErrOrderNotFound
+	// 订单不是冻结成功的订单
+	ErrOrderNotFrozen = dao.ErrOrderNotFrozen
+	// 订单已冲正
+	ErrOrderReversed = dao.ErrOrderReversed
+	// 订单不允许冲正
+	ErrOrderNotReversible = dao.ErrOrderNotReversible
+	// 转出方和转入方的key不在redis集群的同一个slot, 无法转账
+	ErrCrossSlotTransfer = dao.ErrCrossSlotTransfer
+	// 冻结已取消, 无法确认
+	ErrFrozenCancelled = errors.New("frozen is cancelled")
+	// 冻结已确认, 无法取消
+	ErrFrozenConfirmed = errors.New("frozen is confirmed")
 )
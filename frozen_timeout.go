@@ -0,0 +1,87 @@
+package score
+
+import (
+	"context"
+	"time"
+
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/log"
+	"github.com/zly-app/zapp/pkg/utils"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/dao"
+	"github.com/zlyuancn/score/score_type"
+)
+
+// 每次检查冻结超时处理的数量
+const cancelFrozenTimeoutBatchSize = 100
+
+// 取消超时冻结的最大失败次数, 超过后不再重试并删除冻结超时数据, 避免一直失败的数据占满每次检查的数量
+const cancelFrozenTimeoutMaxRetry = 5
+
+// 启动冻结超时守护程序, 定时取消已超时的冻结. 冻结只有redis实现, 注册了其它储存时不启动.
+// 没有积分类型配置冻结超时时不检查, 积分类型重新加载后配置了冻结超时才开始检查
+func startCancelFrozenTimeout(app core.IApp) {
+	if dao.CheckRedisStore() != nil {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(conf.Conf.CheckFrozenTimeoutIntervalSec) * time.Second)
+		defer t.Stop()
+		c := &frozenTimeoutCanceler{retry: make(map[dao.FrozenTimeoutData]int)}
+		for {
+			select {
+			case <-app.BaseContext().Done():
+				return
+			case <-t.C:
+				if score_type.HasFrozenTimeout(app.BaseContext()) {
+					c.cancel(app.BaseContext())
+				}
+			}
+		}
+	}()
+}
+
+type frozenTimeoutCanceler struct {
+	offset int                           // 下次检查开始的分片
+	retry  map[dao.FrozenTimeoutData]int // 取消失败的次数
+}
+
+// 取消已超时的冻结
+func (c *frozenTimeoutCanceler) cancel(ctx context.Context) {
+	ctx = utils.Trace.CtxStart(ctx, "cancelFrozenTimeout")
+	defer utils.Trace.CtxEnd(ctx)
+
+	list, next, err := dao.GetFrozenTimeout(ctx, time.Now().Unix(), cancelFrozenTimeoutBatchSize, c.offset)
+	if err != nil {
+		log.Error(ctx, "cancelFrozenTimeout dao.GetFrozenTimeout err", zap.Error(err))
+		return
+	}
+	c.offset = next
+
+	for _, data := range list {
+		st, err := score_type.ForceGetScoreType(ctx, data.ScoreTypeID)
+		if err == nil {
+			_, err = scoreApi.settleFrozen(ctx, st, OpType_CancelFrozen, data.Domain, data.Uid, data.OrderID, "frozen timeout")
+		}
+		switch err {
+		case nil, ErrFrozenConfirmed, ErrOrderNotFound, ErrOrderNotFrozen, ErrScoreTypeNotFound, ErrScoreTypeInvalid:
+		default:
+			c.retry[*data]++
+			if c.retry[*data] < cancelFrozenTimeoutMaxRetry {
+				// 下次检查时重试
+				log.Error(ctx, "cancelFrozenTimeout settleFrozen err", zap.Any("data", data), zap.Error(err))
+				continue
+			}
+			// 不再重试, 冻结保持原状需要人工处理
+			log.Error(ctx, "cancelFrozenTimeout settleFrozen err, give up", zap.Any("data", data), zap.Error(err))
+		}
+		delete(c.retry, *data)
+
+		err = dao.RemoveFrozenTimeout(ctx, data)
+		if err != nil {
+			log.Error(ctx, "cancelFrozenTimeout dao.RemoveFrozenTimeout err", zap.Any("data", data), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package score
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+)
+
+// http服务类型, 服务配置的key为 services.score
+const HttpServiceType core.ServiceType = "score"
+
+const (
+	defHttpServiceReadTimeoutSec  = 5
+	defHttpServiceWriteTimeoutSec = 5
+	// 监听地址没有指定host时使用的host
+	defHttpServiceBindHost = "127.0.0.1"
+	// 请求body最大字节数
+	httpServiceMaxBodySize = 1 << 20
+)
+
+// http服务配置
+type HttpServiceConfig struct {
+	Bind            string // 监听地址, 如 ":8080", 为空时不启用http服务. 没有指定host时只监听 127.0.0.1, 监听所有网卡需要明确配置为 "0.0.0.0:8080"
+	Token           string // 访问令牌, 不为空时请求头需要携带 "Authorization: Bearer <Token>"
+	ReadTimeoutSec  int    // 读取请求超时秒数
+	WriteTimeoutSec int    // 写入响应超时秒数
+}
+
+func (conf *HttpServiceConfig) Check() {
+	if conf.Bind != "" {
+		host, port, err := net.SplitHostPort(conf.Bind)
+		if err == nil && host == "" {
+			conf.Bind = net.JoinHostPort(defHttpServiceBindHost, port)
+		}
+	}
+	if conf.ReadTimeoutSec < 1 {
+		conf.ReadTimeoutSec = defHttpServiceReadTimeoutSec
+	}
+	if conf.WriteTimeoutSec < 1 {
+		conf.WriteTimeoutSec = defHttpServiceWriteTimeoutSec
+	}
+}
+
+// 解析http服务配置, 没有配置时返回零值
+func parseHttpServiceConfig(app core.IApp) (*HttpServiceConfig, error) {
+	conf := &HttpServiceConfig{}
+	err := app.GetConfig().ParseServiceConfig(HttpServiceType, conf, true)
+	if err != nil {
+		return nil, err
+	}
+	conf.Check()
+	return conf, nil
+}
+
+// 错误码, 用于http服务的响应
+type ErrCode int32
+
+const (
+	ErrCode_OK             ErrCode = 0 // 成功
+	ErrCode_Unknown        ErrCode = 1 // 未知错误
+	ErrCode_InvalidRequest ErrCode = 2 // 请求无效, 如请求方法错误或请求体不是有效的json
+	ErrCode_Unauthorized   ErrCode = 3 // 未授权, 配置了访问令牌但请求没有携带或携带的令牌错误
+
+	ErrCode_ScoreTypeNotFound        ErrCode = 1001 // 积分类型不存在
+	ErrCode_ScoreTypeInvalid         ErrCode = 1002 // 积分类型未生效
+	ErrCode_ChangeScoreLessThanZero  ErrCode = 1003 // 变更积分值小于0
+	ErrCode_LotModeNotSupported      ErrCode = 1004 // 批次模式的积分类型不支持这个操作
+	ErrCode_StoreNotSupported        ErrCode = 1005 // 储存不支持这个操作
+	ErrCode_InsufficientBalance      ErrCode = 2001 // 余额不足
+	ErrCode_ExceedLimit              ErrCode = 2002 // 超过余额上限
+	ErrCode_QuotaExceeded            ErrCode = 2003 // 超过周期配额
+	ErrCode_BalanceChanged           ErrCode = 2004 // 余额已变化
+	ErrCode_OrderNotFound            ErrCode = 3001 // 订单不存在
+	ErrCode_OrderReversed            ErrCode = 3002 // 订单已冲正
+	ErrCode_FrozenConfirmedCancelled ErrCode = 3003 // 冻结已确认或已取消
+)
+
+// 错误与错误码的映射
+var errCodes = map[error]ErrCode{
+	ErrScoreTypeNotFound:              ErrCode_ScoreTypeNotFound,
+	ErrScoreTypeInvalid:               ErrCode_ScoreTypeInvalid,
+	ErrChangeScoreValueIsLessThanZero: ErrCode_ChangeScoreLessThanZero,
+	ErrLotModeNotSupported:            ErrCode_LotModeNotSupported,
+	ErrStoreNotSupported:              ErrCode_StoreNotSupported,
+	ErrInsufficientBalance:            ErrCode_InsufficientBalance,
+	ErrExceedLimit:                    ErrCode_ExceedLimit,
+	ErrQuotaExceeded:                  ErrCode_QuotaExceeded,
+	ErrBalanceChanged:                 ErrCode_BalanceChanged,
+	ErrOrderNotFound:                  ErrCode_OrderNotFound,
+	ErrOrderReversed:                  ErrCode_OrderReversed,
+	ErrFrozenConfirmed:                ErrCode_FrozenConfirmedCancelled,
+	ErrFrozenCancelled:                ErrCode_FrozenConfirmedCancelled,
+}
+
+// 获取错误对应的错误码
+func GetErrCode(err error) ErrCode {
+	if err == nil {
+		return ErrCode_OK
+	}
+	for e, code := range errCodes {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return ErrCode_Unknown
+}
+
+type httpReq struct {
+	ScoreTypeID uint32 `json:"score_type_id"`
+	Domain      string `json:"domain"`
+	Uid         string `json:"uid"`
+	OrderID     string `json:"order_id"`
+	Score       int64  `json:"score"`
+	Remark      string `json:"remark"`
+}
+
+type httpRsp struct {
+	Code    ErrCode     `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type httpOrderData struct {
+	OpType      OpType `json:"op_type"`
+	OldScore    int64  `json:"old_score"`
+	ChangeScore int64  `json:"change_score"`
+	ResultScore int64  `json:"result_score"`
+	IsReentry   bool   `json:"is_reentry"`
+}
+
+type httpOrderStatus struct {
+	Order  *httpOrderData `json:"order"`
+	Status OrderStatus    `json:"status"`
+}
+
+func newHttpOrderData(data *OrderData) *httpOrderData {
+	if data == nil {
+		return nil
+	}
+	return &httpOrderData{
+		OpType:      data.OpType,
+		OldScore:    data.OldScore,
+		ChangeScore: data.ChangeScore,
+		ResultScore: data.ResultScore,
+		IsReentry:   data.IsReentry,
+	}
+}
+
+// http接口的处理函数, 返回的数据会写入响应的 data 中
+type httpHandler func(ctx context.Context, req *httpReq) (interface{}, error)
+
+var httpHandlers = map[string]httpHandler{
+	"/score/GetScore": func(ctx context.Context, req *httpReq) (interface{}, error) {
+		score, err := NewSdk(req.ScoreTypeID, req.Domain, req.Uid).GetScore(ctx)
+		return map[string]int64{"score": score}, err
+	},
+	"/score/GenOrderSeqNo": func(ctx context.Context, req *httpReq) (interface{}, error) {
+		seqNo, err := NewSdk(req.ScoreTypeID, req.Domain, req.Uid).GenOrderSeqNo(ctx)
+		return map[string]string{"order_id": seqNo}, err
+	},
+	"/score/AddScore": func(ctx context.Context, req *httpReq) (interface{}, error) {
+		data, err := NewSdk(req.ScoreTypeID, req.Domain, req.Uid).AddScore(ctx, req.OrderID, req.Score, req.Remark)
+		return newHttpOrderData(data), err
+	},
+	"/score/DeductScore": func(ctx context.Context, req *httpReq) (interface{}, error) {
+		data, err := NewSdk(req.ScoreTypeID, req.Domain, req.Uid).DeductScore(ctx, req.OrderID, req.Score, req.Remark)
+		return newHttpOrderData(data), err
+	},
+	"/score/ResetScore": func(ctx context.Context, req *httpReq) (interface{}, error) {
+		data, err := NewSdk(req.ScoreTypeID, req.Domain, req.Uid).ResetScore(ctx, req.OrderID, req.Score, req.Remark)
+		return newHttpOrderData(data), err
+	},
+	"/score/GetOrderStatus": func(ctx context.Context, req *httpReq) (interface{}, error) {
+		data, status, err := NewSdk(req.ScoreTypeID, req.Domain, req.Uid).GetOrderStatus(ctx, req.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		return &httpOrderStatus{Order: newHttpOrderData(data), Status: status}, nil
+	},
+}
+
+type httpService struct {
+	app    core.IApp
+	conf   *HttpServiceConfig
+	server *http.Server
+}
+
+func newHttpService(app core.IApp) core.IService {
+	conf, err := parseHttpServiceConfig(app)
+	if err != nil {
+		app.Fatal("parse score http service config err", zap.Error(err))
+	}
+
+	s := &httpService{app: app, conf: conf}
+	mux := http.NewServeMux()
+	for path, handler := range httpHandlers {
+		mux.Handle(path, s.wrap(handler))
+	}
+	s.server = &http.Server{
+		Addr:         conf.Bind,
+		Handler:      mux,
+		ReadTimeout:  time.Duration(conf.ReadTimeoutSec) * time.Second,
+		WriteTimeout: time.Duration(conf.WriteTimeoutSec) * time.Second,
+	}
+	return s
+}
+
+func (s *httpService) Inject(a ...interface{}) {}
+
+func (s *httpService) Start() error {
+	ln, err := net.Listen("tcp", s.conf.Bind)
+	if err != nil {
+		return err
+	}
+	s.app.Info("score http service start", zap.String("bind", ln.Addr().String()))
+	if s.conf.Token == "" {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+			s.app.Warn("score http service listen on non-loopback address without token", zap.String("bind", ln.Addr().String()))
+		}
+	}
+	go func() {
+		err := s.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.app.Error("score http service serve err", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+func (s *httpService) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.conf.WriteTimeoutSec)*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// 包装处理函数, 配置了访问令牌时检查请求头, 只接受 POST 请求, 请求和响应都是json
+func (s *httpService) wrap(handler httpHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.checkToken(r) {
+			s.writeRsp(ctx, w, http.StatusUnauthorized, &httpRsp{Code: ErrCode_Unauthorized, Message: "unauthorized"})
+			return
+		}
+		if r.Method != http.MethodPost {
+			s.writeRsp(ctx, w, http.StatusMethodNotAllowed, &httpRsp{Code: ErrCode_InvalidRequest, Message: "method not allowed"})
+			return
+		}
+
+		req := &httpReq{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpServiceMaxBodySize)).Decode(req)
+		if err != nil {
+			s.writeRsp(ctx, w, http.StatusBadRequest, &httpRsp{Code: ErrCode_InvalidRequest, Message: err.Error()})
+			return
+		}
+
+		data, err := handler(ctx, req)
+		if err != nil {
+			s.writeRsp(ctx, w, http.StatusOK, &httpRsp{Code: GetErrCode(err), Message: err.Error()})
+			return
+		}
+		s.writeRsp(ctx, w, http.StatusOK, &httpRsp{Code: ErrCode_OK, Message: "ok", Data: data})
+	})
+}
+
+// 检查请求头中的访问令牌, 没有配置访问令牌时总是通过
+func (s *httpService) checkToken(r *http.Request) bool {
+	if s.conf.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.Token)) == 1
+}
+
+func (s *httpService) writeRsp(ctx context.Context, w http.ResponseWriter, status int, rsp *httpRsp) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		log.Error(ctx, "score http service write response err", zap.Any("rsp", rsp), zap.Error(err))
+	}
+}
@@ -0,0 +1,53 @@
+package score
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpServiceConfigBind(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		":8080":        "127.0.0.1:8080",
+		"0.0.0.0:8080": "0.0.0.0:8080",
+		"[::1]:8080":   "[::1]:8080",
+	}
+	for bind, want := range tests {
+		conf := &HttpServiceConfig{Bind: bind}
+		conf.Check()
+		if conf.Bind != want {
+			t.Errorf("Check bind %q got %q, want %q", bind, conf.Bind, want)
+		}
+	}
+}
+
+func TestHttpServiceToken(t *testing.T) {
+	s := &httpService{conf: &HttpServiceConfig{Token: "secret"}}
+	h := s.wrap(func(ctx context.Context, req *httpReq) (interface{}, error) {
+		return "ok", nil
+	})
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/score/GetScore", strings.NewReader("{}"))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("auth %q got status %d, want %d", tt.auth, w.Code, tt.want)
+		}
+	}
+}
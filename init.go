@@ -5,10 +5,13 @@ import (
 	"github.com/zly-app/zapp/config"
 	"github.com/zly-app/zapp/core"
 	"github.com/zly-app/zapp/handler"
+	"github.com/zly-app/zapp/service"
 	"go.uber.org/zap"
 
+	"github.com/zlyuancn/score/balance_mirror"
 	"github.com/zlyuancn/score/conf"
 	"github.com/zlyuancn/score/dao"
+	"github.com/zlyuancn/score/leaderboard"
 	"github.com/zlyuancn/score/model"
 	"github.com/zlyuancn/score/score_flow"
 	"github.com/zlyuancn/score/score_type"
@@ -20,6 +23,11 @@ func init() {
 
 	// 注册副作用
 	side_effect.RegistrySideEffect(model.SideEffectType_AfterScoreChange, "score_change_flow", new(score_flow.ScoreChangeSideEffect))
+	side_effect.RegistrySideEffect(model.SideEffectType_AfterScoreChange, "score_change_leaderboard", new(leaderboard.ScoreChangeSideEffect))
+	side_effect.RegistrySideEffect(model.SideEffectType_AfterScoreChange, "score_change_balance_mirror", new(balance_mirror.ScoreChangeSideEffect))
+
+	// 注册http服务
+	service.RegisterCreatorFunc(HttpServiceType, newHttpService)
 
 	// 持久内存-加载积分类型
 	score_type.StartLoopLoad()
@@ -34,4 +42,9 @@ func init() {
 	zapp.AddHandler(zapp.AfterInitializeHandler, func(app core.IApp, handlerType handler.HandlerType) {
 		dao.TryInjectScript()
 	})
+	zapp.AddHandler(zapp.AfterStartHandler, func(app core.IApp, handlerType handler.HandlerType) {
+		startCancelFrozenTimeout(app)
+		startPurgeStoreExpired(app)
+		balance_mirror.StartReconcile(app)
+	})
 }
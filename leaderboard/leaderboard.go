@@ -0,0 +1,88 @@
+package leaderboard
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zly-app/zapp/log"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/dao"
+	"github.com/zlyuancn/score/model"
+	"github.com/zlyuancn/score/side_effect"
+)
+
+// 刷新排行榜时写入后余额仍在变化的最大重试次数
+const refreshLeaderboardMaxRetry = 3
+
+// 刷新用户在排行榜中的积分. 总是写入用户最新的余额而不是按变更值累加.
+//
+// 排行榜key与积分数据key不在同一个slot, 无法在一个lua脚本中读取余额并写入排行榜. 并发刷新时较早读取的余额可能较晚写入,
+// 所以写入后会再次读取余额, 余额与写入的值不同时重新写入. 最后一次写入排行榜的刷新在写入后确认过余额, 排行榜总是等于最新余额.
+// 重试多次后余额仍在变化时返回错误, 由副作用守护程序重试
+func refreshLeaderboard(ctx context.Context, st *model.ScoreType, data *model.SideEffectData) error {
+	score, err := getScore(ctx, st, data)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < refreshLeaderboardMaxRetry; i++ {
+		err = dao.UpdateLeaderboard(ctx, data.ScoreTypeID, data.Domain, data.Uid, score)
+		if err != nil {
+			log.Error(ctx, "refreshLeaderboard call dao.UpdateLeaderboard fail.", zap.Any("data", data), zap.Int64("score", score), zap.Error(err))
+			return err
+		}
+
+		// 检查写入后余额没有变化
+		nowScore, err := getScore(ctx, st, data)
+		if err != nil {
+			return err
+		}
+		if nowScore == score {
+			return nil
+		}
+		score = nowScore
+	}
+	log.Error(ctx, "refreshLeaderboard fail. score is still changing", zap.Any("data", data), zap.Int64("score", score))
+	return errScoreChanging
+}
+
+// 余额在刷新排行榜时一直在变化
+var errScoreChanging = errors.New("score is still changing")
+
+// 获取用户的最新余额
+func getScore(ctx context.Context, st *model.ScoreType, data *model.SideEffectData) (int64, error) {
+	var score int64
+	var err error
+	if st.LotMode {
+		score, err = dao.GetLotScore(ctx, data.ScoreTypeID, data.Domain, data.Uid, time.Now().Unix())
+	} else {
+		score, err = dao.GetScore(ctx, data.ScoreTypeID, data.Domain, data.Uid)
+	}
+	if err != nil {
+		log.Error(ctx, "refreshLeaderboard call GetScore fail.", zap.Any("data", data), zap.Error(err))
+	}
+	return score, err
+}
+
+type ScoreChangeSideEffect struct {
+	side_effect.BaseSideEffect
+}
+
+func (ScoreChangeSideEffect) AfterScoreChange(ctx context.Context, st *model.ScoreType, data *model.SideEffectData, flow *dao.ScoreFlowModel) error {
+	// 排行榜只有redis实现
+	if !st.Leaderboard || dao.CheckRedisStore() != nil {
+		return nil
+	}
+	// 余额没有变化
+	if flow.OldScore == flow.ResultScore {
+		return nil
+	}
+
+	err := refreshLeaderboard(ctx, st, data)
+	if err != nil {
+		log.Error(ctx, "SideEffect.AfterScoreChange call refreshLeaderboard fail.", zap.Any("data", data), zap.Any("flow", flow), zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -3,7 +3,10 @@ package score
 import (
 	"context"
 
+	"github.com/zlyuancn/score/balance_mirror"
+	"github.com/zlyuancn/score/dao"
 	"github.com/zlyuancn/score/model"
+	"github.com/zlyuancn/score/rebuild"
 	"github.com/zlyuancn/score/side_effect"
 )
 
@@ -14,6 +17,10 @@ const (
 	OpType_Add    OpType = model.OpType_Add    // 增加
 	OpType_Deduct OpType = model.OpType_Deduct // 扣除
 	OpType_Reset  OpType = model.OpType_Reset  // 重置
+
+	OpType_Freeze        OpType = model.OpType_Freeze        // 冻结
+	OpType_ConfirmFrozen OpType = model.OpType_ConfirmFrozen // 确认冻结
+	OpType_CancelFrozen  OpType = model.OpType_CancelFrozen  // 取消冻结
 )
 
 // 订单状态
@@ -22,16 +29,115 @@ type OrderStatus = model.OrderStatus
 const (
 	OrderStatus_Finish              OrderStatus = model.OrderStatus_Finish              // 完成
 	OrderStatus_InsufficientBalance OrderStatus = model.OrderStatus_InsufficientBalance // 余额不足
+	OrderStatus_Frozen              OrderStatus = model.OrderStatus_Frozen              // 已冻结
+	OrderStatus_Confirmed           OrderStatus = model.OrderStatus_Confirmed           // 已确认冻结
+	OrderStatus_Cancelled           OrderStatus = model.OrderStatus_Cancelled           // 已取消冻结
+	OrderStatus_Reversed            OrderStatus = model.OrderStatus_Reversed            // 已冲正
+	OrderStatus_ExceedLimit         OrderStatus = model.OrderStatus_ExceedLimit         // 超过余额上限
+	OrderStatus_QuotaExceeded       OrderStatus = model.OrderStatus_QuotaExceeded       // 超过周期配额
+	OrderStatus_BalanceChanged      OrderStatus = model.OrderStatus_BalanceChanged      // 余额已变化, 当前余额不等于期望的值
 )
 
 type (
-	ScoreType = model.ScoreType
-	OrderData = model.OrderData
+	ScoreType        = model.ScoreType
+	OrderData        = model.OrderData
+	ExchangeRate     = model.ExchangeRate
+	Quota            = model.Quota
+	ScoreLot         = model.ScoreLot
+	Grant            = model.Grant
+	GrantResult      = model.GrantResult
+	MultiOpLeg       = model.MultiOpLeg
+	DeductSource     = model.DeductSource
+	ScoreKey         = model.ScoreKey
+	ScoreValue       = model.ScoreValue
+	WalletBalance    = model.WalletBalance
+	ScoreFlow        = model.ScoreFlow
+	ScoreFlowFilter  = model.ScoreFlowFilter
+	ScoreStatsFilter = model.ScoreStatsFilter
+	ScoreStats       = model.ScoreStats
+	ScoreSupply      = model.ScoreSupply
+	RankItem         = model.RankItem
+	BalanceDrift     = model.BalanceDrift
+	RebuildResult    = model.RebuildResult
+)
+
+// 舍入方式
+type RoundingMode = model.RoundingMode
+
+const (
+	RoundingMode_Floor RoundingMode = model.RoundingMode_Floor // 向下取整
+	RoundingMode_Ceil  RoundingMode = model.RoundingMode_Ceil  // 向上取整
+	RoundingMode_Round RoundingMode = model.RoundingMode_Round // 四舍五入
+	RoundingMode_Exact RoundingMode = model.RoundingMode_Exact // 必须整除, 否则不允许操作
 )
 
+// 积分统计周期
+type StatsPeriod = model.StatsPeriod
+
+const (
+	StatsPeriod_Day   StatsPeriod = model.StatsPeriod_Day   // 按天
+	StatsPeriod_Week  StatsPeriod = model.StatsPeriod_Week  // 按周, 周一为一周的开始
+	StatsPeriod_Month StatsPeriod = model.StatsPeriod_Month // 按月
+)
+
+// 生成转账/兑换时转入方的订单id, 转入方使用这个订单id记录订单状态和流水
+func GenTransferInOrderID(orderID string) string {
+	return dao.GenTransferInOrderID(orderID)
+}
+
+// 生成确认/取消冻结的订单id, 确认/取消冻结使用这个订单id记录订单状态和流水
+func GenSettleFrozenOrderID(orderID string, op OpType) string {
+	return dao.GenSettleFrozenOrderID(orderID, op)
+}
+
+// 生成多积分类型原子操作第 index 个分项的订单id, 第一个分项直接使用订单id
+func GenMultiOpOrderID(orderID string, index int) string {
+	return dao.GenMultiOpOrderID(orderID, index)
+}
+
+// 储存, 负责积分数据/订单状态/订单副作用状态/订单序列号/流水的读写
+type Store = dao.Store
+
+// 能提供积分类型的储存
+type ScoreTypeStore = dao.ScoreTypeStore
+
+// 内存储存
+type MemoryStore = dao.MemoryStore
+
+// mysql储存
+type MysqlStore = dao.MysqlStore
+
+// 注册储存, 需要在app启动前注册
+func RegistryStore(s Store) {
+	dao.RegistryStore(s)
+}
+
+// 创建内存储存, 用于在没有redis和mysql的环境下运行单元测试
+func NewMemoryStore() *MemoryStore {
+	return dao.NewMemoryStore()
+}
+
+// 创建mysql储存, 积分余额/订单状态/周期配额/订单序列号储存在mysql中
+func NewMysqlStore() *MysqlStore {
+	return dao.NewMysqlStore()
+}
+
+// 核对积分余额镜像, 返回发现的差异. repair 为true时修复差异
+func ReconcileBalanceMirror(ctx context.Context, repair bool) ([]*BalanceDrift, error) {
+	return balance_mirror.Reconcile(ctx, repair)
+}
+
+// 从流水重建redis中的积分数据和订单状态, 用于redis数据丢失后的恢复. overwrite 为false时只写入不存在的积分数据
+func RebuildFromFlow(ctx context.Context, overwrite bool) (*RebuildResult, error) {
+	return rebuild.RebuildFromFlow(ctx, overwrite)
+}
+
 // mq工具
 type MqTool = side_effect.MqTool
 
+// 支持批量发送的mq工具
+type BatchMqTool = side_effect.BatchMqTool
+
 // 注册mq工具
 func RegistryMqTool(v MqTool) {
 	side_effect.RegistryMqTool(v)
@@ -8,6 +8,197 @@ type ScoreType struct {
 	EndTime                   int64  // 失效时间
 	OrderStatusExpireDay      uint16 // 订单状态保留多少天
 	VerifyOrderCreateLessThan uint16 // 操作时验证订单id创建时间小于多少天
+	FrozenTimeoutSec          uint32 // 冻结积分超时秒数, 超时后自动取消冻结, 0表示不超时
+	MinBalance                int64  // 最小余额, 负数表示允许透支
+	MaxBalance                int64  // 最大余额, 0表示不限制
+	LotMode                   bool   // 是否按批次储存积分, 每次增加的积分为一个批次, 扣除时优先消耗最早过期的批次
+	LotExpireSec              int64  // 批次模式下增加的积分默认多少秒后过期, 0表示永不过期
+	NoLockOnInsufficient      bool   // 扣除积分余额不足时不锁定订单, 充值后可以使用相同的订单id重试. 转账/兑换/多积分类型原子操作/按优先级扣除扣除这个积分类型时返回 ErrNoLockNotSupported
+	Leaderboard               bool   // 是否启用排行榜
+
+	ExchangeRates map[uint32]*ExchangeRate // 兑换为其它积分类型的比例, key为目标积分类型id
+	Quotas        []*Quota                 // 周期配额. 转账/兑换/多积分类型原子操作/按优先级扣除不检查配额, 对这个积分类型执行配额对应的操作时返回 ErrQuotaNotSupported
+}
+
+// 周期配额, 限制用户在一个周期内增加/扣除积分的总值和订单数
+type Quota struct {
+	Op        OpType `json:"op"`         // 操作类型, 1=增加, 2=扣除
+	PeriodSec int64  `json:"period_sec"` // 周期秒数, 比如 86400 表示每天, 周期按本地时区对齐
+	MaxScore  int64  `json:"max_score"`  // 周期内最多变更的积分值, 0表示不限制
+	MaxOrders int64  `json:"max_orders"` // 周期内最多成功的订单数, 0表示不限制
+}
+
+// 兑换比例, 扣除 From 个源积分类型的积分得到 To 个目标积分类型的积分
+type ExchangeRate struct {
+	From     int64        `json:"from"`     // 源积分数量
+	To       int64        `json:"to"`       // 目标积分数量
+	Rounding RoundingMode `json:"rounding"` // 舍入方式
+}
+
+// 积分批次
+type ScoreLot struct {
+	OrderID    string // 增加积分的订单id
+	Score      int64  // 批次剩余积分
+	ExpireTime int64  // 过期时间, 秒级时间戳, 0表示永不过期
+}
+
+// 批量增加积分的单个用户数据
+type Grant struct {
+	Uid     string // 用户id
+	OrderID string // 订单id, 为空时自动生成
+	Score   int64  // 增加积分值
+	Remark  string // 备注
+}
+
+// 批量增加积分的单个用户结果
+type GrantResult struct {
+	Uid     string      // 用户id
+	OrderID string      // 订单id
+	Data    *OrderData  // 订单数据, 操作失败时可能为nil
+	Status  OrderStatus // 订单状态
+	Err     error       // 这个用户操作失败的原因
+}
+
+// 批量获取积分的key
+type ScoreKey struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	Uid         string // 用户id
+}
+
+// 批量获取积分的结果
+type ScoreValue struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	Uid         string // 用户id
+	Score       int64  // 积分
+	Err         error  // 获取失败的原因, 积分类型不存在或已失效时不会查询积分
+}
+
+// 用户钱包中的积分
+type WalletBalance struct {
+	ScoreTypeID uint32     // 积分类型id
+	Domain      string     // 域
+	Score       int64      // 积分
+	ScoreType   *ScoreType // 积分类型
+}
+
+// 积分流水查询条件, 为空的条件不会过滤
+type ScoreFlowFilter struct {
+	ScoreTypeIDs []uint32      // 积分类型id
+	Domains      []string      // 域
+	OpTypes      []OpType      // 操作类型
+	OpStatuses   []OrderStatus // 操作状态
+	StartTime    int64         // 开始时间, 秒级时间戳, 包含
+	EndTime      int64         // 结束时间, 秒级时间戳, 不包含
+}
+
+// 积分流水
+type ScoreFlow struct {
+	ID          uint64      // 流水id, 用于分页
+	OrderID     string      // 订单id
+	ScoreTypeID uint32      // 积分类型id
+	Domain      string      // 域
+	OpType      OpType      // 操作类型
+	OpStatus    OrderStatus // 操作状态
+	OldScore    int64       // 原始积分
+	ChangeScore int64       // 变更积分
+	ResultScore int64       // 结果积分
+	Uid         string      // 用户id
+	Remark      string      // 备注
+	LinkOrderID string      // 关联订单id
+	CreateTime  int64       // 创建时间, 秒级时间戳
+}
+
+// 积分统计周期
+type StatsPeriod uint8
+
+const (
+	StatsPeriod_Day   StatsPeriod = 1 // 按天
+	StatsPeriod_Week  StatsPeriod = 2 // 按周, 周一为一周的开始
+	StatsPeriod_Month StatsPeriod = 3 // 按月
+)
+
+// 积分统计条件
+type ScoreStatsFilter struct {
+	ScoreTypeIDs []uint32    // 积分类型id, 为空表示所有积分类型
+	Domains      []string    // 域, 为空表示所有域
+	Period       StatsPeriod // 统计周期
+	StartTime    int64       // 开始时间, 秒级时间戳, 包含
+	EndTime      int64       // 结束时间, 秒级时间戳, 不包含
+	GroupByUid   bool        // 是否按用户分组, 为true时结果的 Uid 为用户id
+}
+
+// 积分统计结果
+type ScoreStats struct {
+	Bucket       string // 统计周期的开始日期, 格式为 2006-01-02
+	ScoreTypeID  uint32 // 积分类型id
+	Domain       string // 域
+	Uid          string // 用户id, 只有按用户分组时才有值
+	EarnedScore  int64  // 增加的积分总值
+	SpentScore   int64  // 扣除的积分总值, 包含确认冻结的积分
+	EarnedOrders int64  // 增加积分的订单数
+	SpentOrders  int64  // 扣除积分的订单数, 包含确认冻结的订单
+}
+
+// 积分类型在一个域的供应量
+type ScoreSupply struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	Added       int64  // 增加的积分总值
+	Deducted    int64  // 扣除的积分总值, 包含确认冻结的积分
+	Reset       int64  // 重设积分对余额的净影响
+	Expired     int64  // 批次模式下已清理的过期积分总值
+	Outstanding int64  // 流通中的积分, 包含冻结中的积分. Added - Deducted + Reset - Expired
+}
+
+// 排行榜中的用户
+type RankItem struct {
+	Uid   string // 用户id
+	Score int64  // 积分余额
+	Rank  int64  // 名次, 从1开始, 0表示不在排行榜中
+}
+
+// 积分余额镜像核对发现的差异
+type BalanceDrift struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	Uid         string // 用户id
+
+	RedisScore    int64  // redis中的余额
+	RedisExists   bool   // redis中的积分数据是否存在
+	MirrorScore   int64  // 镜像中的余额
+	MirrorOrderID string // 镜像中最后一次变更余额的订单id
+	FlowScore     int64  // 最新流水的结果积分
+	FlowOrderID   string // 最新流水的订单id, 为空表示没有流水或未开启流水
+
+	Repaired bool // 是否已修复
+}
+
+// 从流水重建积分数据和订单状态的结果
+type RebuildResult struct {
+	Flows         int64 // 扫描的流水数
+	SkippedFlows  int64 // 积分类型不存在而跳过的流水数
+	Scores        int64 // 写入的积分数据数
+	OrderStatuses int64 // 写入的订单状态数
+	ChangedOrders int64 // 根据冲正/确认冻结/取消冻结流水修改操作状态的订单数
+	LinkedOrders  int64 // 写入的关联订单标记数
+	Frozens       int64 // 写入的冻结积分数
+	Supplies      int64 // 写入的供应量分片数
+}
+
+// 多积分类型原子操作的分项
+type MultiOpLeg struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
+	Op          OpType // 操作类型, 只支持增加和扣除
+	Score       int64  // 增加/扣除积分值
+}
+
+// 按优先级扣除积分的积分来源
+type DeductSource struct {
+	ScoreTypeID uint32 // 积分类型id
+	Domain      string // 域
 }
 
 // 订单数据
@@ -11,12 +11,20 @@ const (
 	OpType_Add    OpType = 1 // 增加
 	OpType_Deduct OpType = 2 // 扣除
 	OpType_Reset  OpType = 3 // 重置
+
+	OpType_Freeze        OpType = 4 // 冻结
+	OpType_ConfirmFrozen OpType = 5 // 确认冻结
+	OpType_CancelFrozen  OpType = 6 // 取消冻结
 )
 
 var OpTypeName = map[OpType]string{
 	OpType_Add:    "Add",
 	OpType_Deduct: "Deduct",
 	OpType_Reset:  "Reset",
+
+	OpType_Freeze:        "Freeze",
+	OpType_ConfirmFrozen: "ConfirmFrozen",
+	OpType_CancelFrozen:  "CancelFrozen",
 }
 
 func GetOpName(op OpType) string {
@@ -27,12 +35,29 @@ func GetOpName(op OpType) string {
 	return fmt.Sprintf("Undefined op=%d", op)
 }
 
+// 舍入方式
+type RoundingMode int8
+
+const (
+	RoundingMode_Floor RoundingMode = 0 // 向下取整
+	RoundingMode_Ceil  RoundingMode = 1 // 向上取整
+	RoundingMode_Round RoundingMode = 2 // 四舍五入
+	RoundingMode_Exact RoundingMode = 3 // 必须整除, 否则不允许操作
+)
+
 // 订单状态
 type OrderStatus int8
 
 const (
 	OrderStatus_Finish              OrderStatus = 1 // 完成
 	OrderStatus_InsufficientBalance OrderStatus = 2 // 余额不足
+	OrderStatus_Frozen              OrderStatus = 3 // 已冻结
+	OrderStatus_Confirmed           OrderStatus = 4 // 已确认冻结
+	OrderStatus_Cancelled           OrderStatus = 5 // 已取消冻结
+	OrderStatus_Reversed            OrderStatus = 6 // 已冲正
+	OrderStatus_ExceedLimit         OrderStatus = 7 // 超过余额上限
+	OrderStatus_QuotaExceeded       OrderStatus = 8 // 超过周期配额
+	OrderStatus_BalanceChanged      OrderStatus = 9 // 余额已变化, 当前余额不等于期望的值
 )
 
 // 副作用类型
@@ -53,4 +78,7 @@ type SideEffectData struct {
 	Op          OpType         `json:"op"`  // 操作类型
 	Score       int64          `json:"v"`   // 积分值
 	Remark      string         `json:"ps"`  // 备注
+	LinkOrderID string         `json:"lo"`  // 关联订单id
+	UpTo        bool           `json:"ut"`  // 是否为部分扣除, 此时 Score 为最多扣除的积分值
+	OpTime      int64          `json:"ot"`  // 积分变更时间, 毫秒级时间戳, 写入流水的 otime
 }
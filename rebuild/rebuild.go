@@ -0,0 +1,281 @@
+package rebuild
+
+import (
+	"context"
+	"time"
+
+	"github.com/zly-app/zapp/log"
+	"github.com/zly-app/zapp/pkg/utils"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/dao"
+	"github.com/zlyuancn/score/model"
+	"github.com/zlyuancn/score/score_type"
+)
+
+// 每次从流水分表读取的行数
+const scanBatchSize = 1000
+
+type scoreKey struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+}
+
+// 需要在订单状态重建后修改操作状态的订单
+type stateChange struct {
+	Flow *dao.ScoreFlowModel // 冲正/确认冻结/取消冻结的流水, LinkOrderID 为需要修改的订单
+	From model.OrderStatus
+	To   model.OrderStatus
+}
+
+// 冻结订单
+type frozenKey struct {
+	Uid     string
+	OrderID string
+}
+
+// 从流水重建redis中的积分数据, 订单状态, 冻结积分和供应量.
+//
+// 依次扫描所有流水分表, 每个用户/积分类型/域取id最大的流水的结果积分写入积分数据key, 同时将积分类型和域写入用户钱包.
+// overwrite 为false时只写入不存在的积分数据, 为true时覆盖已存在的积分数据. 批次模式的积分无法从余额重建, 会被跳过.
+//
+// 仍在积分类型的订单状态保留时间内的流水会重建订单状态, 有效期为流水创建时间加上保留时间, 已存在的订单状态不会被覆盖.
+// 之后根据冲正/确认冻结/取消冻结的流水将原订单的操作状态修改为已冲正/已确认冻结/已取消冻结, 避免订单被重复冲正或结算.
+// 转账/兑换/多积分类型原子操作/按优先级扣除的订单会同时恢复关联订单标记, 避免被单独冲正.
+// 重建订单状态后仍为已冻结的订单会恢复冻结积分和冻结超时, 超时时间为积分变更时间加上积分类型的冻结超时时间.
+//
+// 所有成功的流水累计为供应量的 add/deduct/reset, 在扫描所有分表后写入, overwrite 为false时只写入不存在的field. 批次模式清理的过期积分没有流水, 不会重建.
+// 注册了其它储存时返回 dao.ErrStoreNotSupported
+func RebuildFromFlow(ctx context.Context, overwrite bool) (*model.RebuildResult, error) {
+	ctx = utils.Trace.CtxStart(ctx, "RebuildFromFlow", utils.OtelSpanKey("overwrite").Bool(overwrite))
+	defer utils.Trace.CtxEnd(ctx)
+
+	err := dao.CheckRedisStore()
+	if err != nil {
+		log.Error(ctx, "RebuildFromFlow err", zap.Error(err))
+		return nil, err
+	}
+
+	ret := &model.RebuildResult{}
+	// 供应量按slot分片, 不同分表的用户可能在同一个分片, 所以扫描所有分表后再写入
+	supplies := make(dao.RestoreSupplies)
+	for _, tabName := range dao.GetAllScoreFlowTableNames() {
+		err := rebuildTable(ctx, tabName, overwrite, supplies, ret)
+		if err != nil {
+			log.Error(ctx, "RebuildFromFlow call rebuildTable fail.", zap.String("tabName", tabName), zap.Any("result", ret), zap.Error(err))
+			return ret, err
+		}
+		log.Info(ctx, "RebuildFromFlow table done", zap.String("tabName", tabName), zap.Any("result", ret))
+	}
+
+	n, err := dao.RestoreScoreSupplies(ctx, supplies, overwrite)
+	if err != nil {
+		log.Error(ctx, "RebuildFromFlow call dao.RestoreScoreSupplies fail.", zap.Any("result", ret), zap.Error(err))
+		return ret, err
+	}
+	ret.Supplies += int64(n)
+	return ret, nil
+}
+
+// 重建一个流水分表. 按id从大到小扫描, 每个用户/积分类型/域第一次出现的流水即为最新的流水
+func rebuildTable(ctx context.Context, tabName string, overwrite bool, supplies dao.RestoreSupplies, ret *model.RebuildResult) error {
+	seen := make(map[scoreKey]struct{})
+	settled := make(map[frozenKey]struct{})
+	var changes []*stateChange
+	var frozens []*dao.RestoreFrozenItem
+	now := time.Now().Unix()
+
+	var cursor uint64
+	for {
+		flows, err := dao.ScanScoreFlowTable(ctx, tabName, cursor, scanBatchSize)
+		if err != nil {
+			return err
+		}
+
+		var scores []*dao.RestoreScoreItem
+		var statuses []*dao.RestoreOrderStatusItem
+		var linkeds []*dao.RestoreLinkedOrderItem
+		for _, flow := range flows {
+			ret.Flows++
+			st, err := score_type.ForceGetScoreType(ctx, flow.ScoreTypeID)
+			if err == score_type.ErrScoreTypeNotFound {
+				ret.SkippedFlows++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			key := scoreKey{flow.ScoreTypeID, flow.Domain, flow.Uid}
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				if !st.LotMode {
+					scores = append(scores, &dao.RestoreScoreItem{
+						ScoreTypeID: flow.ScoreTypeID,
+						Domain:      flow.Domain,
+						Uid:         flow.Uid,
+						Score:       flow.ResultScore,
+					})
+				}
+			}
+
+			if s := genSupply(flow, settled); s != nil {
+				supplies.Add(flow.ScoreTypeID, flow.Domain, flow.Uid, s)
+			}
+
+			var expireSec int64
+			if st.OrderStatusExpireDay > 0 {
+				expireSec = flow.Ctime.Unix() + int64(st.OrderStatusExpireDay)*86400 - now
+				if expireSec < 1 {
+					continue
+				}
+			}
+			statuses = append(statuses, &dao.RestoreOrderStatusItem{
+				Uid:     flow.Uid,
+				OrderID: flow.OrderID,
+				Data: &model.OrderData{
+					OpType:      model.OpType(flow.OpType),
+					OldScore:    flow.OldScore,
+					ChangeScore: int64(flow.ChangeScore),
+					ResultScore: flow.ResultScore,
+				},
+				Status:    model.OrderStatus(flow.OpStatus),
+				ExpireSec: expireSec,
+			})
+			if id := dao.GetLinkedOrderID(flow.OrderID, flow.LinkOrderID); id != "" && model.OrderStatus(flow.OpStatus) == model.OrderStatus_Finish {
+				linkeds = append(linkeds, &dao.RestoreLinkedOrderItem{Uid: flow.Uid, OrderID: id, ExpireSec: expireSec})
+			}
+			if c := genStateChange(flow); c != nil {
+				changes = append(changes, c)
+			}
+			if model.OpType(flow.OpType) == model.OpType_Freeze && model.OrderStatus(flow.OpStatus) == model.OrderStatus_Frozen {
+				var deadline int64
+				if st.FrozenTimeoutSec > 0 {
+					deadline = flow.OrderTime.Unix() + int64(st.FrozenTimeoutSec)
+				}
+				frozens = append(frozens, &dao.RestoreFrozenItem{
+					ScoreTypeID: flow.ScoreTypeID,
+					Domain:      flow.Domain,
+					Uid:         flow.Uid,
+					OrderID:     flow.OrderID,
+					Score:       int64(flow.ChangeScore),
+					Deadline:    deadline,
+				})
+			}
+		}
+
+		n, err := dao.RestoreScores(ctx, scores, overwrite)
+		if err != nil {
+			return err
+		}
+		ret.Scores += int64(n)
+
+		n, err = dao.RestoreOrderStatuses(ctx, statuses)
+		if err != nil {
+			return err
+		}
+		ret.OrderStatuses += int64(n)
+
+		n, err = dao.RestoreLinkedOrders(ctx, linkeds)
+		if err != nil {
+			return err
+		}
+		ret.LinkedOrders += int64(n)
+
+		if len(flows) < scanBatchSize {
+			break
+		}
+		cursor = flows[len(flows)-1].ID
+	}
+
+	// 原订单的流水比冲正/结算的流水更早, 所以在整个分表的订单状态重建后再修改
+	for _, c := range changes {
+		ok, err := applyStateChange(ctx, c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ret.ChangedOrders++
+		}
+	}
+
+	// 已确认或取消的冻结订单在上面被修改了操作状态, 不会恢复冻结积分
+	n, err := dao.RestoreFrozens(ctx, frozens)
+	if err != nil {
+		return err
+	}
+	ret.Frozens += int64(n)
+	return nil
+}
+
+// 根据成功的流水生成对供应量的影响, 与lua脚本写入供应量的规则相同. 不影响供应量时返回nil
+func genSupply(flow *dao.ScoreFlowModel, settled map[frozenKey]struct{}) *dao.ScoreSupply {
+	op, status := model.OpType(flow.OpType), model.OrderStatus(flow.OpStatus)
+	switch {
+	case op == model.OpType_Add && status == model.OrderStatus_Finish:
+		return &dao.ScoreSupply{Added: int64(flow.ChangeScore)}
+	case op == model.OpType_Deduct && status == model.OrderStatus_Finish:
+		return &dao.ScoreSupply{Deducted: int64(flow.ChangeScore)}
+	case op == model.OpType_Reset && status == model.OrderStatus_Finish:
+		return &dao.ScoreSupply{Reset: flow.ResultScore - flow.OldScore}
+	case (op == model.OpType_ConfirmFrozen || op == model.OpType_CancelFrozen) && status == model.OrderStatus_Confirmed:
+		// 冻结订单确认后再取消时的流水也是已确认冻结, 每个冻结订单只计算一次
+		key := frozenKey{flow.Uid, flow.LinkOrderID}
+		if _, ok := settled[key]; ok {
+			return nil
+		}
+		settled[key] = struct{}{}
+		return &dao.ScoreSupply{Deducted: int64(flow.ChangeScore)}
+	}
+	return nil
+}
+
+// 根据流水生成需要修改的原订单操作状态, 不需要修改时返回nil
+func genStateChange(flow *dao.ScoreFlowModel) *stateChange {
+	if flow.LinkOrderID == "" {
+		return nil
+	}
+	op, status := model.OpType(flow.OpType), model.OrderStatus(flow.OpStatus)
+	switch {
+	case (op == model.OpType_ConfirmFrozen || op == model.OpType_CancelFrozen) &&
+		(status == model.OrderStatus_Confirmed || status == model.OrderStatus_Cancelled):
+		return &stateChange{Flow: flow, From: model.OrderStatus_Frozen, To: status}
+	case (op == model.OpType_Add || op == model.OpType_Deduct || op == model.OpType_Reset) && status == model.OrderStatus_Finish:
+		// 可能是冲正, 需要在 applyStateChange 中检查原订单
+		return &stateChange{Flow: flow, From: model.OrderStatus_Finish, To: model.OrderStatus_Reversed}
+	}
+	return nil
+}
+
+// 修改原订单的操作状态, 返回是否修改
+func applyStateChange(ctx context.Context, c *stateChange) (bool, error) {
+	if c.To == model.OrderStatus_Reversed {
+		// 转账/兑换/多积分类型原子操作等流水也有关联订单, 只有关联的是同一个积分类型/域下相反操作的成功订单时才是冲正
+		origin, err := dao.GetScoreFlowByOrderID(ctx, c.Flow.Uid, c.Flow.LinkOrderID)
+		if err != nil {
+			return false, err
+		}
+		if origin == nil || !isReverseOf(c.Flow, origin) {
+			return false, nil
+		}
+	}
+	return dao.ChangeOrderState(ctx, c.Flow.Uid, c.Flow.LinkOrderID, c.From, c.To)
+}
+
+// 检查 flow 是否为 origin 的冲正流水
+func isReverseOf(flow *dao.ScoreFlowModel, origin *dao.ScoreFlowModel) bool {
+	if origin.ScoreTypeID != flow.ScoreTypeID || origin.Domain != flow.Domain || model.OrderStatus(origin.OpStatus) != model.OrderStatus_Finish {
+		return false
+	}
+	switch model.OpType(origin.OpType) {
+	case model.OpType_Add:
+		return model.OpType(flow.OpType) == model.OpType_Deduct
+	case model.OpType_Deduct:
+		return model.OpType(flow.OpType) == model.OpType_Add
+	case model.OpType_Reset:
+		// 冲正重置时恢复为重置前的积分
+		return model.OpType(flow.OpType) == model.OpType_Reset && int64(flow.ChangeScore) == origin.OldScore
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,59 +27,1484 @@ var scoreApi = scoreCli{}
 
 type scoreCli struct{}
 
-// 获取积分
+// 获取积分. 批次模式下已过期的批次不会计入
 func (scoreCli) GetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
 	st, err := score_type.GetScoreType(ctx, scoreTypeID)
 	if err != nil {
 		return 0, err
 	}
 
-	score, err := dao.GetScore(ctx, scoreTypeID, domain, uid)
+	var score int64
+	if st.LotMode {
+		err = scoreApi.checkRedisStore(ctx, "GetScore")
+		if err != nil {
+			return 0, err
+		}
+		score, err = dao.GetLotScore(ctx, scoreTypeID, domain, uid, time.Now().Unix())
+	} else {
+		score, err = dao.GetScore(ctx, scoreTypeID, domain, uid)
+	}
+	if err != nil {
+		log.Error(ctx, "GetScore dao.GetScore err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return 0, err
+	}
+	return score, nil
+}
+
+// 批量获取积分, 返回结果与 keys 一一对应. 积分类型不存在或已失效的key会被跳过, 其原因记录在结果的 Err 中
+func (scoreCli) GetScores(ctx context.Context, keys []*ScoreKey) ([]*ScoreValue, error) {
+	ret := make([]*ScoreValue, len(keys))
+	items := make([]*dao.GetScoresItem, 0, len(keys))
+	index := make([]int, 0, len(keys)) // items 对应 keys 的下标
+	type stResult struct {
+		st  *model.ScoreType
+		err error
+	}
+	sts := make(map[uint32]*stResult)
+	for i, k := range keys {
+		ret[i] = &ScoreValue{ScoreTypeID: k.ScoreTypeID, Domain: k.Domain, Uid: k.Uid}
+		r, ok := sts[k.ScoreTypeID]
+		if !ok {
+			r = &stResult{}
+			r.st, r.err = score_type.GetScoreType(ctx, k.ScoreTypeID)
+			sts[k.ScoreTypeID] = r
+		}
+		if r.err != nil {
+			ret[i].Err = r.err
+			continue
+		}
+		items = append(items, &dao.GetScoresItem{
+			ScoreTypeID: k.ScoreTypeID,
+			Domain:      k.Domain,
+			Uid:         k.Uid,
+			LotMode:     r.st.LotMode,
+		})
+		index = append(index, i)
+	}
+	if len(items) == 0 {
+		return ret, nil
+	}
+
+	results, err := dao.GetScores(ctx, items, time.Now().Unix())
+	if err != nil {
+		log.Error(ctx, "GetScores dao.GetScores err", zap.Int("count", len(items)), zap.Error(err))
+		return nil, err
+	}
+	for j, r := range results {
+		v := ret[index[j]]
+		v.Score, v.Err = r.Score, r.Err
+		if r.Err != nil {
+			log.Error(ctx, "GetScores dao.GetScores item err",
+				zap.Uint32("scoreTypeID", v.ScoreTypeID),
+				zap.String("domain", v.Domain),
+				zap.String("uid", v.Uid),
+				zap.Error(r.Err),
+			)
+		}
+	}
+	return ret, nil
+}
+
+// 获取用户钱包, 返回用户有积分数据的所有积分类型/域的积分, 按积分类型id和域排序. 已删除的积分类型会被跳过, 已失效的积分类型仍会返回
+func (s scoreCli) GetWallet(ctx context.Context, uid string) ([]*WalletBalance, error) {
+	err := s.checkRedisStore(ctx, "GetWallet")
+	if err != nil {
+		return nil, err
+	}
+
+	wallet, err := dao.GetWallet(ctx, uid)
+	if err != nil {
+		log.Error(ctx, "GetWallet dao.GetWallet err", zap.String("uid", uid), zap.Error(err))
+		return nil, err
+	}
+
+	ret := make([]*WalletBalance, 0, len(wallet))
+	items := make([]*dao.GetScoresItem, 0, len(wallet))
+	sts := make(map[uint32]*model.ScoreType)
+	for _, w := range wallet {
+		st, ok := sts[w.ScoreTypeID]
+		if !ok {
+			st, err = score_type.ForceGetScoreType(ctx, w.ScoreTypeID)
+			if err == ErrScoreTypeNotFound {
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			sts[w.ScoreTypeID] = st
+		}
+		if st == nil {
+			continue
+		}
+
+		ret = append(ret, &WalletBalance{
+			ScoreTypeID: w.ScoreTypeID,
+			Domain:      w.Domain,
+			ScoreType:   st,
+		})
+		items = append(items, &dao.GetScoresItem{
+			ScoreTypeID: w.ScoreTypeID,
+			Domain:      w.Domain,
+			Uid:         uid,
+			LotMode:     st.LotMode,
+		})
+	}
+	if len(items) == 0 {
+		return ret, nil
+	}
+
+	results, err := dao.GetScores(ctx, items, time.Now().Unix())
+	if err != nil {
+		log.Error(ctx, "GetWallet dao.GetScores err", zap.String("uid", uid), zap.Error(err))
+		return nil, err
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			log.Error(ctx, "GetWallet dao.GetScores item err",
+				zap.String("uid", uid),
+				zap.Uint32("scoreTypeID", ret[i].ScoreTypeID),
+				zap.String("domain", ret[i].Domain),
+				zap.Error(r.Err),
+			)
+			return nil, r.Err
+		}
+		ret[i].Score = r.Score
+	}
+	return ret, nil
+}
+
+// 积分流水每页默认数量和最大数量
+const (
+	defListScoreFlowLimit = 20
+	maxListScoreFlowLimit = 100
+)
+
+// 查询用户的积分流水, 按流水id从新到旧排序. cursor 为上一页返回的 nextCursor, 为0表示从最新的流水开始.
+// 返回的 nextCursor 为0表示没有更多数据
+func (scoreCli) ListScoreFlow(ctx context.Context, uid string, filter *ScoreFlowFilter, cursor uint64, limit int) ([]*ScoreFlow, uint64, error) {
+	if limit < 1 {
+		limit = defListScoreFlowLimit
+	}
+	if limit > maxListScoreFlowLimit {
+		limit = maxListScoreFlowLimit
+	}
+
+	flows, err := dao.ListScoreFlow(ctx, uid, filter, cursor, limit)
+	if err != nil {
+		log.Error(ctx, "ListScoreFlow dao.ListScoreFlow err",
+			zap.String("uid", uid),
+			zap.Any("filter", filter),
+			zap.Uint64("cursor", cursor),
+			zap.Int("limit", limit),
+			zap.Error(err),
+		)
+		return nil, 0, err
+	}
+
+	ret := make([]*ScoreFlow, len(flows))
+	for i, f := range flows {
+		ret[i] = &ScoreFlow{
+			ID:          f.ID,
+			OrderID:     f.OrderID,
+			ScoreTypeID: f.ScoreTypeID,
+			Domain:      f.Domain,
+			OpType:      model.OpType(f.OpType),
+			OpStatus:    model.OrderStatus(f.OpStatus),
+			OldScore:    f.OldScore,
+			ChangeScore: int64(f.ChangeScore),
+			ResultScore: f.ResultScore,
+			Uid:         f.Uid,
+			Remark:      f.Remark,
+			LinkOrderID: f.LinkOrderID,
+			CreateTime:  f.Ctime.Unix(),
+		}
+	}
+
+	var nextCursor uint64
+	if len(flows) == limit {
+		nextCursor = flows[len(flows)-1].ID
+	}
+	return ret, nextCursor, nil
+}
+
+// 获取用户在过去某个时间点的积分, t 为秒级时间戳. 通过积分流水中积分变更时间(otime)不晚于 t 的最新一条流水的结果积分得到, 没有流水时返回0.
+// 需要开启写入积分流水. 批次模式下未发生积分变更时的批次过期不会反映在结果中
+func (scoreCli) GetScoreAt(ctx context.Context, scoreTypeID uint32, domain string, uid string, t int64) (int64, error) {
+	st, err := score_type.ForceGetScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return 0, err
+	}
+
+	flow, err := dao.GetLatestScoreFlowBefore(ctx, scoreTypeID, domain, uid, time.Unix(t, 0))
+	if err != nil {
+		log.Error(ctx, "GetScoreAt dao.GetLatestScoreFlowBefore err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("t", t),
+			zap.Error(err),
+		)
+		return 0, err
+	}
+	if flow == nil {
+		return 0, nil
+	}
+	return flow.ResultScore, nil
+}
+
+// 统计用户的积分流水, 返回每个周期/积分类型/域增加和扣除的积分总值及订单数
+func (s scoreCli) GetUserScoreStats(ctx context.Context, uid string, filter *ScoreStatsFilter) ([]*ScoreStats, error) {
+	return s.getScoreStats(ctx, uid, filter)
+}
+
+// 统计所有用户的积分流水, 会查询所有流水分表, 返回每个周期/积分类型/域增加和扣除的积分总值及订单数. filter.GroupByUid 为true时还按用户分组
+func (s scoreCli) GetScoreStats(ctx context.Context, filter *ScoreStatsFilter) ([]*ScoreStats, error) {
+	return s.getScoreStats(ctx, "", filter)
+}
+
+func (scoreCli) getScoreStats(ctx context.Context, uid string, filter *ScoreStatsFilter) ([]*ScoreStats, error) {
+	if filter == nil || filter.StartTime < 1 || filter.EndTime <= filter.StartTime ||
+		filter.Period < model.StatsPeriod_Day || filter.Period > model.StatsPeriod_Month {
+		log.Error(ctx, "getScoreStats err",
+			zap.String("uid", uid),
+			zap.Any("filter", filter),
+			zap.Error(ErrInvalidStatsFilter),
+		)
+		return nil, ErrInvalidStatsFilter
+	}
+
+	rows, err := dao.StatsScoreFlow(ctx, uid, filter)
+	if err != nil {
+		log.Error(ctx, "getScoreStats dao.StatsScoreFlow err",
+			zap.String("uid", uid),
+			zap.Any("filter", filter),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	ret := make([]*ScoreStats, len(rows))
+	for i, r := range rows {
+		ret[i] = &ScoreStats{
+			Bucket:       r.Bucket,
+			ScoreTypeID:  r.ScoreTypeID,
+			Domain:       r.Domain,
+			Uid:          r.Uid,
+			EarnedScore:  r.EarnedScore,
+			SpentScore:   r.SpentScore,
+			EarnedOrders: r.EarnedOrders,
+			SpentOrders:  r.SpentOrders,
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Bucket != ret[j].Bucket {
+			return ret[i].Bucket < ret[j].Bucket
+		}
+		if ret[i].ScoreTypeID != ret[j].ScoreTypeID {
+			return ret[i].ScoreTypeID < ret[j].ScoreTypeID
+		}
+		if ret[i].Domain != ret[j].Domain {
+			return ret[i].Domain < ret[j].Domain
+		}
+		return ret[i].Uid < ret[j].Uid
+	})
+	return ret, nil
+}
+
+// 获取积分类型在一个域的供应量, 包括增加/扣除的积分总值和流通中的积分
+func (s scoreCli) GetScoreTypeSupply(ctx context.Context, scoreTypeID uint32, domain string) (*ScoreSupply, error) {
+	err := s.checkRedisStore(ctx, "GetScoreTypeSupply")
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := score_type.ForceGetScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	supply, err := dao.GetScoreSupply(ctx, scoreTypeID, domain)
+	if err != nil {
+		log.Error(ctx, "GetScoreTypeSupply dao.GetScoreSupply err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return &ScoreSupply{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		Added:       supply.Added,
+		Deducted:    supply.Deducted,
+		Reset:       supply.Reset,
+		Expired:     supply.Expired,
+		Outstanding: supply.Added - supply.Deducted + supply.Reset - supply.Expired,
+	}, nil
+}
+
+// 排行榜单次查询的最大数量
+const maxLeaderboardLimit = 100
+
+// 获取启用了排行榜的积分类型
+func (scoreCli) getLeaderboardScoreType(ctx context.Context, scoreTypeID uint32) (*model.ScoreType, error) {
+	st, err := score_type.ForceGetScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Leaderboard {
+		log.Error(ctx, "getLeaderboardScoreType err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.Error(ErrLeaderboardNotEnabled),
+		)
+		return nil, ErrLeaderboardNotEnabled
+	}
+	return st, nil
+}
+
+// 获取排行榜前n名的用户, 按积分从高到低排序. 排行榜由积分变更后的副作用更新, 是最终一致的
+func (s scoreCli) GetTopN(ctx context.Context, scoreTypeID uint32, domain string, n int) ([]*RankItem, error) {
+	err := s.checkRedisStore(ctx, "GetTopN")
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := s.getLeaderboardScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return []*RankItem{}, nil
+	}
+	if n > maxLeaderboardLimit {
+		n = maxLeaderboardLimit
+	}
+
+	ret, err := dao.GetLeaderboardRange(ctx, scoreTypeID, domain, 0, int64(n-1))
+	if err != nil {
+		log.Error(ctx, "GetTopN dao.GetLeaderboardRange err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.Int("n", n),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 获取用户在排行榜中的名次, 用户不在排行榜中时 Rank 为0
+func (s scoreCli) GetRank(ctx context.Context, scoreTypeID uint32, domain string, uid string) (*RankItem, error) {
+	err := s.checkRedisStore(ctx, "GetRank")
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := s.getLeaderboardScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := dao.GetLeaderboardRank(ctx, scoreTypeID, domain, uid)
+	if err != nil {
+		log.Error(ctx, "GetRank dao.GetLeaderboardRank err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 获取用户在排行榜中前后各n名的用户(包含用户自己), 按积分从高到低排序. 用户不在排行榜中时返回空列表
+func (s scoreCli) GetAround(ctx context.Context, scoreTypeID uint32, domain string, uid string, n int) ([]*RankItem, error) {
+	self, err := s.GetRank(ctx, scoreTypeID, domain, uid)
+	if err != nil {
+		return nil, err
+	}
+	if self.Rank == 0 {
+		return []*RankItem{}, nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > maxLeaderboardLimit/2 {
+		n = maxLeaderboardLimit / 2
+	}
+
+	start := self.Rank - 1 - int64(n)
+	if start < 0 {
+		start = 0
+	}
+	stop := self.Rank - 1 + int64(n)
+	ret, err := dao.GetLeaderboardRange(ctx, scoreTypeID, domain, start, stop)
+	if err != nil {
+		log.Error(ctx, "GetAround dao.GetLeaderboardRange err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int("n", n),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 生成订单号
+func (scoreCli) GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
+	st, err := score_type.GetScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return "", err
+	}
+
+	seqNo, err := dao.GenOrderSeqNo(ctx, scoreTypeID, domain, uid)
+	if err != nil {
+		log.Error(ctx, "GenOrderSeqNo dao.GenOrderSeqNo err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return "", err
+	}
+	return seqNo, nil
+}
+
+// 增加积分. 批次模式下积分的过期时间由积分类型的 LotExpireSec 决定
+func (s scoreCli) AddScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
+	return s.addScore(ctx, scoreTypeID, domain, uid, orderID, score, defLotExpireTime, remark)
+}
+
+// 增加会过期的积分, 只能用于批次模式的积分类型. expireTime 为秒级时间戳, 0表示永不过期
+func (s scoreCli) AddScoreWithExpire(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, expireTime int64,
+	remark string) (*OrderData, error) {
+	if expireTime < 0 || (expireTime > 0 && expireTime <= time.Now().Unix()) {
+		log.Error(ctx, "AddScoreWithExpire err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Int64("expireTime", expireTime),
+			zap.Error(ErrInvalidLotExpireTime),
+		)
+		return nil, ErrInvalidLotExpireTime
+	}
+	return s.addScore(ctx, scoreTypeID, domain, uid, orderID, score, expireTime, remark)
+}
+
+// 使用积分类型配置的批次过期时间
+const defLotExpireTime = -1
+
+func (s scoreCli) addScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, lotExpireTime int64,
+	remark string) (*OrderData, error) {
+	st, err := s.checkScoreOp(ctx, model.OpType_Add, scoreTypeID, domain, uid, orderID, score)
+	if err != nil {
+		return nil, err
+	}
+	if lotExpireTime != defLotExpireTime && !st.LotMode {
+		log.Error(ctx, "AddScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.Error(ErrNotLotMode),
+		)
+		return nil, ErrNotLotMode
+	}
+	err = s.beforeScoreChange(ctx, &model.SideEffectData{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		OrderID:     orderID,
+		Uid:         uid,
+		Op:          model.OpType_Add,
+		Score:       score,
+		Remark:      remark,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opt := s.addScoreOption(st)
+	if st.LotMode {
+		switch {
+		case lotExpireTime != defLotExpireTime:
+			opt.LotExpireTime = lotExpireTime
+		case st.LotExpireSec > 0:
+			opt.LotExpireTime = time.Now().Unix() + st.LotExpireSec
+		}
+	}
+
+	// 增加积分
+	data, status, err := dao.AddScore(ctx, orderID, scoreTypeID, domain, uid, score, int64(st.OrderStatusExpireDay)*86400, opt)
+	if err != nil {
+		log.Error(ctx, "AddScore dao.AddScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	err = s.afterScoreOp(ctx, model.OpType_Add, scoreTypeID, domain, uid, orderID, score, remark, st, data, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// 批量增加积分, 返回结果与 grants 一一对应, 单个用户的失败记录在结果的 Err 中不影响其它用户.
+// 订单id为空时会批量生成, 增加积分的lua脚本通过pipeline执行, 副作用守护程序的mq数据会批量发送
+func (s scoreCli) BatchAddScore(ctx context.Context, scoreTypeID uint32, domain string, grants []*Grant) ([]*GrantResult, error) {
+	err := s.checkRedisStore(ctx, "BatchAddScore")
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := score_type.GetScoreType(ctx, scoreTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// 批量生成订单id
+	ret := make([]*GrantResult, len(grants))
+	genIndexes := make([]int, 0, len(grants))
+	genUids := make([]string, 0, len(grants))
+	for i, g := range grants {
+		if g == nil {
+			ret[i] = &GrantResult{Err: ErrInvalidGrant}
+			continue
+		}
+		ret[i] = &GrantResult{Uid: g.Uid, OrderID: g.OrderID}
+		if g.OrderID == "" {
+			genIndexes = append(genIndexes, i)
+			genUids = append(genUids, g.Uid)
+		}
+	}
+	orderIDs, err := dao.GenOrderSeqNos(ctx, scoreTypeID, domain, genUids)
+	if err != nil {
+		log.Error(ctx, "BatchAddScore dao.GenOrderSeqNos err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.Int("count", len(genUids)),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	for i, index := range genIndexes {
+		ret[index].OrderID = orderIDs[i]
+	}
+
+	// 检查参数并触发积分变更前副作用
+	ses := make([]*model.SideEffectData, len(grants))
+	fns := make([]func() error, 0, len(grants))
+	for i, g := range grants {
+		r := ret[i]
+		if r.Err != nil {
+			continue
+		}
+		if g.Score < 0 {
+			r.Err = ErrChangeScoreValueIsLessThanZero
+			continue
+		}
+		err = s.verifyOrderID(r.OrderID, scoreTypeID, domain, g.Uid, int64(st.VerifyOrderCreateLessThan))
+		if err != nil {
+			log.Error(ctx, "BatchAddScore verifyOrderID err",
+				zap.String("orderID", r.OrderID),
+				zap.Uint32("scoreTypeID", scoreTypeID),
+				zap.String("scoreName", st.ScoreName),
+				zap.String("domain", domain),
+				zap.String("uid", g.Uid),
+				zap.Error(err),
+			)
+			r.Err = err
+			continue
+		}
+
+		se := &model.SideEffectData{
+			Type:        model.SideEffectType_BeforeScoreChange,
+			ScoreTypeID: scoreTypeID,
+			Domain:      domain,
+			OrderID:     r.OrderID,
+			Uid:         g.Uid,
+			Op:          model.OpType_Add,
+			Score:       g.Score,
+			Remark:      g.Remark,
+			OpTime:      time.Now().UnixMilli(),
+		}
+		ses[i] = se
+		fns = append(fns, func() error {
+			r.Err = side_effect.TriggerSideEffect(ctx, se)
+			return nil
+		})
+	}
+	_ = gpool.GetDefGPool().GoAndWait(fns...)
+
+	// 添加副作用守护程序
+	items := make([]*dao.BatchAddScoreItem, 0, len(grants))
+	indexes := make([]int, 0, len(grants))
+	afterDatas := make([]*model.SideEffectData, 0, len(grants))
+	for i, se := range ses {
+		if se == nil || ret[i].Err != nil {
+			continue
+		}
+		afterData := *se
+		afterData.Type = model.SideEffectType_AfterScoreChange
+		afterDatas = append(afterDatas, &afterData)
+		items = append(items, &dao.BatchAddScoreItem{Uid: se.Uid, OrderID: se.OrderID, Score: se.Score})
+		indexes = append(indexes, i)
+	}
+	err = side_effect.AddSideEffectDaemons(ctx, afterDatas)
+	if err != nil {
+		log.Error(ctx, "BatchAddScore call side_effect.AddSideEffectDaemons fail.", zap.Int("count", len(afterDatas)), zap.Error(err))
+		return nil, err
+	}
+
+	opt := s.addScoreOption(st)
+	if st.LotMode && st.LotExpireSec > 0 {
+		opt.LotExpireTime = time.Now().Unix() + st.LotExpireSec
+	}
+
+	// 批量增加积分
+	results, err := dao.BatchAddScore(ctx, scoreTypeID, domain, items, int64(st.OrderStatusExpireDay)*86400, opt)
+	if err != nil {
+		log.Error(ctx, "BatchAddScore dao.BatchAddScore err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.Int("count", len(items)),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	afters := make([]*model.SideEffectData, 0, len(results))
+	orderDatas := make([]*model.OrderData, 0, len(results))
+	orderStatuses := make([]model.OrderStatus, 0, len(results))
+	for j, result := range results {
+		i := indexes[j]
+		r := ret[i]
+		if result.Err != nil {
+			log.Error(ctx, "BatchAddScore dao.BatchAddScore item err",
+				zap.String("orderID", r.OrderID),
+				zap.Uint32("scoreTypeID", scoreTypeID),
+				zap.String("scoreName", st.ScoreName),
+				zap.String("domain", domain),
+				zap.String("uid", r.Uid),
+				zap.Error(result.Err),
+			)
+			r.Err = result.Err
+			continue
+		}
+		r.Data, r.Status = result.Data, result.Status
+
+		// 检查重入时参数发生了变化
+		err = s.checkReentryParamsIsChanged(result.Data, ses[i])
+		if err != nil {
+			log.Error(ctx, "BatchAddScore checkReentryParamsIsChanged err",
+				zap.String("orderID", r.OrderID),
+				zap.Uint32("scoreTypeID", scoreTypeID),
+				zap.String("scoreName", st.ScoreName),
+				zap.String("uid", r.Uid),
+				zap.Error(err),
+			)
+			r.Err = err
+			continue
+		}
+		afterData := *ses[i]
+		afterData.Type = model.SideEffectType_AfterScoreChange
+		afters = append(afters, &afterData)
+		orderDatas = append(orderDatas, result.Data)
+		orderStatuses = append(orderStatuses, result.Status)
+		r.Err = s.checkStatus(model.OpType_Add, result.Status)
+	}
+
+	// 积分变更后副作用, 副作用状态通过pipeline批量读写
+	cloneCtx := utils.Ctx.CloneContext(ctx)
+	gpool.GetDefGPool().Go(func() error {
+		return side_effect.TriggerAfterScoreChanges(cloneCtx, st, afters, orderDatas, orderStatuses)
+	}, func(err error) {
+		if err != nil {
+			log.Error(cloneCtx, "BatchAddScore call side_effect.TriggerAfterScoreChanges fail.", zap.Int("count", len(afters)), zap.Error(err))
+		}
+	})
+	return ret, nil
+}
+
+// 扣除积分
+func (s scoreCli) DeductScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
+	return s.deductScore(ctx, scoreTypeID, domain, uid, orderID, score, nil, false, remark)
+}
+
+// 部分扣除积分, 最多扣除 score, 余额不足时扣除所有可用的积分而不是返回余额不足. 订单数据中的变更值为实际扣除的积分
+func (s scoreCli) DeductScoreUpTo(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
+	return s.deductScore(ctx, scoreTypeID, domain, uid, orderID, score, nil, true, remark)
+}
+
+// 扣除积分, 只有当前余额等于 expectedOldScore 时才会扣除, 否则订单状态为余额已变化
+func (s scoreCli) DeductScoreCAS(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, expectedOldScore int64,
+	remark string) (*OrderData, error) {
+	return s.deductScore(ctx, scoreTypeID, domain, uid, orderID, score, &expectedOldScore, false, remark)
+}
+
+func (s scoreCli) deductScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, expectedOldScore *int64,
+	upTo bool, remark string) (*OrderData, error) {
+	st, err := s.checkScoreOp(ctx, model.OpType_Deduct, scoreTypeID, domain, uid, orderID, score)
+	if err != nil {
+		return nil, err
+	}
+	se := &model.SideEffectData{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		OrderID:     orderID,
+		Uid:         uid,
+		Op:          model.OpType_Deduct,
+		Score:       score,
+		Remark:      remark,
+		UpTo:        upTo,
+	}
+	err = s.beforeScoreChange(ctx, se)
+	if err != nil {
+		return nil, err
+	}
+
+	opt := s.addScoreOption(st)
+	opt.ExpectedOldScore = expectedOldScore
+	opt.UpTo = upTo
+	if st.NoLockOnInsufficient {
+		opt.RejectedOrderID = dao.GenRejectedOrderID(orderID)
+	}
+
+	// 扣除积分
+	data, status, err := dao.AddScore(ctx, orderID, scoreTypeID, domain, uid, -score, int64(st.OrderStatusExpireDay)*86400, opt)
+	if err != nil {
+		log.Error(ctx, "DeductScore dao.AddScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	// 余额不足时订单没有被锁定, 使用本次尝试的订单id记录流水和副作用
+	if status == model.OrderStatus_InsufficientBalance && !data.IsReentry && opt.RejectedOrderID != "" {
+		se.LinkOrderID = se.OrderID
+		se.OrderID = opt.RejectedOrderID
+		afterData := *se
+		afterData.Type = model.SideEffectType_AfterScoreChange
+		err = side_effect.AddSideEffectDaemon(ctx, &afterData)
+		if err != nil {
+			log.Error(ctx, "DeductScore call side_effect.AddSideEffectDaemon fail.", zap.Any("data", se), zap.Error(err))
+		}
+	}
+
+	err = s.afterScoreChange(ctx, st, se, data, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// 重设积分
+func (s scoreCli) ResetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
+	return s.resetScore(ctx, scoreTypeID, domain, uid, orderID, score, nil, remark)
+}
+
+// 重设积分, 只有当前余额等于 expectedOldScore 时才会重设, 否则订单状态为余额已变化
+func (s scoreCli) ResetScoreCAS(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, expectedOldScore int64,
+	remark string) (*OrderData, error) {
+	return s.resetScore(ctx, scoreTypeID, domain, uid, orderID, score, &expectedOldScore, remark)
+}
+
+func (s scoreCli) resetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, expectedOldScore *int64,
+	remark string) (*OrderData, error) {
+	st, err := s.beforeScoreOp(ctx, model.OpType_Reset, scoreTypeID, domain, uid, orderID, score, remark)
+	if err != nil {
+		return nil, err
+	}
+
+	// 重设积分
+	data, status, err := dao.ResetScore(ctx, orderID, scoreTypeID, domain, uid, score, int64(st.OrderStatusExpireDay)*86400, st.MaxBalance, expectedOldScore)
+	if err != nil {
+		log.Error(ctx, "ResetScore dao.ResetScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	err = s.afterScoreOp(ctx, model.OpType_Reset, scoreTypeID, domain, uid, orderID, score, remark, st, data, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// 转账, 从 fromUid 扣除积分后增加到 toUid. 转入方使用 GenTransferInOrderID(orderID) 作为订单id记录订单状态和流水.
+// 不检查周期配额且余额不足时总是锁定订单, 积分类型配置了对应操作的周期配额时返回 ErrQuotaNotSupported, 扣除的积分类型配置了 NoLockOnInsufficient 时返回 ErrNoLockNotSupported
+func (s scoreCli) TransferScore(ctx context.Context, scoreTypeID uint32, domain string, fromUid string, toUid string, orderID string, score int64,
+	remark string) (*OrderData, *OrderData, error) {
+	err := s.checkRedisStore(ctx, "TransferScore")
+	if err != nil {
+		return nil, nil, err
+	}
+	if fromUid == toUid {
+		log.Error(ctx, "TransferScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("fromUid", fromUid),
+			zap.String("toUid", toUid),
+			zap.Error(ErrTransferToSelf),
+		)
+		return nil, nil, ErrTransferToSelf
+	}
+
+	// 订单id由转出方生成
+	st, err := s.checkScoreOp(ctx, model.OpType_Deduct, scoreTypeID, domain, fromUid, orderID, score)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkLotModeNotSupported(ctx, "TransferScore", st)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkQuotaNotSupported(ctx, "TransferScore", model.OpType_Deduct, st)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkQuotaNotSupported(ctx, "TransferScore", model.OpType_Add, st)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = dao.CheckTransferScore(orderID, scoreTypeID, domain, fromUid, toUid)
+	if err != nil {
+		log.Error(ctx, "TransferScore dao.CheckTransferScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("fromUid", fromUid),
+			zap.String("toUid", toUid),
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+
+	inOrderID := dao.GenTransferInOrderID(orderID)
+	fromSE := &model.SideEffectData{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		OrderID:     orderID,
+		Uid:         fromUid,
+		Op:          model.OpType_Deduct,
+		Score:       score,
+		Remark:      remark,
+		LinkOrderID: inOrderID,
+	}
+	toSE := &model.SideEffectData{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		OrderID:     inOrderID,
+		Uid:         toUid,
+		Op:          model.OpType_Add,
+		Score:       score,
+		Remark:      remark,
+		LinkOrderID: orderID,
+	}
+	for _, data := range []*model.SideEffectData{fromSE, toSE} {
+		err = s.beforeScoreChange(ctx, data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 转账
+	fromData, toData, status, err := dao.TransferScore(ctx, orderID, scoreTypeID, domain, fromUid, toUid, score, int64(st.OrderStatusExpireDay)*86400,
+		st.MinBalance, st.MaxBalance)
+	if err != nil {
+		log.Error(ctx, "TransferScore dao.TransferScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("fromUid", fromUid),
+			zap.String("toUid", toUid),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+
+	// 双方的副作用都需要触发
+	toErr := s.afterScoreChange(ctx, st, toSE, toData, status)
+	err = s.afterScoreChange(ctx, st, fromSE, fromData, status)
+	if err != nil {
+		return nil, nil, err
+	}
+	if toErr != nil {
+		return nil, nil, toErr
+	}
+
+	return fromData, toData, nil
+}
+
+// 兑换, 扣除用户 fromScoreTypeID 积分类型的积分, 根据兑换比例增加 toScoreTypeID 积分类型的积分.
+// 订单id由源积分类型生成, 目标积分类型使用 GenTransferInOrderID(orderID) 作为订单id记录订单状态和流水.
+// 不检查周期配额且余额不足时总是锁定订单, 积分类型配置了对应操作的周期配额时返回 ErrQuotaNotSupported, 扣除的积分类型配置了 NoLockOnInsufficient 时返回 ErrNoLockNotSupported
+func (s scoreCli) ExchangeScore(ctx context.Context, fromScoreTypeID uint32, fromDomain string, toScoreTypeID uint32, toDomain string, uid string,
+	orderID string, score int64, remark string) (*OrderData, *OrderData, error) {
+	err := s.checkRedisStore(ctx, "ExchangeScore")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := s.checkScoreOp(ctx, model.OpType_Deduct, fromScoreTypeID, fromDomain, uid, orderID, score)
+	if err != nil {
+		return nil, nil, err
+	}
+	toSt, err := score_type.GetScoreType(ctx, toScoreTypeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkLotModeNotSupported(ctx, "ExchangeScore", st, toSt)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkQuotaNotSupported(ctx, "ExchangeScore", model.OpType_Deduct, st)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkQuotaNotSupported(ctx, "ExchangeScore", model.OpType_Add, toSt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 计算兑换结果
+	toScore, err := score_type.CalculateExchangeScore(st, toScoreTypeID, score)
+	if err != nil {
+		log.Error(ctx, "ExchangeScore CalculateExchangeScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("fromScoreTypeID", fromScoreTypeID),
+			zap.String("fromScoreName", st.ScoreName),
+			zap.Uint32("toScoreTypeID", toScoreTypeID),
+			zap.String("toScoreName", toSt.ScoreName),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+
+	inOrderID := dao.GenTransferInOrderID(orderID)
+	fromSE := &model.SideEffectData{
+		ScoreTypeID: fromScoreTypeID,
+		Domain:      fromDomain,
+		OrderID:     orderID,
+		Uid:         uid,
+		Op:          model.OpType_Deduct,
+		Score:       score,
+		Remark:      remark,
+		LinkOrderID: inOrderID,
+	}
+	toSE := &model.SideEffectData{
+		ScoreTypeID: toScoreTypeID,
+		Domain:      toDomain,
+		OrderID:     inOrderID,
+		Uid:         uid,
+		Op:          model.OpType_Add,
+		Score:       toScore,
+		Remark:      remark,
+		LinkOrderID: orderID,
+	}
+	for _, data := range []*model.SideEffectData{fromSE, toSE} {
+		err = s.beforeScoreChange(ctx, data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 兑换
+	fromData, toData, status, err := dao.ExchangeScore(ctx, orderID, fromScoreTypeID, fromDomain, toScoreTypeID, toDomain, uid, score, toScore,
+		int64(st.OrderStatusExpireDay)*86400, st.MinBalance, toSt.MaxBalance)
+	if err != nil {
+		log.Error(ctx, "ExchangeScore dao.ExchangeScore err",
+			zap.String("orderID", orderID),
+			zap.Uint32("fromScoreTypeID", fromScoreTypeID),
+			zap.String("fromScoreName", st.ScoreName),
+			zap.String("fromDomain", fromDomain),
+			zap.Uint32("toScoreTypeID", toScoreTypeID),
+			zap.String("toScoreName", toSt.ScoreName),
+			zap.String("toDomain", toDomain),
+			zap.String("uid", uid),
+			zap.Int64("score", score),
+			zap.Int64("toScore", toScore),
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+
+	// 重入时以第一次兑换的结果为准, 兑换比例可能已经被修改
+	if toData.IsReentry {
+		toSE.Score = toData.ChangeScore
+	}
+
+	// 双方的副作用都需要触发
+	toErr := s.afterScoreChange(ctx, toSt, toSE, toData, status)
+	err = s.afterScoreChange(ctx, st, fromSE, fromData, status)
+	if err != nil {
+		return nil, nil, err
+	}
+	if toErr != nil {
+		return nil, nil, toErr
+	}
+
+	return fromData, toData, nil
+}
+
+// 多积分类型原子操作, 对同一个用户的多个积分类型/域同时增加或扣除积分, 全部成功或全部失败.
+// 订单id由第一个分项的积分类型和域生成, 每个分项使用 GenMultiOpOrderID(orderID, i) 作为订单id记录订单状态和流水. 返回每个分项的订单数据.
+// 不检查周期配额且余额不足时总是锁定订单, 积分类型配置了对应操作的周期配额时返回 ErrQuotaNotSupported, 扣除的积分类型配置了 NoLockOnInsufficient 时返回 ErrNoLockNotSupported
+func (s scoreCli) MultiOp(ctx context.Context, uid string, orderID string, legs []*MultiOpLeg, remark string) ([]*OrderData, error) {
+	err := s.checkRedisStore(ctx, "MultiOp")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkMultiOpLegs(legs)
+	if err != nil {
+		log.Error(ctx, "MultiOp checkMultiOpLegs err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Any("legs", legs),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	// 订单id由第一个分项生成
+	sts := make([]*model.ScoreType, len(legs))
+	sts[0], err = s.checkScoreOp(ctx, legs[0].Op, legs[0].ScoreTypeID, legs[0].Domain, uid, orderID, legs[0].Score)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(legs); i++ {
+		sts[i], err = score_type.GetScoreType(ctx, legs[i].ScoreTypeID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = s.checkLotModeNotSupported(ctx, "MultiOp", sts...)
+	if err != nil {
+		return nil, err
+	}
+	for i, leg := range legs {
+		err = s.checkQuotaNotSupported(ctx, "MultiOp", leg.Op, sts[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ses := make([]*model.SideEffectData, len(legs))
+	daoLegs := make([]*dao.MultiOpLeg, len(legs))
+	var statusExpireSec int64
+	for i, leg := range legs {
+		ses[i] = &model.SideEffectData{
+			ScoreTypeID: leg.ScoreTypeID,
+			Domain:      leg.Domain,
+			OrderID:     dao.GenMultiOpOrderID(orderID, i),
+			Uid:         uid,
+			Op:          leg.Op,
+			Score:       leg.Score,
+			Remark:      remark,
+		}
+		if i > 0 {
+			ses[i].LinkOrderID = orderID
+		}
+
+		st := sts[i]
+		daoLegs[i] = &dao.MultiOpLeg{
+			ScoreTypeID: leg.ScoreTypeID,
+			Domain:      leg.Domain,
+			Op:          leg.Op,
+			Score:       leg.Score,
+			MinScore:    st.MinBalance,
+			MaxScore:    st.MaxBalance,
+		}
+		// 使用最长的订单状态有效期
+		if ex := int64(st.OrderStatusExpireDay) * 86400; ex > statusExpireSec {
+			statusExpireSec = ex
+		}
+	}
+	for _, data := range ses {
+		err = s.beforeScoreChange(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	datas, status, err := dao.MultiOp(ctx, orderID, uid, daoLegs, statusExpireSec)
+	if err != nil {
+		log.Error(ctx, "MultiOp dao.MultiOp err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Any("legs", legs),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	for i, data := range ses {
+		err = s.afterScoreChange(ctx, sts[i], data, datas[i], status)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return datas, nil
+}
+
+// 按优先级扣除积分, 按 sources 的顺序消耗各个积分类型/域的余额直到扣完, 只有所有来源的可用积分总和不足时才返回余额不足.
+// 订单id由第一个来源的积分类型和域生成, 每个来源使用 GenMultiOpOrderID(orderID, i) 作为订单id记录订单状态和流水.
+// 返回每个来源的订单数据, ChangeScore 为从这个来源实际扣除的积分.
+// 不检查周期配额且余额不足时总是锁定订单, 积分类型配置了对应操作的周期配额时返回 ErrQuotaNotSupported, 扣除的积分类型配置了 NoLockOnInsufficient 时返回 ErrNoLockNotSupported
+func (s scoreCli) DeductScoreByPriority(ctx context.Context, uid string, orderID string, sources []*DeductSource, score int64, remark string) ([]*OrderData, error) {
+	err := s.checkRedisStore(ctx, "DeductScoreByPriority")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDeductSources(sources)
+	if err != nil {
+		log.Error(ctx, "DeductScoreByPriority checkDeductSources err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Any("sources", sources),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	// 订单id由第一个来源生成
+	sts := make([]*model.ScoreType, len(sources))
+	sts[0], err = s.checkScoreOp(ctx, model.OpType_Deduct, sources[0].ScoreTypeID, sources[0].Domain, uid, orderID, score)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(sources); i++ {
+		sts[i], err = score_type.GetScoreType(ctx, sources[i].ScoreTypeID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = s.checkLotModeNotSupported(ctx, "DeductScoreByPriority", sts...)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkQuotaNotSupported(ctx, "DeductScoreByPriority", model.OpType_Deduct, sts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ses := make([]*model.SideEffectData, len(sources))
+	daoSources := make([]*dao.PriorityDeductSource, len(sources))
+	var statusExpireSec int64
+	for i, src := range sources {
+		// 每个来源实际扣除的积分不大于请求扣除的积分
+		ses[i] = &model.SideEffectData{
+			ScoreTypeID: src.ScoreTypeID,
+			Domain:      src.Domain,
+			OrderID:     dao.GenMultiOpOrderID(orderID, i),
+			Uid:         uid,
+			Op:          model.OpType_Deduct,
+			Score:       score,
+			Remark:      remark,
+			UpTo:        true,
+		}
+		if i > 0 {
+			ses[i].LinkOrderID = orderID
+		}
+
+		st := sts[i]
+		daoSources[i] = &dao.PriorityDeductSource{
+			ScoreTypeID: src.ScoreTypeID,
+			Domain:      src.Domain,
+			MinScore:    st.MinBalance,
+		}
+		// 使用最长的订单状态有效期
+		if ex := int64(st.OrderStatusExpireDay) * 86400; ex > statusExpireSec {
+			statusExpireSec = ex
+		}
+	}
+	for _, data := range ses {
+		err = s.beforeScoreChange(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	datas, status, err := dao.PriorityDeduct(ctx, orderID, uid, daoSources, score, statusExpireSec)
+	if err != nil {
+		log.Error(ctx, "DeductScoreByPriority dao.PriorityDeduct err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Any("sources", sources),
+			zap.Int64("score", score),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	for i, data := range ses {
+		err = s.afterScoreChange(ctx, sts[i], data, datas[i], status)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return datas, nil
+}
+
+// 检查按优先级扣除积分的积分来源, 至少有一个来源, 且不能有相同的积分类型和域
+func (scoreCli) checkDeductSources(sources []*DeductSource) error {
+	if len(sources) == 0 {
+		return ErrInvalidDeductSources
+	}
+	type stDomain struct {
+		scoreTypeID uint32
+		domain      string
+	}
+	exists := make(map[stDomain]struct{}, len(sources))
+	for _, src := range sources {
+		if src == nil {
+			return ErrInvalidDeductSources
+		}
+		k := stDomain{src.ScoreTypeID, src.Domain}
+		if _, ok := exists[k]; ok {
+			return ErrInvalidDeductSources
+		}
+		exists[k] = struct{}{}
+	}
+	return nil
+}
+
+// 检查多积分类型原子操作的分项, 至少有一个分项, 只支持增加和扣除, 且不能有相同的积分类型和域
+func (scoreCli) checkMultiOpLegs(legs []*MultiOpLeg) error {
+	if len(legs) == 0 {
+		return ErrInvalidMultiOpLegs
+	}
+	type stDomain struct {
+		scoreTypeID uint32
+		domain      string
+	}
+	exists := make(map[stDomain]struct{}, len(legs))
+	for _, leg := range legs {
+		if leg == nil || (leg.Op != model.OpType_Add && leg.Op != model.OpType_Deduct) {
+			return ErrInvalidMultiOpLegs
+		}
+		if leg.Score < 0 {
+			return ErrChangeScoreValueIsLessThanZero
+		}
+		k := stDomain{leg.ScoreTypeID, leg.Domain}
+		if _, ok := exists[k]; ok {
+			return ErrInvalidMultiOpLegs
+		}
+		exists[k] = struct{}{}
+	}
+	return nil
+}
+
+// 冲正订单, 对原订单做相反的操作: 增加的积分会被扣除, 扣除的积分会被返还, 重置的积分会恢复为重置前的值.
+// 冲正成功后原订单的状态变为已冲正, 一个订单只能冲正一次. 返回冲正订单的订单数据
+func (s scoreCli) ReverseOrder(ctx context.Context, scoreTypeID uint32, domain string, uid string, originOrderID string, orderID string, remark string) (*OrderData, error) {
+	err := s.checkRedisStore(ctx, "ReverseOrder")
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查原订单
+	_, err = s.verifyOrderIDOwner(originOrderID, scoreTypeID, domain, uid)
+	if err != nil {
+		log.Error(ctx, "ReverseOrder verifyOrderIDOwner err",
+			zap.String("originOrderID", originOrderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	originData, originStatus, err := dao.GetOrderStatus(ctx, originOrderID, uid)
+	if err != nil {
+		log.Error(ctx, "ReverseOrder dao.GetOrderStatus err",
+			zap.String("originOrderID", originOrderID),
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	// 冲正操作
+	op, score, err := s.reverseOp(originData, originStatus)
+	if err == ErrOrderReversed {
+		// 使用相同的订单id重试时由lua脚本返回冲正订单的结果
+		_, _, err = dao.GetOrderStatus(ctx, orderID, uid)
+		if err == nil {
+			op, score, err = s.reverseOp(originData, model.OrderStatus_Finish)
+		} else if err == ErrOrderNotFound {
+			err = ErrOrderReversed
+		}
+	}
+	if err == nil {
+		// 转账/兑换/多积分类型原子操作/按优先级扣除的订单只是整个操作的一部分, 不允许冲正
+		var linked bool
+		linked, err = dao.IsLinkedOrder(ctx, originOrderID, uid)
+		if err == nil && linked {
+			err = ErrOrderNotReversible
+		}
+	}
 	if err != nil {
-		log.Error(ctx, "GetScore dao.GetScore err",
+		log.Error(ctx, "ReverseOrder reverseOp err",
+			zap.String("originOrderID", originOrderID),
 			zap.Uint32("scoreTypeID", scoreTypeID),
-			zap.String("scoreName", st.ScoreName),
 			zap.String("domain", domain),
 			zap.String("uid", uid),
+			zap.Any("originData", originData),
+			zap.Int8("originStatus", int8(originStatus)),
 			zap.Error(err),
 		)
-		return 0, err
+		return nil, err
 	}
-	return score, nil
-}
 
-// 生成订单号
-func (scoreCli) GenOrderSeqNo(ctx context.Context, scoreTypeID uint32, domain string, uid string) (string, error) {
-	st, err := score_type.GetScoreType(ctx, scoreTypeID)
+	st, err := s.checkScoreOp(ctx, op, scoreTypeID, domain, uid, orderID, score)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	err = s.checkLotModeNotSupported(ctx, "ReverseOrder", st)
+	if err != nil {
+		return nil, err
+	}
+	se := &model.SideEffectData{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		OrderID:     orderID,
+		Uid:         uid,
+		Op:          op,
+		Score:       score,
+		Remark:      remark,
+		LinkOrderID: originOrderID,
+	}
+	err = s.beforeScoreChange(ctx, se)
+	if err != nil {
+		return nil, err
 	}
 
-	seqNo, err := dao.GenOrderSeqNo(ctx, scoreTypeID, domain, uid)
+	rejectedOrderID := ""
+	if op == model.OpType_Deduct && st.NoLockOnInsufficient {
+		rejectedOrderID = dao.GenRejectedOrderID(orderID)
+	}
+	data, status, err := dao.ReverseOrder(ctx, originOrderID, orderID, scoreTypeID, domain, uid, int64(st.OrderStatusExpireDay)*86400,
+		st.MinBalance, st.MaxBalance, rejectedOrderID)
 	if err != nil {
-		log.Error(ctx, "GenOrderSeqNo dao.GenOrderSeqNo err",
+		log.Error(ctx, "ReverseOrder dao.ReverseOrder err",
+			zap.String("originOrderID", originOrderID),
+			zap.String("orderID", orderID),
 			zap.Uint32("scoreTypeID", scoreTypeID),
 			zap.String("scoreName", st.ScoreName),
 			zap.String("domain", domain),
 			zap.String("uid", uid),
 			zap.Error(err),
 		)
-		return "", err
+		return nil, err
 	}
-	return seqNo, nil
+
+	// 余额不足时冲正订单没有被锁定, 使用本次尝试的订单id记录流水和副作用
+	if status == model.OrderStatus_InsufficientBalance && !data.IsReentry && rejectedOrderID != "" {
+		se.OrderID = rejectedOrderID
+		afterData := *se
+		afterData.Type = model.SideEffectType_AfterScoreChange
+		err = side_effect.AddSideEffectDaemon(ctx, &afterData)
+		if err != nil {
+			log.Error(ctx, "ReverseOrder call side_effect.AddSideEffectDaemon fail.", zap.Any("data", se), zap.Error(err))
+		}
+	}
+
+	err = s.afterScoreChange(ctx, st, se, data, status)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-// 增加积分
-func (s scoreCli) AddScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
-	st, err := s.beforeScoreOp(ctx, model.OpType_Add, scoreTypeID, domain, uid, orderID, score, remark)
+// 根据原订单获取冲正的操作类型和变更值
+func (scoreCli) reverseOp(originData *model.OrderData, originStatus model.OrderStatus) (model.OpType, int64, error) {
+	if originStatus == model.OrderStatus_Reversed {
+		return 0, 0, ErrOrderReversed
+	}
+	if originStatus != model.OrderStatus_Finish {
+		return 0, 0, ErrOrderNotReversible
+	}
+	switch originData.OpType {
+	case model.OpType_Add:
+		return model.OpType_Deduct, originData.ChangeScore, nil
+	case model.OpType_Deduct:
+		return model.OpType_Add, originData.ChangeScore, nil
+	case model.OpType_Reset:
+		return model.OpType_Reset, originData.OldScore, nil
+	}
+	return 0, 0, ErrOrderNotReversible
+}
+
+// 冻结积分, 冻结的积分会从余额中扣除, 之后需要使用冻结时的订单id确认冻结或取消冻结. 冻结超时后会自动取消冻结
+func (s scoreCli) FreezeScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
+	err := s.checkRedisStore(ctx, "FreezeScore")
 	if err != nil {
 		return nil, err
 	}
 
-	// 增加积分
-	data, status, err := dao.AddScore(ctx, orderID, scoreTypeID, domain, uid, score, int64(st.OrderStatusExpireDay)*86400)
+	st, err := s.beforeScoreOp(ctx, model.OpType_Freeze, scoreTypeID, domain, uid, orderID, score, remark)
 	if err != nil {
-		log.Error(ctx, "AddScore dao.AddScore err",
+		return nil, err
+	}
+
+	deadline := int64(0)
+	if st.FrozenTimeoutSec > 0 {
+		deadline = time.Now().Unix() + int64(st.FrozenTimeoutSec)
+	}
+
+	// 冻结积分
+	data, status, err := dao.FreezeScore(ctx, orderID, scoreTypeID, domain, uid, score, int64(st.OrderStatusExpireDay)*86400, deadline, st.MinBalance)
+	if err != nil {
+		log.Error(ctx, "FreezeScore dao.FreezeScore err",
 			zap.String("orderID", orderID),
 			zap.Uint32("scoreTypeID", scoreTypeID),
 			zap.String("scoreName", st.ScoreName),
@@ -90,7 +1516,7 @@ func (s scoreCli) AddScore(ctx context.Context, scoreTypeID uint32, domain strin
 		return nil, err
 	}
 
-	err = s.afterScoreOp(ctx, model.OpType_Add, scoreTypeID, domain, uid, orderID, score, remark, st, data, status)
+	err = s.afterScoreOp(ctx, model.OpType_Freeze, scoreTypeID, domain, uid, orderID, score, remark, st, data, status)
 	if err != nil {
 		return nil, err
 	}
@@ -98,64 +1524,132 @@ func (s scoreCli) AddScore(ctx context.Context, scoreTypeID uint32, domain strin
 	return data, nil
 }
 
-// 扣除积分
-func (s scoreCli) DeductScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
-	st, err := s.beforeScoreOp(ctx, model.OpType_Deduct, scoreTypeID, domain, uid, orderID, score, remark)
+// 确认冻结, orderID 为冻结积分时的订单id. 如果冻结已超时则会取消冻结并返回 ErrFrozenCancelled
+func (s scoreCli) ConfirmFrozen(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, remark string) (*OrderData, error) {
+	err := s.checkRedisStore(ctx, "ConfirmFrozen")
 	if err != nil {
 		return nil, err
 	}
 
-	// 扣除积分
-	data, status, err := dao.AddScore(ctx, orderID, scoreTypeID, domain, uid, -score, int64(st.OrderStatusExpireDay)*86400)
+	st, err := s.checkScoreOp(ctx, model.OpType_ConfirmFrozen, scoreTypeID, domain, uid, orderID, 0)
 	if err != nil {
-		log.Error(ctx, "DeductScore dao.AddScore err",
+		return nil, err
+	}
+	return s.settleFrozen(ctx, st, model.OpType_ConfirmFrozen, domain, uid, orderID, remark)
+}
+
+// 取消冻结, orderID 为冻结积分时的订单id, 冻结的积分会返还到余额中
+func (s scoreCli) CancelFrozen(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, remark string) (*OrderData, error) {
+	err := s.checkRedisStore(ctx, "CancelFrozen")
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := s.checkScoreOp(ctx, model.OpType_CancelFrozen, scoreTypeID, domain, uid, orderID, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.settleFrozen(ctx, st, model.OpType_CancelFrozen, domain, uid, orderID, remark)
+}
+
+// 确认/取消冻结
+func (s scoreCli) settleFrozen(ctx context.Context, st *model.ScoreType, op model.OpType, domain string, uid string, orderID string, remark string) (*OrderData, error) {
+	settleOrderID := dao.GenSettleFrozenOrderID(orderID, op)
+	se := &model.SideEffectData{
+		ScoreTypeID: st.ID,
+		Domain:      domain,
+		OrderID:     settleOrderID,
+		Uid:         uid,
+		Op:          op,
+		Remark:      remark,
+		LinkOrderID: orderID,
+	}
+	err := s.beforeScoreChange(ctx, se)
+	if err != nil {
+		return nil, err
+	}
+
+	data, status, err := dao.SettleFrozen(ctx, op, orderID, st.ID, domain, uid, int64(st.OrderStatusExpireDay)*86400, time.Now().Unix())
+	if err != nil {
+		log.Error(ctx, "settleFrozen dao.SettleFrozen err",
+			zap.String("opName", model.GetOpName(op)),
 			zap.String("orderID", orderID),
-			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.Uint32("scoreTypeID", st.ID),
 			zap.String("scoreName", st.ScoreName),
 			zap.String("domain", domain),
 			zap.String("uid", uid),
-			zap.Int64("score", score),
 			zap.Error(err),
 		)
 		return nil, err
 	}
+	// 变更积分值由冻结订单决定
+	se.Score = data.ChangeScore
 
-	err = s.afterScoreOp(ctx, model.OpType_Deduct, scoreTypeID, domain, uid, orderID, score, remark, st, data, status)
+	err = s.afterScoreChange(ctx, st, se, data, status)
 	if err != nil {
 		return nil, err
 	}
-
 	return data, nil
 }
 
-// 重设积分
-func (s scoreCli) ResetScore(ctx context.Context, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*OrderData, error) {
-	st, err := s.beforeScoreOp(ctx, model.OpType_Reset, scoreTypeID, domain, uid, orderID, score, remark)
+// 获取冻结中的积分
+func (s scoreCli) GetFrozenScore(ctx context.Context, scoreTypeID uint32, domain string, uid string) (int64, error) {
+	err := s.checkRedisStore(ctx, "GetFrozenScore")
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	// 重设积分
-	data, status, err := dao.ResetScore(ctx, orderID, scoreTypeID, domain, uid, score, int64(st.OrderStatusExpireDay)*86400)
+	st, err := score_type.GetScoreType(ctx, scoreTypeID)
 	if err != nil {
-		log.Error(ctx, "ResetScore dao.ResetScore err",
-			zap.String("orderID", orderID),
+		return 0, err
+	}
+
+	score, err := dao.GetFrozenScore(ctx, scoreTypeID, domain, uid)
+	if err != nil {
+		log.Error(ctx, "GetFrozenScore dao.GetFrozenScore err",
 			zap.Uint32("scoreTypeID", scoreTypeID),
 			zap.String("scoreName", st.ScoreName),
 			zap.String("domain", domain),
 			zap.String("uid", uid),
-			zap.Int64("score", score),
 			zap.Error(err),
 		)
+		return 0, err
+	}
+	return score, nil
+}
+
+// 获取未过期的积分批次, 按过期时间从早到晚排序, 只能用于批次模式的积分类型
+func (s scoreCli) GetScoreLots(ctx context.Context, scoreTypeID uint32, domain string, uid string) ([]*ScoreLot, error) {
+	err := s.checkRedisStore(ctx, "GetScoreLots")
+	if err != nil {
 		return nil, err
 	}
 
-	err = s.afterScoreOp(ctx, model.OpType_Reset, scoreTypeID, domain, uid, orderID, score, remark, st, data, status)
+	st, err := score_type.GetScoreType(ctx, scoreTypeID)
 	if err != nil {
 		return nil, err
 	}
+	if !st.LotMode {
+		log.Error(ctx, "GetScoreLots err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.Error(ErrNotLotMode),
+		)
+		return nil, ErrNotLotMode
+	}
 
-	return data, nil
+	lots, err := dao.GetScoreLots(ctx, scoreTypeID, domain, uid, time.Now().Unix())
+	if err != nil {
+		log.Error(ctx, "GetScoreLots dao.GetScoreLots err",
+			zap.Uint32("scoreTypeID", scoreTypeID),
+			zap.String("scoreName", st.ScoreName),
+			zap.String("domain", domain),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return lots, nil
 }
 
 // 获取订单状态
@@ -172,7 +1666,95 @@ func (s scoreCli) GetOrderStatus(ctx context.Context, uid string, orderID string
 	return data, status, err
 }
 
+// 增加/扣除积分选项
+func (scoreCli) addScoreOption(st *model.ScoreType) *dao.AddScoreOption {
+	opt := &dao.AddScoreOption{
+		MinScore: st.MinBalance,
+		MaxScore: st.MaxBalance,
+		Quotas:   st.Quotas,
+		LotMode:  st.LotMode,
+	}
+	// 批次模式下余额必须等于未过期批次的总和, 不允许透支
+	if st.LotMode && opt.MinScore < 0 {
+		opt.MinScore = 0
+	}
+	return opt
+}
+
+// 检查当前储存是否为redis储存, 只有redis实现的功能在注册了其它储存时返回 ErrStoreNotSupported
+func (scoreCli) checkRedisStore(ctx context.Context, method string) error {
+	err := dao.CheckRedisStore()
+	if err != nil {
+		log.Error(ctx, method+" err", zap.Error(err))
+	}
+	return err
+}
+
+// 检查积分类型是否为批次模式, 批次模式只支持增加/扣除积分
+func (scoreCli) checkLotModeNotSupported(ctx context.Context, method string, sts ...*model.ScoreType) error {
+	for _, st := range sts {
+		if st.LotMode {
+			log.Error(ctx, method+" err",
+				zap.Uint32("scoreTypeID", st.ID),
+				zap.String("scoreName", st.ScoreName),
+				zap.Error(ErrLotModeNotSupported),
+			)
+			return ErrLotModeNotSupported
+		}
+	}
+	return nil
+}
+
+// 检查积分类型是否配置了 op 操作的周期配额, 扣除时还检查是否配置了余额不足时不锁定订单.
+// 同时操作多个订单的lua脚本无法检查配额和不锁定订单, 只能拒绝
+func (scoreCli) checkQuotaNotSupported(ctx context.Context, method string, op model.OpType, sts ...*model.ScoreType) error {
+	for _, st := range sts {
+		var err error
+		for _, q := range st.Quotas {
+			if q != nil && q.Op == op {
+				err = ErrQuotaNotSupported
+				break
+			}
+		}
+		if err == nil && op == model.OpType_Deduct && st.NoLockOnInsufficient {
+			err = ErrNoLockNotSupported
+		}
+		if err != nil {
+			log.Error(ctx, method+" err",
+				zap.Uint32("scoreTypeID", st.ID),
+				zap.String("scoreName", st.ScoreName),
+				zap.Int8("op", int8(op)),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	return nil
+}
+
 func (s scoreCli) beforeScoreOp(ctx context.Context, op model.OpType, scoreTypeID uint32, domain string, uid string, orderID string, score int64, remark string) (*model.ScoreType, error) {
+	st, err := s.checkScoreOp(ctx, op, scoreTypeID, domain, uid, orderID, score)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.beforeScoreChange(ctx, &model.SideEffectData{
+		ScoreTypeID: scoreTypeID,
+		Domain:      domain,
+		OrderID:     orderID,
+		Uid:         uid,
+		Op:          op,
+		Score:       score,
+		Remark:      remark,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// 检查积分操作参数
+func (s scoreCli) checkScoreOp(ctx context.Context, op model.OpType, scoreTypeID uint32, domain string, uid string, orderID string, score int64) (*model.ScoreType, error) {
 	opName := model.GetOpName(op)
 	if score < 0 {
 		log.Error(ctx, "beforeScoreOp err",
@@ -192,6 +1774,18 @@ func (s scoreCli) beforeScoreOp(ctx context.Context, op model.OpType, scoreTypeI
 	if err != nil {
 		return nil, err
 	}
+	if op != model.OpType_Add && op != model.OpType_Deduct {
+		err = s.checkLotModeNotSupported(ctx, "beforeScoreOp "+opName, st)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if st.LotMode {
+		err = s.checkRedisStore(ctx, "beforeScoreOp "+opName)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// 检查订单id
 	err = s.verifyOrderID(orderID, scoreTypeID, domain, uid, int64(st.VerifyOrderCreateLessThan))
@@ -208,26 +1802,38 @@ func (s scoreCli) beforeScoreOp(ctx context.Context, op model.OpType, scoreTypeI
 		)
 		return nil, err
 	}
+	return st, nil
+}
 
-	// 拦截
-	data := &model.SideEffectData{
-		Type:        model.SideEffectType_BeforeScoreChange,
-		ScoreTypeID: scoreTypeID,
-		Domain:      domain,
-		OrderID:     orderID,
-		Uid:         uid,
-		Op:          op,
-		Score:       score,
-		Remark:      remark,
+// 触发积分变更前副作用, 并为积分变更后副作用添加守护程序
+func (scoreCli) beforeScoreChange(ctx context.Context, data *model.SideEffectData) error {
+	// 守护程序可能在很久之后才执行, 需要在这里记录积分变更时间
+	if data.OpTime == 0 {
+		data.OpTime = time.Now().UnixMilli()
 	}
-	err = side_effect.TriggerSideEffect(ctx, data)
+
+	// 拦截
+	data.Type = model.SideEffectType_BeforeScoreChange
+	err := side_effect.TriggerSideEffect(ctx, data)
 	if err != nil {
 		log.Error(ctx, "beforeScoreOp call side_effect.TriggerSideEffect BeforeScoreChange fail.", zap.Any("data", data), zap.Error(err))
-		return nil, err
+		return err
 	}
 
 	// 添加副作用守护程序
-	err = side_effect.AddSideEffectDaemon(ctx, &model.SideEffectData{
+	afterData := *data
+	afterData.Type = model.SideEffectType_AfterScoreChange
+	err = side_effect.AddSideEffectDaemon(ctx, &afterData)
+	if err != nil {
+		log.Error(ctx, "beforeScoreOp call mq.TriggerSendMq fail.", zap.Any("data", data), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s scoreCli) afterScoreOp(ctx context.Context, op model.OpType, scoreTypeID uint32, domain string, uid string, orderID string, score int64,
+	remark string, st *model.ScoreType, orderData *model.OrderData, orderStatus model.OrderStatus) error {
+	data := &model.SideEffectData{
 		Type:        model.SideEffectType_AfterScoreChange,
 		ScoreTypeID: scoreTypeID,
 		Domain:      domain,
@@ -236,35 +1842,36 @@ func (s scoreCli) beforeScoreOp(ctx context.Context, op model.OpType, scoreTypeI
 		Op:          op,
 		Score:       score,
 		Remark:      remark,
-	})
-	if err != nil {
-		log.Error(ctx, "beforeScoreOp call mq.TriggerSendMq fail.", zap.Any("data", data), zap.Error(err))
-		return nil, err
 	}
-
-	return st, nil
+	return s.afterScoreChange(ctx, st, data, orderData, orderStatus)
 }
 
-func (s scoreCli) afterScoreOp(ctx context.Context, op model.OpType, scoreTypeID uint32, domain string, uid string, orderID string, score int64,
-	remark string, st *model.ScoreType, orderData *model.OrderData, orderStatus model.OrderStatus) error {
+// 检查积分变更结果, 并触发积分变更后副作用
+func (s scoreCli) afterScoreChange(ctx context.Context, st *model.ScoreType, data *model.SideEffectData, orderData *model.OrderData, orderStatus model.OrderStatus) error {
+	if data.OpTime == 0 {
+		data.OpTime = time.Now().UnixMilli()
+	}
+
 	// 流水数据
 	flow := &dao.ScoreFlowModel{
-		OrderID:     orderID,
-		ScoreTypeID: scoreTypeID,
-		Domain:      domain,
+		OrderID:     data.OrderID,
+		ScoreTypeID: data.ScoreTypeID,
+		Domain:      data.Domain,
 		OpType:      uint8(orderData.OpType),
 		OpStatus:    uint8(orderStatus),
-		OldScore:    uint64(orderData.OldScore),
+		OldScore:    orderData.OldScore,
 		ChangeScore: uint64(orderData.ChangeScore),
-		ResultScore: uint64(orderData.ResultScore),
-		Uid:         uid,
-		Remark:      remark,
+		ResultScore: orderData.ResultScore,
+		Uid:         data.Uid,
+		Remark:      data.Remark,
+		LinkOrderID: data.LinkOrderID,
+		OrderTime:   time.UnixMilli(data.OpTime),
 	}
 
-	opName := model.GetOpName(op)
+	opName := model.GetOpName(data.Op)
 
 	// 检查重入时参数发生了变化
-	err := s.checkReentryParamsIsChanged(orderData, op, score)
+	err := s.checkReentryParamsIsChanged(orderData, data)
 	if err != nil {
 		log.Error(ctx, "afterScoreOp checkReentryParamsIsChanged err",
 			zap.String("opName", opName),
@@ -278,17 +1885,9 @@ func (s scoreCli) afterScoreOp(ctx context.Context, op model.OpType, scoreTypeID
 	// 副作用
 	cloneCtx := utils.Ctx.CloneContext(ctx)
 	gpool.GetDefGPool().Go(func() error {
-		data := &model.SideEffectData{
-			Type:        model.SideEffectType_AfterScoreChange,
-			ScoreTypeID: scoreTypeID,
-			Domain:      domain,
-			OrderID:     orderID,
-			Uid:         uid,
-			Op:          op,
-			Score:       score,
-			Remark:      remark,
-		}
-		return side_effect.TriggerSideEffect(cloneCtx, data)
+		afterData := *data
+		afterData.Type = model.SideEffectType_AfterScoreChange
+		return side_effect.TriggerSideEffect(cloneCtx, &afterData)
 	}, func(err error) {
 		if err != nil {
 			log.Error(cloneCtx, "afterScoreOp call side_effect.TriggerScoreChange fail.", zap.Any("flow", flow), zap.Error(err))
@@ -296,12 +1895,12 @@ func (s scoreCli) afterScoreOp(ctx context.Context, op model.OpType, scoreTypeID
 	})
 
 	// 检查状态
-	err = s.checkStatus(orderStatus)
+	err = s.checkStatus(data.Op, orderStatus)
 	if err != nil {
 		log.Error(ctx, "afterScoreOp checkStatus err",
 			zap.String("opName", opName),
 			zap.String("scoreName", st.ScoreName),
-			zap.Int64("score", score),
+			zap.Int64("score", data.Score),
 			zap.Any("flow", flow),
 			zap.Error(err),
 		)
@@ -311,33 +1910,42 @@ func (s scoreCli) afterScoreOp(ctx context.Context, op model.OpType, scoreTypeID
 }
 
 // 验证订单id
-func (scoreCli) verifyOrderID(orderID string, scoreTypeID uint32, domain string, uid string, verifyOrderIDCreateLessThan int64) error {
+func (s scoreCli) verifyOrderID(orderID string, scoreTypeID uint32, domain string, uid string, verifyOrderIDCreateLessThan int64) error {
+	ss, err := s.verifyOrderIDOwner(orderID, scoreTypeID, domain, uid)
+	if err != nil {
+		return err
+	}
+	timestamp, err := strconv.ParseInt(ss[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("orderID not parsed timestamp")
+	}
+	if time.Now().Unix() > int64(verifyOrderIDCreateLessThan)*86400+timestamp {
+		return errors.New("orderID timeout")
+	}
+	return nil
+}
+
+// 验证订单id属于这个用户的积分类型和域, 返回订单id的各个部分
+func (scoreCli) verifyOrderIDOwner(orderID string, scoreTypeID uint32, domain string, uid string) ([]string, error) {
 	ss := strings.SplitN(orderID, "_", 6)
 	if len(ss) != 6 {
-		return errors.New("orderID invalid")
+		return nil, errors.New("orderID invalid")
 	}
 
 	uidHash := crc32.ChecksumIEEE([]byte(uid))
 	uidHashHex := strconv.FormatInt(int64(uidHash), 16)
 	if ss[3] != uidHashHex {
-		return errors.New("orderID not matched uid")
+		return nil, errors.New("orderID not matched uid")
 	}
 	if ss[4] != cast.ToString(scoreTypeID) {
-		return errors.New("orderID not matched scoreTypeID")
+		return nil, errors.New("orderID not matched scoreTypeID")
 	}
 	domainHash := crc32.ChecksumIEEE([]byte(domain))
 	domainHashHex := strconv.FormatInt(int64(domainHash), 16)
 	if ss[5] != domainHashHex {
-		return errors.New("orderID not matched domain")
+		return nil, errors.New("orderID not matched domain")
 	}
-	timestamp, err := strconv.ParseInt(ss[0], 10, 64)
-	if err != nil {
-		return fmt.Errorf("orderID not parsed timestamp")
-	}
-	if time.Now().Unix() > int64(verifyOrderIDCreateLessThan)*86400+timestamp {
-		return errors.New("orderID timeout")
-	}
-	return nil
+	return ss, nil
 }
 
 /*
@@ -345,27 +1953,54 @@ func (scoreCli) verifyOrderID(orderID string, scoreTypeID uint32, domain string,
 
 在订单状态key中已经包含了 uid/orderID, 而 orderID 是根据 scoreTypeID, domain 生成的, 所以无需检查这些参数
 */
-func (scoreCli) checkReentryParamsIsChanged(data *model.OrderData, op model.OpType, changeScore int64) error {
-	if !data.IsReentry {
+func (scoreCli) checkReentryParamsIsChanged(orderData *model.OrderData, data *model.SideEffectData) error {
+	if !orderData.IsReentry {
 		return nil
 	}
 
-	if data.OpType != op {
+	if orderData.OpType != data.Op {
 		return errors.New("reentry opType is changed")
 	}
-	if data.ChangeScore != changeScore {
+	// 部分扣除时实际扣除的积分可能小于请求的积分
+	if data.UpTo {
+		if orderData.ChangeScore > data.Score {
+			return errors.New("reentry changeScore is changed")
+		}
+		return nil
+	}
+	if orderData.ChangeScore != data.Score {
 		return errors.New("reentry changeScore is changed")
 	}
 	return nil
 }
 
 // 检查状态
-func (scoreCli) checkStatus(status model.OrderStatus) error {
+func (scoreCli) checkStatus(op model.OpType, status model.OrderStatus) error {
 	switch status {
 	case model.OrderStatus_Finish:
 		return nil
 	case model.OrderStatus_InsufficientBalance:
 		return ErrInsufficientBalance
+	case model.OrderStatus_Frozen:
+		return nil
+	case model.OrderStatus_Confirmed:
+		if op == model.OpType_CancelFrozen {
+			return ErrFrozenConfirmed
+		}
+		return nil
+	case model.OrderStatus_Cancelled:
+		if op == model.OpType_ConfirmFrozen {
+			return ErrFrozenCancelled
+		}
+		return nil
+	case model.OrderStatus_Reversed:
+		return ErrOrderReversed
+	case model.OrderStatus_ExceedLimit:
+		return ErrExceedLimit
+	case model.OrderStatus_QuotaExceeded:
+		return ErrQuotaExceeded
+	case model.OrderStatus_BalanceChanged:
+		return ErrBalanceChanged
 	}
 	return fmt.Errorf("undefined status=%d", status)
 }
@@ -3,8 +3,10 @@ package score_type
 import (
 	"context"
 	"errors"
+	"math"
 	"time"
 
+	"github.com/bytedance/sonic"
 	"github.com/zly-app/utils/loopload"
 	"github.com/zly-app/zapp/log"
 	"go.uber.org/zap"
@@ -22,10 +24,25 @@ var (
 	ErrScoreTypeNotFound = errors.New("score type not found")
 	// 积分类型未生效
 	ErrScoreTypeInvalid = errors.New("score type invalid")
+	// 兑换比例不存在
+	ErrExchangeRateNotFound = errors.New("exchange rate not found")
+	// 兑换比例无效
+	ErrExchangeRateInvalid = errors.New("exchange rate invalid")
+	// 兑换积分值不能整除
+	ErrExchangeScoreNotDivisible = errors.New("exchange score not divisible")
+	// 兑换结果积分值为0
+	ErrExchangeResultIsZero = errors.New("exchange result score is zero")
+	// 兑换结果积分值溢出
+	ErrExchangeResultOverflow = errors.New("exchange result score overflow")
 )
 
 func StartLoopLoad() {
 	loader = loopload.New("score_type", func(ctx context.Context) (map[uint32]*model.ScoreType, error) {
+		// 注册的储存能提供积分类型时不再从redis/mysql加载
+		if s, ok := dao.GetStore().(dao.ScoreTypeStore); ok {
+			return s.GetAllScoreType(ctx)
+		}
+
 		if conf.Conf.ScoreTypeRedisName != "" {
 			data, err := dao.GetAllScoreTypeByRedis(ctx)
 			if err != nil {
@@ -41,6 +58,15 @@ func StartLoopLoad() {
 					EndTime:                   d.EndTime,
 					OrderStatusExpireDay:      d.OrderStatusExpireDay,
 					VerifyOrderCreateLessThan: d.VerifyOrderCreateLessThan,
+					FrozenTimeoutSec:          d.FrozenTimeoutSec,
+					MinBalance:                d.MinBalance,
+					MaxBalance:                d.MaxBalance,
+					LotMode:                   d.LotMode,
+					LotExpireSec:              d.LotExpireSec,
+					NoLockOnInsufficient:      d.NoLockOnInsufficient,
+					Leaderboard:               d.Leaderboard,
+					ExchangeRates:             d.ExchangeRates,
+					Quotas:                    d.Quotas,
 				}
 
 				if v.OrderStatusExpireDay > 0 && v.OrderStatusExpireDay < v.VerifyOrderCreateLessThan {
@@ -63,6 +89,13 @@ func StartLoopLoad() {
 				ScoreName:                 d.ScoreName,
 				OrderStatusExpireDay:      d.OrderStatusExpireDay,
 				VerifyOrderCreateLessThan: d.VerifyOrderCreateLessThan,
+				FrozenTimeoutSec:          d.FrozenTimeoutSec,
+				MinBalance:                d.MinBalance,
+				MaxBalance:                d.MaxBalance,
+				LotMode:                   d.LotMode,
+				LotExpireSec:              d.LotExpireSec,
+				NoLockOnInsufficient:      d.NoLockOnInsufficient,
+				Leaderboard:               d.Leaderboard,
 			}
 			if d.StartTime.Valid {
 				v.StartTime = d.StartTime.Time.Unix()
@@ -70,6 +103,21 @@ func StartLoopLoad() {
 			if d.EndTime.Valid {
 				v.EndTime = d.EndTime.Time.Unix()
 			}
+			// 配置错误的积分类型跳过, 不影响其它积分类型的加载
+			if d.ExchangeRates != "" {
+				err = sonic.UnmarshalString(d.ExchangeRates, &v.ExchangeRates)
+				if err != nil {
+					log.Error(ctx, "can't parse score type exchange_rates, skip it", zap.Uint32("id", d.ID), zap.String("exchange_rates", d.ExchangeRates), zap.Error(err))
+					continue
+				}
+			}
+			if d.Quotas != "" {
+				err = sonic.UnmarshalString(d.Quotas, &v.Quotas)
+				if err != nil {
+					log.Error(ctx, "can't parse score type quotas, skip it", zap.Uint32("id", d.ID), zap.String("quotas", d.Quotas), zap.Error(err))
+					continue
+				}
+			}
 
 			if v.OrderStatusExpireDay > 0 && v.OrderStatusExpireDay < v.VerifyOrderCreateLessThan {
 				v.OrderStatusExpireDay = v.VerifyOrderCreateLessThan
@@ -104,6 +152,16 @@ func ForceGetScoreType(ctx context.Context, scoreTypeID uint32) (*model.ScoreTyp
 	return st, err
 }
 
+// 是否有积分类型配置了冻结超时
+func HasFrozenTimeout(ctx context.Context) bool {
+	for _, st := range loader.Get(ctx) {
+		if st.FrozenTimeoutSec > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func getScoreType(ctx context.Context, scoreTypeID uint32, force bool) (*model.ScoreType, error) {
 	all := loader.Get(ctx)
 	st, ok := all[scoreTypeID]
@@ -129,3 +187,43 @@ func getScoreType(ctx context.Context, scoreTypeID uint32, force bool) (*model.S
 	}
 	return st, nil
 }
+
+// 计算兑换结果, 返回兑换后能得到的目标积分类型的积分值
+func CalculateExchangeScore(st *model.ScoreType, toScoreTypeID uint32, score int64) (int64, error) {
+	rate, ok := st.ExchangeRates[toScoreTypeID]
+	if !ok || rate == nil {
+		return 0, ErrExchangeRateNotFound
+	}
+	if rate.From < 1 || rate.To < 1 {
+		return 0, ErrExchangeRateInvalid
+	}
+	if score > math.MaxInt64/rate.To {
+		return 0, ErrExchangeResultOverflow
+	}
+
+	product := score * rate.To
+	ret := product / rate.From
+	remainder := product % rate.From
+	switch rate.Rounding {
+	case model.RoundingMode_Floor:
+	case model.RoundingMode_Ceil:
+		if remainder > 0 {
+			ret++
+		}
+	case model.RoundingMode_Round:
+		if remainder >= rate.From-remainder {
+			ret++
+		}
+	case model.RoundingMode_Exact:
+		if remainder > 0 {
+			return 0, ErrExchangeScoreNotDivisible
+		}
+	default:
+		return 0, ErrExchangeRateInvalid
+	}
+
+	if ret < 1 {
+		return 0, ErrExchangeResultIsZero
+	}
+	return ret, nil
+}
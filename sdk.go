@@ -14,16 +14,59 @@ const (
 type SDK interface {
 	// 获取积分
 	GetScore(ctx context.Context) (int64, error)
+	// 获取过去某个时间点的积分, t 为秒级时间戳, 通过积分流水得到, 需要开启写入积分流水
+	GetScoreAt(ctx context.Context, t int64) (int64, error)
 	// 生成订单号
 	GenOrderSeqNo(ctx context.Context) (string, error)
 	// 增加积分
 	AddScore(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error)
+	// 增加会过期的积分, 只能用于批次模式的积分类型. expireTime 为秒级时间戳, 0表示永不过期
+	AddScoreWithExpire(ctx context.Context, orderID string, score int64, expireTime int64, remark string) (*OrderData, error)
 	// 扣除积分
 	DeductScore(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error)
 	// 重设积分
 	ResetScore(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error)
+	// 部分扣除积分, 最多扣除 score, 余额不足时扣除所有可用的积分. 订单数据中的变更值为实际扣除的积分
+	DeductScoreUpTo(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error)
+	// 扣除积分, 只有当前余额等于 expectedOldScore 时才会扣除
+	DeductScoreCAS(ctx context.Context, orderID string, score int64, expectedOldScore int64, remark string) (*OrderData, error)
+	// 重设积分, 只有当前余额等于 expectedOldScore 时才会重设
+	ResetScoreCAS(ctx context.Context, orderID string, score int64, expectedOldScore int64, remark string) (*OrderData, error)
+	// 转账给 toUid, 返回转出方和转入方的订单数据
+	TransferScore(ctx context.Context, toUid string, orderID string, score int64, remark string) (*OrderData, *OrderData, error)
+	// 兑换为 toScoreTypeID 积分类型的积分, 返回源积分类型和目标积分类型的订单数据
+	ExchangeScore(ctx context.Context, toScoreTypeID uint32, toDomain string, orderID string, score int64, remark string) (*OrderData, *OrderData, error)
+	// 多积分类型原子操作, 对当前用户的多个积分类型同时增加或扣除积分, 全部成功或全部失败. 订单id由第一个分项的积分类型和域生成
+	MultiOp(ctx context.Context, orderID string, legs []*MultiOpLeg, remark string) ([]*OrderData, error)
+	// 按优先级扣除积分, 按 sources 的顺序消耗当前用户各个积分类型的余额直到扣完, 只有可用积分总和不足时才返回余额不足. 订单id由第一个来源的积分类型和域生成
+	DeductScoreByPriority(ctx context.Context, orderID string, sources []*DeductSource, score int64, remark string) ([]*OrderData, error)
 	// 获取订单状态
 	GetOrderStatus(ctx context.Context, orderID string) (*OrderData, OrderStatus, error)
+	// 冻结积分
+	FreezeScore(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error)
+	// 确认冻结, orderID 为冻结积分时的订单id
+	ConfirmFrozen(ctx context.Context, orderID string, remark string) (*OrderData, error)
+	// 取消冻结, orderID 为冻结积分时的订单id
+	CancelFrozen(ctx context.Context, orderID string, remark string) (*OrderData, error)
+	// 获取冻结中的积分
+	GetFrozenScore(ctx context.Context) (int64, error)
+	// 冲正订单, 对 originOrderID 订单做相反的操作, 返回冲正订单的订单数据
+	ReverseOrder(ctx context.Context, originOrderID string, orderID string, remark string) (*OrderData, error)
+	// 获取未过期的积分批次, 只能用于批次模式的积分类型
+	GetScoreLots(ctx context.Context) ([]*ScoreLot, error)
+	// 获取用户钱包, 返回当前用户所有积分类型/域的积分, 不受sdk的积分类型和域限制
+	GetWallet(ctx context.Context) ([]*WalletBalance, error)
+	// 查询当前积分类型和域的积分流水, 按流水id从新到旧排序. flowFilter 中的积分类型和域会被忽略.
+	// cursor 为上一页返回的 nextCursor, 为0表示从最新的流水开始. 返回的 nextCursor 为0表示没有更多数据
+	ListScoreFlow(ctx context.Context, flowFilter *ScoreFlowFilter, cursor uint64, limit int) ([]*ScoreFlow, uint64, error)
+	// 统计当前用户在当前积分类型和域的积分流水, 返回每个周期增加和扣除的积分总值及订单数. startTime/endTime 为秒级时间戳, 左闭右开
+	GetScoreStats(ctx context.Context, period StatsPeriod, startTime int64, endTime int64) ([]*ScoreStats, error)
+	// 获取当前积分类型和域排行榜前n名的用户, 积分类型需要启用排行榜
+	GetTopN(ctx context.Context, n int) ([]*RankItem, error)
+	// 获取当前用户在排行榜中的名次, 用户不在排行榜中时 Rank 为0
+	GetRank(ctx context.Context) (*RankItem, error)
+	// 获取当前用户在排行榜中前后各n名的用户(包含用户自己)
+	GetAround(ctx context.Context, n int) ([]*RankItem, error)
 }
 
 type sdkCli struct {
@@ -59,6 +102,32 @@ func (s *sdkCli) GetScore(ctx context.Context) (int64, error) {
 	return sp.Score, err
 }
 
+type reqGetScoreAt struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	T           int64
+}
+
+func (s *sdkCli) GetScoreAt(ctx context.Context, t int64) (int64, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetScoreAt")
+	r := &reqGetScoreAt{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		T:           t,
+	}
+	sp := &rspGetScore{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetScoreAt)
+		sp := rsp.(*rspGetScore)
+		var err error
+		sp.Score, err = scoreApi.GetScoreAt(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.T)
+		return err
+	})
+	return sp.Score, err
+}
+
 type rspGenOrderSeqNo struct {
 	SeqNo string
 }
@@ -114,6 +183,113 @@ func (s *sdkCli) AddScore(ctx context.Context, orderID string, score int64, rema
 	return sp.Data, err
 }
 
+type reqOSER struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	OrderID     string
+	Score       int64
+	ExpireTime  int64
+	Remark      string
+}
+
+func (s *sdkCli) AddScoreWithExpire(ctx context.Context, orderID string, score int64, expireTime int64, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "AddScoreWithExpire")
+	r := &reqOSER{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		OrderID:     orderID,
+		Score:       score,
+		ExpireTime:  expireTime,
+		Remark:      remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqOSER)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.AddScoreWithExpire(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Score, r.ExpireTime, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+func (s *sdkCli) DeductScoreUpTo(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "DeductScoreUpTo")
+	r := &reqOSR{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		OrderID:     orderID,
+		Score:       score,
+		Remark:      remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqOSR)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.DeductScoreUpTo(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Score, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+type reqCAS struct {
+	ScoreTypeID      uint32
+	Domain           string
+	Uid              string
+	OrderID          string
+	Score            int64
+	ExpectedOldScore int64
+	Remark           string
+}
+
+func (s *sdkCli) DeductScoreCAS(ctx context.Context, orderID string, score int64, expectedOldScore int64, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "DeductScoreCAS")
+	r := &reqCAS{
+		ScoreTypeID:      s.scoreTypeID,
+		Domain:           s.domain,
+		Uid:              s.uid,
+		OrderID:          orderID,
+		Score:            score,
+		ExpectedOldScore: expectedOldScore,
+		Remark:           remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqCAS)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.DeductScoreCAS(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Score, r.ExpectedOldScore, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+func (s *sdkCli) ResetScoreCAS(ctx context.Context, orderID string, score int64, expectedOldScore int64, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ResetScoreCAS")
+	r := &reqCAS{
+		ScoreTypeID:      s.scoreTypeID,
+		Domain:           s.domain,
+		Uid:              s.uid,
+		OrderID:          orderID,
+		Score:            score,
+		ExpectedOldScore: expectedOldScore,
+		Remark:           remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqCAS)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.ResetScoreCAS(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Score, r.ExpectedOldScore, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
 func (s *sdkCli) DeductScore(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error) {
 	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "DeductScore")
 	r := &reqOSR{
@@ -156,6 +332,76 @@ func (s *sdkCli) ResetScore(ctx context.Context, orderID string, score int64, re
 	return sp.Data, err
 }
 
+type reqTransfer struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	ToUid       string
+	OrderID     string
+	Score       int64
+	Remark      string
+}
+type rspTransfer struct {
+	FromData *OrderData
+	ToData   *OrderData
+}
+
+func (s *sdkCli) TransferScore(ctx context.Context, toUid string, orderID string, score int64, remark string) (*OrderData, *OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "TransferScore")
+	r := &reqTransfer{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		ToUid:       toUid,
+		OrderID:     orderID,
+		Score:       score,
+		Remark:      remark,
+	}
+	sp := &rspTransfer{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqTransfer)
+		sp := rsp.(*rspTransfer)
+		var err error
+		sp.FromData, sp.ToData, err = scoreApi.TransferScore(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.ToUid, r.OrderID, r.Score, r.Remark)
+		return err
+	})
+	return sp.FromData, sp.ToData, err
+}
+
+type reqExchange struct {
+	ScoreTypeID   uint32
+	Domain        string
+	Uid           string
+	ToScoreTypeID uint32
+	ToDomain      string
+	OrderID       string
+	Score         int64
+	Remark        string
+}
+
+func (s *sdkCli) ExchangeScore(ctx context.Context, toScoreTypeID uint32, toDomain string, orderID string, score int64, remark string) (*OrderData, *OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ExchangeScore")
+	r := &reqExchange{
+		ScoreTypeID:   s.scoreTypeID,
+		Domain:        s.domain,
+		Uid:           s.uid,
+		ToScoreTypeID: toScoreTypeID,
+		ToDomain:      toDomain,
+		OrderID:       orderID,
+		Score:         score,
+		Remark:        remark,
+	}
+	sp := &rspTransfer{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqExchange)
+		sp := rsp.(*rspTransfer)
+		var err error
+		sp.FromData, sp.ToData, err = scoreApi.ExchangeScore(ctx, r.ScoreTypeID, r.Domain, r.ToScoreTypeID, r.ToDomain, r.Uid, r.OrderID, r.Score, r.Remark)
+		return err
+	})
+	return sp.FromData, sp.ToData, err
+}
+
 type reqO struct {
 	ScoreTypeID uint32
 	Domain      string
@@ -186,6 +432,367 @@ func (s *sdkCli) GetOrderStatus(ctx context.Context, orderID string) (*OrderData
 	return sp.Data, sp.Status, err
 }
 
+func (s *sdkCli) FreezeScore(ctx context.Context, orderID string, score int64, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "FreezeScore")
+	r := &reqOSR{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		OrderID:     orderID,
+		Score:       score,
+		Remark:      remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqOSR)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.FreezeScore(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Score, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+type reqOR struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	OrderID     string
+	Remark      string
+}
+
+func (s *sdkCli) ConfirmFrozen(ctx context.Context, orderID string, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ConfirmFrozen")
+	r := &reqOR{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		OrderID:     orderID,
+		Remark:      remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqOR)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.ConfirmFrozen(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+func (s *sdkCli) CancelFrozen(ctx context.Context, orderID string, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "CancelFrozen")
+	r := &reqOR{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		OrderID:     orderID,
+		Remark:      remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqOR)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.CancelFrozen(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OrderID, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+func (s *sdkCli) GetFrozenScore(ctx context.Context) (int64, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetFrozenScore")
+	r := &reqBase{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+	}
+	sp := &rspGetScore{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqBase)
+		sp := rsp.(*rspGetScore)
+		var err error
+		sp.Score, err = scoreApi.GetFrozenScore(ctx, r.ScoreTypeID, r.Domain, r.Uid)
+		return err
+	})
+	return sp.Score, err
+}
+
+type reqMultiOp struct {
+	Uid     string
+	OrderID string
+	Legs    []*MultiOpLeg
+	Remark  string
+}
+type rspMultiD struct {
+	Data []*OrderData
+}
+
+func (s *sdkCli) MultiOp(ctx context.Context, orderID string, legs []*MultiOpLeg, remark string) ([]*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "MultiOp")
+	r := &reqMultiOp{
+		Uid:     s.uid,
+		OrderID: orderID,
+		Legs:    legs,
+		Remark:  remark,
+	}
+	sp := &rspMultiD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqMultiOp)
+		sp := rsp.(*rspMultiD)
+		var err error
+		sp.Data, err = scoreApi.MultiOp(ctx, r.Uid, r.OrderID, r.Legs, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+type reqDeductByPriority struct {
+	Uid     string
+	OrderID string
+	Sources []*DeductSource
+	Score   int64
+	Remark  string
+}
+
+func (s *sdkCli) DeductScoreByPriority(ctx context.Context, orderID string, sources []*DeductSource, score int64, remark string) ([]*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "DeductScoreByPriority")
+	r := &reqDeductByPriority{
+		Uid:     s.uid,
+		OrderID: orderID,
+		Sources: sources,
+		Score:   score,
+		Remark:  remark,
+	}
+	sp := &rspMultiD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqDeductByPriority)
+		sp := rsp.(*rspMultiD)
+		var err error
+		sp.Data, err = scoreApi.DeductScoreByPriority(ctx, r.Uid, r.OrderID, r.Sources, r.Score, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+type reqReverse struct {
+	ScoreTypeID   uint32
+	Domain        string
+	Uid           string
+	OriginOrderID string
+	OrderID       string
+	Remark        string
+}
+
+func (s *sdkCli) ReverseOrder(ctx context.Context, originOrderID string, orderID string, remark string) (*OrderData, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ReverseOrder")
+	r := &reqReverse{
+		ScoreTypeID:   s.scoreTypeID,
+		Domain:        s.domain,
+		Uid:           s.uid,
+		OriginOrderID: originOrderID,
+		OrderID:       orderID,
+		Remark:        remark,
+	}
+	sp := &rspD{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqReverse)
+		sp := rsp.(*rspD)
+		var err error
+		sp.Data, err = scoreApi.ReverseOrder(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.OriginOrderID, r.OrderID, r.Remark)
+		return err
+	})
+	return sp.Data, err
+}
+
+type rspGetScoreLots struct {
+	Lots []*ScoreLot
+}
+
+func (s *sdkCli) GetScoreLots(ctx context.Context) ([]*ScoreLot, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetScoreLots")
+	r := &reqBase{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+	}
+	sp := &rspGetScoreLots{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqBase)
+		sp := rsp.(*rspGetScoreLots)
+		var err error
+		sp.Lots, err = scoreApi.GetScoreLots(ctx, r.ScoreTypeID, r.Domain, r.Uid)
+		return err
+	})
+	return sp.Lots, err
+}
+
+type reqGetWallet struct {
+	Uid string
+}
+type rspGetWallet struct {
+	Balances []*WalletBalance
+}
+
+func (s *sdkCli) GetWallet(ctx context.Context) ([]*WalletBalance, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetWallet")
+	r := &reqGetWallet{
+		Uid: s.uid,
+	}
+	sp := &rspGetWallet{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetWallet)
+		sp := rsp.(*rspGetWallet)
+		var err error
+		sp.Balances, err = scoreApi.GetWallet(ctx, r.Uid)
+		return err
+	})
+	return sp.Balances, err
+}
+
+type reqListScoreFlow struct {
+	Uid    string
+	Filter *ScoreFlowFilter
+	Cursor uint64
+	Limit  int
+}
+type rspListScoreFlow struct {
+	Flows      []*ScoreFlow
+	NextCursor uint64
+}
+
+func (s *sdkCli) ListScoreFlow(ctx context.Context, flowFilter *ScoreFlowFilter, cursor uint64, limit int) ([]*ScoreFlow, uint64, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ListScoreFlow")
+	f := ScoreFlowFilter{}
+	if flowFilter != nil {
+		f = *flowFilter
+	}
+	f.ScoreTypeIDs = []uint32{s.scoreTypeID}
+	f.Domains = []string{s.domain}
+	r := &reqListScoreFlow{
+		Uid:    s.uid,
+		Filter: &f,
+		Cursor: cursor,
+		Limit:  limit,
+	}
+	sp := &rspListScoreFlow{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqListScoreFlow)
+		sp := rsp.(*rspListScoreFlow)
+		var err error
+		sp.Flows, sp.NextCursor, err = scoreApi.ListScoreFlow(ctx, r.Uid, r.Filter, r.Cursor, r.Limit)
+		return err
+	})
+	return sp.Flows, sp.NextCursor, err
+}
+
+type reqGetUserScoreStats struct {
+	Uid    string
+	Filter *ScoreStatsFilter
+}
+type rspGetScoreStats struct {
+	Stats []*ScoreStats
+}
+
+func (s *sdkCli) GetScoreStats(ctx context.Context, period StatsPeriod, startTime int64, endTime int64) ([]*ScoreStats, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetScoreStats")
+	r := &reqGetUserScoreStats{
+		Uid: s.uid,
+		Filter: &ScoreStatsFilter{
+			ScoreTypeIDs: []uint32{s.scoreTypeID},
+			Domains:      []string{s.domain},
+			Period:       period,
+			StartTime:    startTime,
+			EndTime:      endTime,
+		},
+	}
+	sp := &rspGetScoreStats{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetUserScoreStats)
+		sp := rsp.(*rspGetScoreStats)
+		var err error
+		sp.Stats, err = scoreApi.GetUserScoreStats(ctx, r.Uid, r.Filter)
+		return err
+	})
+	return sp.Stats, err
+}
+
+type reqGetTopN struct {
+	ScoreTypeID uint32
+	Domain      string
+	N           int
+}
+type rspRankList struct {
+	List []*RankItem
+}
+
+func (s *sdkCli) GetTopN(ctx context.Context, n int) ([]*RankItem, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetTopN")
+	r := &reqGetTopN{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		N:           n,
+	}
+	sp := &rspRankList{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetTopN)
+		sp := rsp.(*rspRankList)
+		var err error
+		sp.List, err = scoreApi.GetTopN(ctx, r.ScoreTypeID, r.Domain, r.N)
+		return err
+	})
+	return sp.List, err
+}
+
+type rspGetRank struct {
+	Item *RankItem
+}
+
+func (s *sdkCli) GetRank(ctx context.Context) (*RankItem, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetRank")
+	r := &reqBase{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+	}
+	sp := &rspGetRank{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqBase)
+		sp := rsp.(*rspGetRank)
+		var err error
+		sp.Item, err = scoreApi.GetRank(ctx, r.ScoreTypeID, r.Domain, r.Uid)
+		return err
+	})
+	return sp.Item, err
+}
+
+type reqGetAround struct {
+	ScoreTypeID uint32
+	Domain      string
+	Uid         string
+	N           int
+}
+
+func (s *sdkCli) GetAround(ctx context.Context, n int) ([]*RankItem, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetAround")
+	r := &reqGetAround{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Uid:         s.uid,
+		N:           n,
+	}
+	sp := &rspRankList{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetAround)
+		sp := rsp.(*rspRankList)
+		var err error
+		sp.List, err = scoreApi.GetAround(ctx, r.ScoreTypeID, r.Domain, r.Uid, r.N)
+		return err
+	})
+	return sp.List, err
+}
+
 func NewSdk(scoreTypeID uint32, domain string, uid string) SDK {
 	return &sdkCli{
 		scoreTypeID: scoreTypeID,
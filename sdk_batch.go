@@ -0,0 +1,136 @@
+package score
+
+import (
+	"context"
+
+	"github.com/zly-app/zapp/filter"
+)
+
+// 批量操作多个用户的sdk
+type BatchSDK interface {
+	// 批量增加积分, 返回结果与 grants 一一对应, 单个用户的失败记录在结果的 Err 中
+	BatchAddScore(ctx context.Context, grants []*Grant) ([]*GrantResult, error)
+	// 批量获取积分, keys 可以是任意积分类型/域/用户, 不受sdk的积分类型和域限制. 返回结果与 keys 一一对应
+	GetScores(ctx context.Context, keys []*ScoreKey) ([]*ScoreValue, error)
+	// 统计所有用户的积分流水, 会查询所有流水分表. statsFilter 为空的积分类型和域表示sdk的积分类型和域
+	GetScoreStats(ctx context.Context, statsFilter *ScoreStatsFilter) ([]*ScoreStats, error)
+	// 获取sdk的积分类型和域的供应量
+	GetScoreTypeSupply(ctx context.Context) (*ScoreSupply, error)
+}
+
+type batchSdkCli struct {
+	scoreTypeID uint32
+	domain      string
+}
+
+type reqBatchAddScore struct {
+	ScoreTypeID uint32
+	Domain      string
+	Grants      []*Grant
+}
+type rspBatchAddScore struct {
+	Results []*GrantResult
+}
+
+func (s *batchSdkCli) BatchAddScore(ctx context.Context, grants []*Grant) ([]*GrantResult, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "BatchAddScore")
+	r := &reqBatchAddScore{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+		Grants:      grants,
+	}
+	sp := &rspBatchAddScore{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqBatchAddScore)
+		sp := rsp.(*rspBatchAddScore)
+		var err error
+		sp.Results, err = scoreApi.BatchAddScore(ctx, r.ScoreTypeID, r.Domain, r.Grants)
+		return err
+	})
+	return sp.Results, err
+}
+
+type reqGetScores struct {
+	Keys []*ScoreKey
+}
+type rspGetScores struct {
+	Values []*ScoreValue
+}
+
+func (s *batchSdkCli) GetScores(ctx context.Context, keys []*ScoreKey) ([]*ScoreValue, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetScores")
+	r := &reqGetScores{
+		Keys: keys,
+	}
+	sp := &rspGetScores{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetScores)
+		sp := rsp.(*rspGetScores)
+		var err error
+		sp.Values, err = scoreApi.GetScores(ctx, r.Keys)
+		return err
+	})
+	return sp.Values, err
+}
+
+type reqGetScoreStats struct {
+	Filter *ScoreStatsFilter
+}
+
+func (s *batchSdkCli) GetScoreStats(ctx context.Context, statsFilter *ScoreStatsFilter) ([]*ScoreStats, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetScoreStats")
+	f := ScoreStatsFilter{}
+	if statsFilter != nil {
+		f = *statsFilter
+	}
+	if len(f.ScoreTypeIDs) == 0 {
+		f.ScoreTypeIDs = []uint32{s.scoreTypeID}
+	}
+	if len(f.Domains) == 0 {
+		f.Domains = []string{s.domain}
+	}
+	r := &reqGetScoreStats{
+		Filter: &f,
+	}
+	sp := &rspGetScoreStats{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetScoreStats)
+		sp := rsp.(*rspGetScoreStats)
+		var err error
+		sp.Stats, err = scoreApi.GetScoreStats(ctx, r.Filter)
+		return err
+	})
+	return sp.Stats, err
+}
+
+type reqGetScoreTypeSupply struct {
+	ScoreTypeID uint32
+	Domain      string
+}
+type rspGetScoreTypeSupply struct {
+	Supply *ScoreSupply
+}
+
+func (s *batchSdkCli) GetScoreTypeSupply(ctx context.Context) (*ScoreSupply, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetScoreTypeSupply")
+	r := &reqGetScoreTypeSupply{
+		ScoreTypeID: s.scoreTypeID,
+		Domain:      s.domain,
+	}
+	sp := &rspGetScoreTypeSupply{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*reqGetScoreTypeSupply)
+		sp := rsp.(*rspGetScoreTypeSupply)
+		var err error
+		sp.Supply, err = scoreApi.GetScoreTypeSupply(ctx, r.ScoreTypeID, r.Domain)
+		return err
+	})
+	return sp.Supply, err
+}
+
+func NewBatchSdk(scoreTypeID uint32, domain string) BatchSDK {
+	return &batchSdkCli{
+		scoreTypeID: scoreTypeID,
+		domain:      domain,
+	}
+}
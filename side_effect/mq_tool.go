@@ -10,6 +10,13 @@ type MqTool interface {
 	Send(ctx context.Context, payload string) error
 }
 
+// 支持批量发送的mq工具, 注册的mq工具实现了这个接口时批量操作会使用 SendBatch 发送mq数据
+type BatchMqTool interface {
+	MqTool
+	// 批量发送mq数据, 要求与 Send 相同
+	SendBatch(ctx context.Context, payloads []string) error
+}
+
 var mqTool MqTool = BaseMqTool{}
 
 type BaseMqTool struct{}
@@ -2,8 +2,11 @@ package side_effect
 
 import (
 	"context"
+	"time"
 
+	"github.com/zly-app/zapp/component/gpool"
 	"github.com/zly-app/zapp/log"
+	"github.com/zly-app/zapp/pkg/utils"
 	"go.uber.org/zap"
 
 	"github.com/zlyuancn/score/dao"
@@ -29,27 +32,102 @@ func afterScoreChangeHandle(ctx context.Context, st *model.ScoreType, data *mode
 		return err
 	}
 
-	// 流水数据
+	// 处理积分变更副作用
+	flow := newScoreFlow(data, orderData, orderStatus)
+	err = processAllSideEffect(ctx, data, func(ctx context.Context, seName string, se SideEffect, st *model.ScoreType, data *model.SideEffectData) error {
+		return se.AfterScoreChange(ctx, st, data, flow)
+	})
+	if err != nil {
+		log.Error(ctx, "afterScoreChangeHandle call side_effect.TriggerScoreChange fail.", zap.Any("flow", flow), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// 生成流水数据
+func newScoreFlow(data *model.SideEffectData, orderData *model.OrderData, orderStatus model.OrderStatus) *dao.ScoreFlowModel {
 	flow := &dao.ScoreFlowModel{
 		OrderID:     data.OrderID,
 		ScoreTypeID: data.ScoreTypeID,
 		Domain:      data.Domain,
 		OpType:      uint8(orderData.OpType),
 		OpStatus:    uint8(orderStatus),
-		OldScore:    uint64(orderData.OldScore),
+		OldScore:    orderData.OldScore,
 		ChangeScore: uint64(orderData.ChangeScore),
-		ResultScore: uint64(orderData.ResultScore),
+		ResultScore: orderData.ResultScore,
 		Uid:         data.Uid,
 		Remark:      data.Remark,
+		LinkOrderID: data.LinkOrderID,
+	}
+	if data.OpTime > 0 {
+		flow.OrderTime = time.UnixMilli(data.OpTime)
 	}
+	return flow
+}
 
-	// 处理积分变更副作用
-	err = processAllSideEffect(ctx, data, func(ctx context.Context, seName string, se SideEffect, st *model.ScoreType, data *model.SideEffectData) error {
-		return se.AfterScoreChange(ctx, st, data, flow)
-	})
+// 批量触发积分变更后副作用, datas 的类型必须为积分变更后, 订单数据和状态与 datas 一一对应.
+// 副作用状态的读取和标记分别通过一个pipeline批量完成, 只能用于redis储存. 某个副作用失败时不影响其它订单, 会在守护程序中重试
+func TriggerAfterScoreChanges(ctx context.Context, st *model.ScoreType, datas []*model.SideEffectData, orderDatas []*model.OrderData,
+	orderStatuses []model.OrderStatus) error {
+	seList := seMap[model.SideEffectType_AfterScoreChange]
+	if len(datas) == 0 || len(seList) == 0 {
+		return nil
+	}
+
+	ctx = utils.Trace.CtxStart(ctx, "TriggerAfterScoreChanges")
+	defer utils.Trace.CtxEnd(ctx)
+
+	type job struct {
+		data *model.SideEffectData
+		flow *dao.ScoreFlowModel
+		name string
+		se   SideEffect
+	}
+	jobs := make([]*job, 0, len(datas)*len(seList))
+	items := make([]*dao.OrderSideEffectStatusItem, 0, cap(jobs))
+	for i, data := range datas {
+		flow := newScoreFlow(data, orderDatas[i], orderStatuses[i])
+		for name, se := range seList {
+			jobs = append(jobs, &job{data: data, flow: flow, name: name, se: se})
+			items = append(items, &dao.OrderSideEffectStatusItem{OrderID: data.OrderID, Uid: data.Uid, SideEffectName: name, SideEffectType: int(data.Type)})
+		}
+	}
+
+	// 获取订单副作用状态
+	done, err := dao.GetOrderSideEffectStatuses(ctx, items)
 	if err != nil {
-		log.Error(ctx, "afterScoreChangeHandle call side_effect.TriggerScoreChange fail.", zap.Any("flow", flow), zap.Error(err))
+		log.Error(ctx, "TriggerAfterScoreChanges call dao.GetOrderSideEffectStatuses fail.", zap.Int("count", len(items)), zap.Error(err))
 		return err
 	}
-	return nil
+
+	ok := make([]bool, len(jobs))
+	fns := make([]func() error, 0, len(jobs))
+	for i, j := range jobs {
+		if done[i] { // 已处理成功
+			continue
+		}
+		i, j := i, j
+		fns = append(fns, func() error {
+			err := callSideEffect(ctx, j.name, j.se, st, j.data, func(ctx context.Context, seName string, se SideEffect, st *model.ScoreType, data *model.SideEffectData) error {
+				return se.AfterScoreChange(ctx, st, data, j.flow)
+			})
+			ok[i] = err == nil
+			return err
+		})
+	}
+	err = gpool.GetDefGPool().GoAndWait(fns...)
+
+	// 标记成功的订单副作用状态已完成
+	marks := make([]*dao.OrderSideEffectStatusItem, 0, len(fns))
+	for i, item := range items {
+		if ok[i] {
+			marks = append(marks, item)
+		}
+	}
+	markErr := dao.MarkOrderSideEffectStatusesOk(ctx, marks, int64(st.OrderStatusExpireDay)*86400)
+	if markErr != nil {
+		log.Error(ctx, "TriggerAfterScoreChanges call dao.MarkOrderSideEffectStatusesOk fail.", zap.Int("count", len(marks)), zap.Error(markErr))
+		// 这里不影响主进程
+	}
+	return err
 }
@@ -82,17 +82,8 @@ func processAllSideEffect(ctx context.Context, data *model.SideEffectData, fn Si
 				return nil
 			}
 
-			ctx, chain := filter.GetClientFilter(ctx, "TriggerSideEffect", strconv.FormatInt(int64(data.Type), 10), name)
-			r := &triggerSideEffectAppFilterReq{
-				Data: data,
-				Name: name,
-			}
-			_, err = chain.Handle(ctx, r, func(ctx context.Context, _ interface{}) (interface{}, error) {
-				err := fn(ctx, name, se, st, data)
-				return nil, err
-			})
+			err = callSideEffect(ctx, name, se, st, data, fn)
 			if err != nil {
-				log.Error(ctx, "TriggerSideEffect call fail.", zap.Int("SideNameType", int(data.Type)), zap.String("SideEffectName", name), zap.Any("data", data), zap.Error(err))
 				return err
 			}
 
@@ -115,6 +106,23 @@ func processAllSideEffect(ctx context.Context, data *model.SideEffectData, fn Si
 	return nil
 }
 
+// 通过过滤器调用一个副作用
+func callSideEffect(ctx context.Context, name string, se SideEffect, st *model.ScoreType, data *model.SideEffectData, fn SideEffectProcess) error {
+	ctx, chain := filter.GetClientFilter(ctx, "TriggerSideEffect", strconv.FormatInt(int64(data.Type), 10), name)
+	r := &triggerSideEffectAppFilterReq{
+		Data: data,
+		Name: name,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		err := fn(ctx, name, se, st, data)
+		return nil, err
+	})
+	if err != nil {
+		log.Error(ctx, "TriggerSideEffect call fail.", zap.Int("SideNameType", int(data.Type)), zap.String("SideEffectName", name), zap.Any("data", data), zap.Error(err))
+	}
+	return err
+}
+
 // 为副作用添加一个守护程序, 延迟一定时间后触发副作用, 如果失败会延迟一定时间后对失败的副作用重试
 func AddSideEffectDaemon(ctx context.Context, data *model.SideEffectData) error {
 	payload, err := sonic.MarshalString(data)
@@ -131,6 +139,40 @@ func AddSideEffectDaemon(ctx context.Context, data *model.SideEffectData) error
 	return nil
 }
 
+// 为多个副作用添加守护程序, 如果mq工具支持批量发送则只发送一次
+func AddSideEffectDaemons(ctx context.Context, datas []*model.SideEffectData) error {
+	if len(datas) == 0 {
+		return nil
+	}
+	batchTool, ok := mqTool.(BatchMqTool)
+	if !ok {
+		for _, data := range datas {
+			err := AddSideEffectDaemon(ctx, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	payloads := make([]string, len(datas))
+	for i, data := range datas {
+		payload, err := sonic.MarshalString(data)
+		if err != nil {
+			log.Error(ctx, "AddSideEffectDaemons call MarshalString data fail.", zap.Any("data", data), zap.Error(err))
+			return err
+		}
+		payloads[i] = payload
+	}
+
+	err := batchTool.SendBatch(ctx, payloads)
+	if err != nil {
+		log.Error(ctx, "AddSideEffectDaemons call mqTool.SendBatch fail.", zap.Int("count", len(payloads)), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 /*
 立即触发副作用
 
@@ -0,0 +1,47 @@
+package score
+
+import (
+	"context"
+	"time"
+
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/log"
+	"github.com/zly-app/zapp/pkg/utils"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/score/conf"
+	"github.com/zlyuancn/score/dao"
+)
+
+// 启动mysql储存过期数据清理守护程序, 定时删除已过期的订单状态/订单副作用状态/周期配额. 只有注册了mysql储存时启动
+func startPurgeStoreExpired(app core.IApp) {
+	s, ok := dao.GetStore().(*dao.MysqlStore)
+	if !ok || conf.Conf.PurgeStoreExpiredIntervalSec < 1 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(conf.Conf.PurgeStoreExpiredIntervalSec) * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-app.BaseContext().Done():
+				return
+			case <-t.C:
+				purgeStoreExpired(app.BaseContext(), s)
+			}
+		}
+	}()
+}
+
+// 清理mysql储存中已过期的数据
+func purgeStoreExpired(ctx context.Context, s *dao.MysqlStore) {
+	ctx = utils.Trace.CtxStart(ctx, "purgeStoreExpired")
+	defer utils.Trace.CtxEnd(ctx)
+
+	n, err := s.PurgeExpired(ctx, time.Now().Unix())
+	if err != nil {
+		log.Error(ctx, "purgeStoreExpired s.PurgeExpired err", zap.Int64("deleted", n), zap.Error(err))
+		return
+	}
+	log.Info(ctx, "purgeStoreExpired done", zap.Int64("deleted", n))
+}
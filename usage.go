@@ -3,10 +3,22 @@ package score
 import (
 	"github.com/zly-app/zapp"
 	"github.com/zly-app/zapp/core"
+	"go.uber.org/zap"
 )
 
+// 启用score服务. 配置了 services.score.Bind 时启用http服务, 通过json接口提供获取积分/生成订单号/增加积分/扣除积分/重设积分/获取订单状态.
+//
+// Bind 没有指定host时(如 ":8080")只监听 127.0.0.1, 需要其它机器访问时配置为 "0.0.0.0:8080" 等明确的地址.
+// http接口可以直接修改积分, 监听非本机地址时应该配置 services.score.Token, 请求头需要携带 "Authorization: Bearer <Token>", 否则返回401
 func WithService() zapp.Option {
 	return zapp.WithCustomEnableService(func(app core.IApp, services []core.ServiceType) []core.ServiceType {
+		conf, err := parseHttpServiceConfig(app)
+		if err != nil {
+			app.Fatal("parse score http service config err", zap.Error(err))
+		}
+		if conf.Bind != "" {
+			services = append(services, HttpServiceType)
+		}
 		return services
 	})
 }